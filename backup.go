@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/libgolang/log"
+)
+
+// Backups are clones of a volume labelled <label>-bak-<timestamp>, taken
+// before the volume is attached so the changes of a bad run can be undone.
+// They are tagged one-linode-backup-of:<volume id> and only clones with the
+// tag of the volume are pruned
+const (
+	backupInfix      = "-bak-"
+	backupTimeFormat = "20060102150405"
+	backupTagPrefix  = "one-linode-backup-of:"
+)
+
+// backupPrefix prefix of the backup labels of the volume.  Long labels are
+// cut so the backup label fits and end with a hash of the full label, e.g:
+// postgres-data-1 gives postgres-c6a7-bak-
+func backupPrefix(label string) string {
+	return fitLabel(label, linodeLabelMax-len(backupInfix)-len(backupTimeFormat)) + backupInfix
+}
+
+// backupTag tag of the backups of the volume
+func backupTag(volumeID int) string {
+	return fmt.Sprintf("%s%d", backupTagPrefix, volumeID)
+}
+
+// backupTime returns when the backup was taken, from the timestamp ending
+// its label.  False when the label has none
+func backupTime(backupLabel string) (time.Time, bool) {
+	i := strings.LastIndex(backupLabel, backupInfix)
+	if i < 0 {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(backupTimeFormat, backupLabel[i+len(backupInfix):])
+	return t, err == nil
+}
+
+// isBackupOf whether the volume is a backup of the volume with the given id
+func isBackupOf(v Volume, volumeID int) bool {
+	tag := backupTag(volumeID)
+	for _, t := range v.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// cloneBeforeAttach whether the volume is backed up before it is attached
+func cloneBeforeAttach(label string) bool {
+	if *backupPtr {
+		return true
+	}
+	v, ok := mappedVolumes[label]
+	return ok && v.Backup
+}
+
+// backupVolume clones the volume to a new backup and prunes the old ones.
+// Tagging and pruning failures are only logged, the backup was taken
+func backupVolume(vol *Volume) (*Volume, error) {
+	label := vol.Label
+	backupLabel, err := newBackupLabel(label)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to back up volume %s: %s", label, err)
+	}
+	backup, err := cloneVolume(vol.ID, backupLabel)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to back up volume %s: %s", label, err)
+	}
+	if err := updateVolumeTags(backup.ID, []string{backupTag(vol.ID)}); err != nil {
+		// kept, untagged backups are never pruned
+		log.Warn("Unable to tag backup %s of volume %s: %s", backup.Label, label, err)
+	}
+	maxAge := time.Duration(*backupMaxAgePtr) * time.Hour
+	if err := pruneBackups(vol, *backupKeepPtr, maxAge); err != nil {
+		log.Warn("Unable to prune backups of volume %s: %s", label, err)
+	}
+	return backup, nil
+}
+
+// newBackupLabel returns a backup label of the volume no volume has yet.
+// The timestamp has one-second resolution, a backup taken in the same second
+// as another one gets the next free second so the labels stay in order
+func newBackupLabel(label string) (string, error) {
+	vols, err := listVolumes()
+	if err != nil {
+		return "", err
+	}
+	taken := make(map[string]bool, len(vols))
+	for _, v := range vols {
+		taken[v.Label] = true
+	}
+	for l := range dryRunVolumes {
+		taken[l] = true
+	}
+	t := time.Now().UTC()
+	for {
+		backupLabel := backupPrefix(label) + t.Format(backupTimeFormat)
+		if !taken[backupLabel] {
+			return backupLabel, nil
+		}
+		t = t.Add(time.Second)
+	}
+}
+
+// pruneBackups deletes the backups of the volume past the keep newest ones
+// and, when maxAge is set, the ones older than maxAge.  The newest backup is
+// always kept.  Clones without the backup tag of the volume are left alone
+func pruneBackups(vol *Volume, keep int, maxAge time.Duration) error {
+	vols, err := listVolumes()
+	if err != nil {
+		return err
+	}
+	type backup struct {
+		vol   Volume
+		taken time.Time
+	}
+	var backups []backup
+	for _, v := range vols {
+		if !isBackupOf(v, vol.ID) {
+			continue
+		}
+		if t, ok := backupTime(v.Label); ok {
+			backups = append(backups, backup{vol: v, taken: t})
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].taken.After(backups[j].taken) })
+
+	if keep < 1 {
+		keep = 1
+	}
+	failed := 0
+	for i, b := range backups {
+		expired := maxAge > 0 && time.Since(b.taken) > maxAge
+		if i == 0 || (i < keep && !expired) {
+			continue
+		}
+		if b.vol.LinodeID != 0 {
+			log.Warn("Backup %s is attached to linode %d, not deleting it", b.vol.Label, b.vol.LinodeID)
+			continue
+		}
+		log.Info("Deleting backup %s taken %s", b.vol.Label, b.taken.Format(time.RFC3339))
+		if err := deleteVolume(b.vol.ID); err != nil {
+			log.Warn("Unable to delete backup %s: %s", b.vol.Label, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d backups could not be deleted", failed)
+	}
+	return nil
+}
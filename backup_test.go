@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackupTime(t *testing.T) {
+	tests := []struct {
+		label string
+		ok    bool
+		want  time.Time
+	}{
+		{"data-bak-20240102030405", true, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{"my-bak-data-bak-20240102030405", true, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{"data-bak-2024", false, time.Time{}},
+		{"data-bak-", false, time.Time{}},
+		{"data", false, time.Time{}},
+	}
+	for _, tt := range tests {
+		got, ok := backupTime(tt.label)
+		if ok != tt.ok || !got.Equal(tt.want) {
+			t.Errorf("backupTime(%q) = %s, %v, want %s, %v", tt.label, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestBackupPrefix(t *testing.T) {
+	if p := backupPrefix("data"); p != "data-bak-" {
+		t.Errorf("backupPrefix(data) = %s", p)
+	}
+	a, b := backupPrefix("postgres-data-1"), backupPrefix("postgres-data-2")
+	if a == b {
+		t.Errorf("labels with a common prefix share backups %s", a)
+	}
+	for _, p := range []string{a, b} {
+		if n := len(p) + len(backupTimeFormat); n > linodeLabelMax {
+			t.Errorf("backup label %s... is %d long, linode allows %d", p, n, linodeLabelMax)
+		}
+		if !strings.HasPrefix(p, "postgres-") || !strings.HasSuffix(p, backupInfix) {
+			t.Errorf("backupPrefix = %s", p)
+		}
+	}
+}
+
+func TestBackupVolume(t *testing.T) {
+	api, _ := setupTest(t)
+	id := api.addVolume("data", "us-east", 20, 0)
+
+	backup, err := backupVolume(api.volume(id))
+	if err != nil {
+		t.Fatalf("backupVolume: %s", err)
+	}
+	v := api.volume(backup.ID)
+	if !strings.HasPrefix(v.Label, "data-bak-") || !isBackupOf(*v, id) {
+		t.Errorf("backup = %s %v", v.Label, v.Tags)
+	}
+	if _, ok := backupTime(v.Label); !ok {
+		t.Errorf("backup label %s has no timestamp", v.Label)
+	}
+}
+
+func TestBackupVolumeSameSecond(t *testing.T) {
+	api, _ := setupTest(t)
+	id := api.addVolume("data", "us-east", 20, 0)
+
+	// the backups of a quick detach and attach are taken in the same second
+	first, err := backupVolume(api.volume(id))
+	if err != nil {
+		t.Fatalf("backupVolume: %s", err)
+	}
+	second, err := backupVolume(api.volume(id))
+	if err != nil {
+		t.Fatalf("second backupVolume: %s", err)
+	}
+	if first.Label == second.Label {
+		t.Fatalf("both backups are labelled %s", first.Label)
+	}
+	t1, ok1 := backupTime(first.Label)
+	t2, ok2 := backupTime(second.Label)
+	if !ok1 || !ok2 || !t2.After(t1) {
+		t.Errorf("backups %s and %s are not in order", first.Label, second.Label)
+	}
+	if n := api.called("POST /volumes/" + strconv.Itoa(id) + "/clone"); n != 2 {
+		t.Errorf("volume cloned %d times, want 2", n)
+	}
+}
+
+func TestPruneBackups(t *testing.T) {
+	api, _ := setupTest(t)
+	id := api.addVolume("data", "us-east", 20, 0)
+	tag := backupTag(id)
+	now := time.Now().UTC()
+	label := func(age time.Duration) string {
+		return "data-bak-" + now.Add(-age).Format(backupTimeFormat)
+	}
+	newest := api.addVolume(label(time.Hour), "us-east", 20, 0, tag)
+	second := api.addVolume(label(2*time.Hour), "us-east", 20, 0, tag)
+	old := api.addVolume(label(3*time.Hour), "us-east", 20, 0, tag)
+	attached := api.addVolume(label(4*time.Hour), "us-east", 20, 1, tag)
+	untagged := api.addVolume(label(5*time.Hour), "us-east", 20, 0)
+	other := api.addVolume(label(6*time.Hour), "us-east", 20, 0, backupTag(id+1000))
+
+	if err := pruneBackups(api.volume(id), 2, 0); err != nil {
+		t.Fatalf("pruneBackups: %s", err)
+	}
+	for _, kept := range []int{newest, second, attached, untagged, other} {
+		if api.volume(kept) == nil {
+			t.Errorf("volume %d was pruned", kept)
+		}
+	}
+	if api.volume(old) != nil {
+		t.Error("backup past the keep newest was kept")
+	}
+
+	// maxAge prunes within keep, never the newest backup
+	if err := pruneBackups(api.volume(id), 5, 30*time.Minute); err != nil {
+		t.Fatalf("pruneBackups: %s", err)
+	}
+	if api.volume(newest) == nil || api.volume(second) != nil {
+		t.Errorf("newest kept %v, second kept %v, want only the newest", api.volume(newest) != nil, api.volume(second) != nil)
+	}
+}
+
+func TestPruneBackupsDeleteFailure(t *testing.T) {
+	api, _ := setupTest(t)
+	id := api.addVolume("data", "us-east", 20, 0)
+	now := time.Now().UTC()
+	api.addVolume("data-bak-"+now.Format(backupTimeFormat), "us-east", 20, 0, backupTag(id))
+	old := api.addVolume("data-bak-"+now.Add(-time.Hour).Format(backupTimeFormat), "us-east", 20, 0, backupTag(id))
+	api.failOn("DELETE /volumes/"+strconv.Itoa(old), http.StatusInternalServerError)
+
+	if err := pruneBackups(api.volume(id), 1, 0); err == nil || !strings.Contains(err.Error(), "1 backups") {
+		t.Errorf("pruneBackups = %v, want 1 backups could not be deleted", err)
+	}
+}
@@ -0,0 +1,633 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/libgolang/log"
+)
+
+// command a one-linode subcommand
+type command struct {
+	name    string
+	aliases []string
+	args    string // arguments synopsis shown in the usage
+	summary string
+	noToken bool // the command does not use the linode API
+	// run returns a slice of results.  Commands returning no results and no
+	// error wrote their own output
+	run func(c *command, args []string) (interface{}, error)
+}
+
+// usageError invalid command line.  Exits with code 2
+type usageError struct {
+	msg string
+}
+
+func (e usageError) Error() string {
+	return e.msg
+}
+
+var commands []*command
+
+func init() {
+	// assigned in init to break the initialization loop between the
+	// command table and printUsage
+	commands = []*command{
+		{name: "attach", aliases: []string{"pre"}, args: "<volume>...", summary: "Attach volumes to --host, detaching them from their current holder", run: runAttach},
+		{name: "detach", aliases: []string{"post"}, args: "[volume...]", summary: "Detach volumes from --host. Defaults to the volumes recorded for --name", run: runDetach},
+		{name: "migrate", args: "[volume...]", summary: "Move volumes from --source to --destination, unmounting and mounting them", run: runMigrate},
+		{name: "prestart", args: "< state.json", summary: "OCI prestart hook. Attaches the volumes in the one-linode.volumes annotation", run: runPrestart},
+		{name: "poststop", args: "< state.json", summary: "OCI poststop hook. Detaches the volumes of the container", run: runPoststop},
+		{name: "plugin", args: "", summary: "Serve the Docker volume plugin protocol on a unix socket", run: runPlugin},
+		{name: "watch", args: "", summary: "Attach and detach the volumes labelled on docker containers as they start and stop", run: runWatch},
+		{name: "csi", args: "", summary: "Serve the CSI Identity, Controller and Node services on a unix socket", run: runCSI},
+		{name: "install-hooks", args: "", summary: "Register the OpenNebula VM state hooks", noToken: true, run: runInstallHooks},
+		{name: "list", args: "", summary: "List the volumes of the account", run: runList},
+		{name: "status", args: "", summary: "Show the attachments recorded in the state file and where the volumes are now", run: runStatus},
+		{name: "create", args: "<volume>", summary: "Create a volume", run: runCreate},
+		{name: "delete", args: "<volume>", summary: "Delete a volume", run: runDelete},
+		{name: "resize", args: "<volume>", summary: "Grow a volume and the filesystem mounted on it", run: runResize},
+		{name: "monitor", args: "", summary: "Grow the volumes mounted on --host when their filesystem fills up", run: runMonitor},
+		{name: "plan", args: "--manifest <file>", summary: "Show the create, resize, detach and attach steps bringing the volumes to the manifest", run: runPlan},
+		{name: "apply", args: "--manifest <file>", summary: "Run the steps of plan. Detaching needs --yes", run: runApply},
+		{name: "config", args: "validate", summary: "Check the volume map of --volume-map", noToken: true, run: runConfig},
+		{name: "tm", args: "<action> <args>...", summary: "OpenNebula transfer manager driver action", run: runTM},
+	}
+}
+
+// run runs the command in args and returns the process exit code
+func run(args []string) int {
+	if *hookTypePtr != "" {
+		// --hook pre|post
+		args = append([]string{*hookTypePtr}, args...)
+	}
+	if len(args) == 0 {
+		printUsage()
+		return 2
+	}
+
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+		printUsage()
+		return 2
+	}
+	switch *outputPtr {
+	case "json", "table", "plain":
+	default:
+		fmt.Fprintf(os.Stderr, "unknown --output %q. Possible values: json|table|plain\n", *outputPtr)
+		return 2
+	}
+
+	if *templatePtr != "" {
+		vm, err := decodeVMTemplate(*templatePtr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return 1
+		}
+		applyVM(vm)
+	} else if *vmIDPtr >= 0 {
+		vm, err := lookupVM(*vmIDPtr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to look up VM %d: %s\n", *vmIDPtr, err)
+			return 1
+		}
+		applyVM(vm)
+	}
+
+	start := time.Now()
+	results, err := cmd.run(cmd, args[1:])
+	if _, ok := err.(usageError); ok {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", cmd.name, err)
+		return 2
+	} else if err == flag.ErrHelp {
+		return 0
+	}
+
+	if results == nil && err == nil {
+		return 0
+	}
+	out := &Output{Command: cmd.name, OK: err == nil, DurationMs: msSince(start), Results: results}
+	if err != nil {
+		// the log may be disabled, the error always goes to stderr
+		fmt.Fprintf(os.Stderr, "%s: %s\n", cmd.name, err)
+		out.Error = err.Error()
+	}
+	if perr := printOutput(os.Stdout, *outputPtr, out); perr != nil {
+		log.Error("Unable to print output: %s", perr)
+		return 1
+	}
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// findCommand looks up a command by name or alias
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+		for _, a := range c.aliases {
+			if a == name {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// printUsage prints the global usage
+func printUsage() {
+	out := os.Stderr
+	fmt.Fprintf(out, "Usage: one-linode [global flags] <command> [flags] [args]\n\nCommands:\n")
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, c := range commands {
+		name := c.name
+		if len(c.aliases) > 0 {
+			name = fmt.Sprintf("%s (%s)", c.name, strings.Join(c.aliases, ", "))
+		}
+		fmt.Fprintf(w, "  %s\t%s\n", name, c.summary)
+	}
+	_ = w.Flush()
+	fmt.Fprintf(out, "\nRun 'one-linode <command> --help' for the command flags.\n\nGlobal flags:\n")
+	// flag.PrintDefaults panics on the zero value of config.Var flags
+	flag.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(out, "  -%s\n    \t%s", f.Name, f.Usage)
+		if f.DefValue != "" && f.DefValue != "false" {
+			fmt.Fprintf(out, " (default %q)", f.DefValue)
+		}
+		fmt.Fprintf(out, "\n")
+	})
+}
+
+// flagSet returns the flag set of the command
+func (c *command) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: one-linode [global flags] %s [flags] %s\n\n%s\n", c.name, c.args, c.summary)
+		hasFlags := false
+		fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintf(fs.Output(), "\nFlags:\n")
+			fs.PrintDefaults()
+		}
+	}
+	return fs
+}
+
+// parse parses the command flags and checks the global configuration
+func (c *command) parse(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return err
+	} else if err != nil {
+		return usageError{err.Error()}
+	}
+	if *tokenPtr == "" && !c.noToken {
+		return usageError{"--token or $TOKEN config is required"}
+	}
+	return nil
+}
+
+// runAttach attach command.  Volumes come from the arguments and --volume,
+// or from --volume-template
+func runAttach(c *command, args []string) (interface{}, error) {
+	fs := c.flagSet()
+	if err := c.parse(fs, args); err != nil {
+		return nil, err
+	}
+	vols, err := commandVolumes(fs.Args())
+	if err != nil {
+		return nil, err
+	}
+	if len(vols) == 0 {
+		return nil, usageError{"no volumes given"}
+	}
+	results, err := attachAll(*namePtr, vols)
+	updateVMAttachments(results)
+	return results, err
+}
+
+// attachAll attaches the volumes of the container in order, stopping at the first failure
+func attachAll(containerName string, vols []string) ([]*VolumeResult, error) {
+	results := []*VolumeResult{}
+	if len(vols) > 1 {
+		if err := preflightAttach(*hostPtr, vols); err != nil {
+			return results, err
+		}
+	}
+	for _, volumeName := range vols {
+		res, err := attachOne(containerName, *hostPtr, volumeName)
+		results = append(results, res)
+		if err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+// attachOne attaches a volume to host under the volume lock and records it
+// in the state file for the container
+func attachOne(containerName, host, volumeName string) (*VolumeResult, error) {
+	start := time.Now()
+	res := &VolumeResult{Volume: volumeName, Linode: host}
+	fail := func(err error) (*VolumeResult, error) {
+		res.Error = err.Error()
+		res.DurationMs = msSince(start)
+		return res, err
+	}
+
+	// held until the attachment is recorded so a concurrent detach cannot
+	// run between the attach and the state update
+	lock, err := lockVolume(volumeName)
+	if err != nil {
+		return fail(fmt.Errorf("Unable to lock volume %s: %s", volumeName, err))
+	}
+	defer lock.Release()
+
+	if err := createMappedVolume(volumeName, host); err != nil {
+		return fail(err)
+	}
+	att, err := attachLinode(host, volumeName, cloneBeforeAttach(volumeName))
+	if err != nil {
+		return fail(err)
+	}
+	// recorded even when the mount fails so detach finds the volume
+	mountErr := mountMappedVolume(att, host)
+	res.VolumeID = att.VolumeID
+	res.LinodeID = att.LinodeID
+	res.PreviousLinodeID = att.PreviousLinodeID
+	res.FilesystemPath = att.FilesystemPath
+	res.MountPoint = att.MountPoint
+	if err := recordAttachment(*statePtr, containerName, host, att); err != nil {
+		return fail(fmt.Errorf("Unable to record attachment of %s in state file %s: %s", volumeName, *statePtr, err))
+	}
+	if mountErr != nil {
+		return fail(mountErr)
+	}
+	res.DurationMs = msSince(start)
+	return res, nil
+}
+
+// runDetach detach command
+func runDetach(c *command, args []string) (interface{}, error) {
+	fs := c.flagSet()
+	if err := c.parse(fs, args); err != nil {
+		return nil, err
+	}
+	vols, err := commandVolumes(fs.Args())
+	if err != nil {
+		return nil, err
+	}
+	if len(vols) == 0 {
+		vols = stateVolumes(*namePtr)
+	}
+	return detachAll(*namePtr, vols)
+}
+
+// detachAll detaches all the volumes of the container, carrying on after failures
+func detachAll(containerName string, vols []string) ([]*VolumeResult, error) {
+	results := []*VolumeResult{}
+	failed := 0
+	for _, volumeName := range vols {
+		res, err := detachOne(containerName, *hostPtr, volumeName)
+		results = append(results, res)
+		if err != nil {
+			log.Error("%s", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return results, fmt.Errorf("%d of %d volumes failed to detach", failed, len(vols))
+	}
+	return results, nil
+}
+
+// detachOne detaches a volume from host under the volume lock and removes
+// it from the state file of the container
+func detachOne(containerName, host, volumeName string) (*VolumeResult, error) {
+	start := time.Now()
+	res := &VolumeResult{Volume: volumeName, Linode: host}
+	fail := func(err error) (*VolumeResult, error) {
+		res.Error = err.Error()
+		res.DurationMs = msSince(start)
+		return res, err
+	}
+
+	lock, err := lockVolume(volumeName)
+	if err != nil {
+		return fail(fmt.Errorf("Unable to lock volume %s: %s", volumeName, err))
+	}
+	defer lock.Release()
+
+	if err := unmountAttachment(containerName, volumeName, host); err != nil {
+		return fail(err)
+	}
+	vol, err := detachLinode(host, volumeName)
+	if err != nil {
+		return fail(err)
+	}
+	res.VolumeID = vol.ID
+	res.PreviousLinodeID = vol.LinodeID
+	res.FilesystemPath = vol.FilesystemPath
+	res.Size = vol.Size
+	if err := removeAttachment(*statePtr, containerName, volumeName); err != nil {
+		return fail(fmt.Errorf("Unable to remove attachment of %s from state file %s: %s", volumeName, *statePtr, err))
+	}
+	res.DurationMs = msSince(start)
+	return res, nil
+}
+
+// unmountAttachment unmounts the volume before it is detached from host.
+// The mount point is the one recorded for the container in the state file,
+// whatever mounted it, or else the one of the volume map
+func unmountAttachment(containerName, volumeName, host string) error {
+	st, err := loadState(*statePtr)
+	if err != nil {
+		return fmt.Errorf("Unable to read state file %s: %s", *statePtr, err)
+	}
+	target := ""
+	if a := st.attachment(containerName, volumeName); a != nil {
+		target = a.MountPoint
+	}
+	if v, ok := mappedVolumes[volumeName]; ok && target == "" {
+		target = v.Mount
+	}
+	if target == "" {
+		return nil
+	}
+	m := mounterFor(host)
+	mounted, err := m.IsMounted(target)
+	if err != nil || !mounted {
+		return err // tm disk links are not mounted
+	}
+	return m.Unmount(target)
+}
+
+// stateVolumes returns the volumes recorded in the state file for the container
+func stateVolumes(containerName string) []string {
+	if containerName == "" {
+		return nil
+	}
+	st, err := loadState(*statePtr)
+	if err != nil {
+		log.Warn("Unable to read state file %s: %s", *statePtr, err)
+		return nil
+	}
+	var labels []string
+	if cs, ok := st.Containers[containerName]; ok {
+		for _, a := range cs.Attachments {
+			labels = append(labels, a.Label)
+		}
+	}
+	return labels
+}
+
+// runList list command
+func runList(c *command, args []string) (interface{}, error) {
+	fs := c.flagSet()
+	linodeFilter := fs.String("linode", "", "Only list volumes attached to this linode")
+	if err := c.parse(fs, args); err != nil {
+		return nil, err
+	}
+
+	vols, err := listVolumes()
+	if err != nil {
+		return nil, err
+	}
+	labels, err := linodeLabels()
+	if err != nil {
+		return nil, err
+	}
+
+	results := []VolumeInfo{}
+	for _, v := range vols {
+		if *linodeFilter != "" && labels[v.LinodeID] != *linodeFilter {
+			continue
+		}
+		results = append(results, VolumeInfo{
+			Volume:         v.Label,
+			VolumeID:       v.ID,
+			Size:           v.Size,
+			Region:         v.Region,
+			Status:         string(v.Status),
+			Linode:         labels[v.LinodeID],
+			LinodeID:       v.LinodeID,
+			FilesystemPath: v.FilesystemPath,
+		})
+	}
+	return results, nil
+}
+
+// runStatus status command
+func runStatus(c *command, args []string) (interface{}, error) {
+	fs := c.flagSet()
+	if err := c.parse(fs, args); err != nil {
+		return nil, err
+	}
+
+	st, err := loadState(*statePtr)
+	if err != nil {
+		return nil, err
+	}
+	vols, err := listVolumes()
+	if err != nil {
+		return nil, err
+	}
+	labels, err := linodeLabels()
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[int]Volume, len(vols))
+	for _, v := range vols {
+		byID[v.ID] = v
+	}
+
+	names := make([]string, 0, len(st.Containers))
+	for name := range st.Containers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	results := []StatusInfo{}
+	for _, name := range names {
+		cs := st.Containers[name]
+		for _, a := range cs.Attachments {
+			holder := "-"
+			if v, ok := byID[a.VolumeID]; !ok {
+				holder = "(deleted)"
+			} else if v.LinodeID != 0 {
+				holder = labels[v.LinodeID]
+			}
+			results = append(results, StatusInfo{
+				Container:      name,
+				Host:           cs.Host,
+				Volume:         a.Label,
+				VolumeID:       a.VolumeID,
+				FilesystemPath: a.FilesystemPath,
+				MountPoint:     a.MountPoint,
+				AttachedTo:     holder,
+			})
+		}
+	}
+	return results, nil
+}
+
+// runCreate create command
+func runCreate(c *command, args []string) (interface{}, error) {
+	fs := c.flagSet()
+	size := fs.Int("size", 20, "Size in GB")
+	region := fs.String("region", "", "Region. Defaults to the region of --host")
+	attach := fs.Bool("attach", false, "Attach the new volume to --host")
+	if err := c.parse(fs, args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() != 1 {
+		return nil, usageError{"exactly one volume label is required"}
+	}
+
+	start := time.Now()
+	req := CreateVolumeRequest{Label: fs.Arg(0), Size: *size, Region: *region}
+	if *region == "" || *attach {
+		node, err := getLinodeByName(*hostPtr)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get Linode by name(%s): %s", *hostPtr, err)
+		}
+		if *attach {
+			req.LinodeID = node.ID
+		} else {
+			req.Region = node.Region
+		}
+	}
+	vol, err := createVolume(req)
+	if err != nil {
+		return nil, err
+	}
+	res := &VolumeResult{
+		Volume:         vol.Label,
+		VolumeID:       vol.ID,
+		LinodeID:       vol.LinodeID,
+		FilesystemPath: vol.FilesystemPath,
+		Size:           vol.Size,
+		DurationMs:     msSince(start),
+	}
+	if *attach {
+		res.Linode = *hostPtr
+	}
+	return []*VolumeResult{res}, nil
+}
+
+// runDelete delete command
+func runDelete(c *command, args []string) (interface{}, error) {
+	fs := c.flagSet()
+	force := fs.Bool("force", false, "Detach the volume first when it is attached")
+	if err := c.parse(fs, args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() != 1 {
+		return nil, usageError{"exactly one volume label is required"}
+	}
+
+	start := time.Now()
+	volumeName := fs.Arg(0)
+	lock, err := lockVolume(volumeName)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Release()
+
+	vol, err := getVolumeByName(volumeName)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get Volume ID by name(%s): %s", volumeName, err)
+	}
+	if vol.LinodeID != 0 {
+		if !*force {
+			return nil, fmt.Errorf("volume %s is attached to linode %d, use --force to detach it", volumeName, vol.LinodeID)
+		}
+		if err := detachVolume(vol.ID); err != nil {
+			return nil, fmt.Errorf("Unable to detach volume %s: %s", volumeName, err)
+		}
+	}
+	if err := deleteVolume(vol.ID); err != nil {
+		return nil, err
+	}
+	return []*VolumeResult{{
+		Volume:           vol.Label,
+		VolumeID:         vol.ID,
+		PreviousLinodeID: vol.LinodeID,
+		Size:             vol.Size,
+		DurationMs:       msSince(start),
+	}}, nil
+}
+
+// runResize resize command.  Grows the filesystem when the volume is mounted
+func runResize(c *command, args []string) (interface{}, error) {
+	fs := c.flagSet()
+	size := fs.Int("size", 0, "New size in GB")
+	mount := fs.String("mount", "", "Mount point of the filesystem to grow. Defaults to the one recorded in the state file")
+	if err := c.parse(fs, args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() != 1 {
+		return nil, usageError{"exactly one volume label is required"}
+	}
+
+	start := time.Now()
+	volumeName := fs.Arg(0)
+	lock, err := lockVolume(volumeName)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Release()
+
+	vol, err := getVolumeByName(volumeName)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get Volume ID by name(%s): %s", volumeName, err)
+	}
+	if *size <= vol.Size {
+		return nil, usageError{fmt.Sprintf("--size must be greater than the current size of %dGB", vol.Size)}
+	}
+	if vol, err = waitVolumeActive(vol); err != nil {
+		return nil, err
+	}
+
+	host := ""
+	if vol.LinodeID != 0 {
+		labels, err := linodeLabels()
+		if err != nil {
+			return nil, err
+		}
+		host = labels[vol.LinodeID]
+	}
+	target := *mount
+	if target == "" && host != "" {
+		st, err := loadState(*statePtr)
+		if err != nil {
+			return nil, err
+		}
+		target = st.mountPoint(volumeName, host)
+	}
+
+	res := &VolumeResult{
+		Volume:         vol.Label,
+		VolumeID:       vol.ID,
+		Linode:         host,
+		LinodeID:       vol.LinodeID,
+		FilesystemPath: vol.FilesystemPath,
+		MountPoint:     target,
+		Size:           *size,
+	}
+	err = growVolume(vol, *size, host, target)
+	res.DurationMs = msSince(start)
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return []*VolumeResult{res}, err
+}
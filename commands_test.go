@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runCommand runs the command line and returns its exit code and stdout
+func runCommand(t *testing.T, args ...string) (int, string) {
+	t.Helper()
+	code := 0
+	out := captureStdout(t, func() { code = run(args) })
+	return code, out
+}
+
+func TestRunUsage(t *testing.T) {
+	api, _ := setupTest(t)
+	api.addVolume("data", "us-east", 20, 0)
+	tests := [][]string{
+		nil,
+		{"bogus"},
+		{"list", "--bogus"},
+		{"create"},
+		{"create", "a", "b"},
+		{"delete"},
+		{"resize", "a", "b"},
+		{"attach"},
+	}
+	for _, args := range tests {
+		if code, out := runCommand(t, args...); code != 2 || out != "" {
+			t.Errorf("%s = %d, printed %q, want 2 and nothing", strings.Join(args, " "), code, out)
+		}
+	}
+
+	*outputPtr = "yaml"
+	if code, _ := runCommand(t, "list"); code != 2 {
+		t.Errorf("--output yaml = %d, want 2", code)
+	}
+	*outputPtr = "plain"
+	*tokenPtr = ""
+	if code, _ := runCommand(t, "list"); code != 2 {
+		t.Errorf("list without a token = %d, want 2", code)
+	}
+	if n := len(api.calls); n != 0 {
+		t.Errorf("usage errors made %d API calls", n)
+	}
+}
+
+func TestRunList(t *testing.T) {
+	api, _ := setupTest(t)
+	api.addVolume("data", "us-east", 20, 1)
+	api.addVolume("spare", "eu-west", 10, 0)
+
+	code, out := runCommand(t, "list")
+	want := "volume=data volume_id=101 size=20 region=us-east status=active linode=web1 linode_id=1 filesystem_path=/dev/disk/by-id/scsi-0Linode_Volume_data\n" +
+		"volume=spare volume_id=102 size=10 region=eu-west status=active filesystem_path=/dev/disk/by-id/scsi-0Linode_Volume_spare\n"
+	if code != 0 || out != want {
+		t.Errorf("list = %d\n%s\nwant 0\n%s", code, out, want)
+	}
+
+	if code, out := runCommand(t, "list", "--linode", "web1"); code != 0 || strings.Count(out, "\n") != 1 || !strings.HasPrefix(out, "volume=data ") {
+		t.Errorf("list --linode web1 = %d %q", code, out)
+	}
+
+	api.failOn("GET /volumes", 500)
+	if code, out := runCommand(t, "list"); code != 1 || out != "" {
+		t.Errorf("list with a failing API = %d %q, want 1 and nothing", code, out)
+	}
+}
+
+func TestRunStatus(t *testing.T) {
+	api, _ := setupTest(t)
+	data := api.addVolume("data", "us-east", 20, 1)
+	moved := api.addVolume("logs", "us-east", 20, 2)
+	for _, a := range []*AttachmentState{
+		{VolumeID: data, Label: "data", LinodeID: 1, MountPoint: "/srv/data"},
+		{VolumeID: moved, Label: "logs", LinodeID: 1},
+		{VolumeID: 999, Label: "gone", LinodeID: 1},
+	} {
+		if err := recordAttachment(*statePtr, "web", "web1", a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	code, out := runCommand(t, "status")
+	want := strings.Join([]string{
+		"container=web host=web1 volume=data volume_id=" + strconv.Itoa(data) + " mount_point=/srv/data attached_to=web1",
+		"container=web host=web1 volume=logs volume_id=" + strconv.Itoa(moved) + " attached_to=db1",
+		"container=web host=web1 volume=gone volume_id=999 attached_to=(deleted)",
+		"",
+	}, "\n")
+	if code != 0 || out != want {
+		t.Errorf("status = %d\n%s\nwant 0\n%s", code, out, want)
+	}
+}
+
+func TestRunCreate(t *testing.T) {
+	api, _ := setupTest(t)
+
+	code, out := runCommand(t, "create", "--size", "30", "new")
+	v := api.volumeByLabel("new")
+	if code != 0 || v == nil || v.Region != "us-east" || v.Size != 30 || v.LinodeID != 0 {
+		t.Fatalf("create = %d, volume %+v, want 30GB in the us-east region of web1", code, v)
+	}
+	if !strings.HasPrefix(out, "volume=new volume_id="+strconv.Itoa(v.ID)+" ") || !strings.Contains(out, " size=30") {
+		t.Errorf("create printed %q", out)
+	}
+
+	code, out = runCommand(t, "create", "--attach", "--region", "us-east", "attached")
+	if v := api.volumeByLabel("attached"); code != 0 || v == nil || v.LinodeID != 1 {
+		t.Errorf("create --attach = %d, volume %+v, want it on web1", code, v)
+	}
+	if !strings.Contains(out, " linode=web1 linode_id=1 ") {
+		t.Errorf("create --attach printed %q", out)
+	}
+
+	api.failOn("POST /volumes", 400)
+	if code, out := runCommand(t, "create", "--region", "us-east", "bad"); code != 1 || out != "" {
+		t.Errorf("failed create = %d %q, want 1 and nothing", code, out)
+	}
+}
+
+func TestRunDelete(t *testing.T) {
+	api, _ := setupTest(t)
+	spare := api.addVolume("spare", "us-east", 20, 0)
+	attached := api.addVolume("data", "us-east", 20, 2)
+
+	if code, out := runCommand(t, "delete", "spare"); code != 0 || !strings.HasPrefix(out, "volume=spare volume_id="+strconv.Itoa(spare)+" ") || api.volume(spare) != nil {
+		t.Errorf("delete spare = %d %q, volume left %v", code, out, api.volume(spare) != nil)
+	}
+	if code, _ := runCommand(t, "delete", "data"); code != 1 || api.volume(attached) == nil {
+		t.Errorf("delete of an attached volume = %d, want 1 and the volume kept", code)
+	}
+	code, out := runCommand(t, "delete", "--force", "data")
+	if code != 0 || api.volume(attached) != nil || !strings.Contains(out, " previous_linode_id=2 ") {
+		t.Errorf("delete --force = %d %q, volume left %v", code, out, api.volume(attached) != nil)
+	}
+	if code, _ := runCommand(t, "delete", "missing"); code != 1 {
+		t.Errorf("delete missing = %d, want 1", code)
+	}
+}
+
+func TestRunResize(t *testing.T) {
+	api, m := setupTest(t)
+	id := api.addVolume("data", "us-east", 20, 0)
+
+	code, out := runCommand(t, "resize", "--size", "40", "data")
+	if v := api.volume(id); code != 0 || v.Size != 40 {
+		t.Fatalf("resize = %d, volume is %dGB, want 0 and 40GB", code, v.Size)
+	}
+	if !strings.HasPrefix(out, "volume=data volume_id="+strconv.Itoa(id)+" ") || !strings.Contains(out, " size=40") {
+		t.Errorf("resize printed %q", out)
+	}
+	if len(m.called()) != 0 {
+		t.Errorf("resize of a detached volume touched the filesystem: %q", m.called())
+	}
+
+	// shrinking is a usage error
+	if code, out := runCommand(t, "resize", "--size", "40", "data"); code != 2 || out != "" {
+		t.Errorf("resize to the current size = %d %q, want 2", code, out)
+	}
+	api.failOn("POST /volumes/"+strconv.Itoa(id)+"/resize", 400)
+	code, out = runCommand(t, "resize", "--size", "50", "data")
+	if code != 1 || !strings.Contains(out, " error=") {
+		t.Errorf("failed resize = %d %q, want 1 and the error in the result", code, out)
+	}
+}
+
+func TestRunAttachTwice(t *testing.T) {
+	api, m := setupTest(t)
+	id := api.addVolume("web-1-data", "us-east", 20, 0)
+	volumeMap := "containers:\n  web:\n    match: web-*\n    volumes:\n      - label: \"{{.Name}}-data\"\n        mount: /srv/web\n"
+	if err := ioutil.WriteFile(*volumeMapPtr, []byte(volumeMap), 0644); err != nil {
+		t.Fatal(err)
+	}
+	name := *namePtr
+	defer func() { *namePtr = name }()
+	*namePtr = "web-1"
+
+	attach, detach := "POST /volumes/"+strconv.Itoa(id)+"/attach", "POST /volumes/"+strconv.Itoa(id)+"/detach"
+	detaches := 0
+	for i := 0; i < 2; i++ {
+		if code, out := runCommand(t, "attach"); code != 0 {
+			t.Fatalf("attach %d = %d %q", i+1, code, out)
+		}
+		if i == 0 {
+			detaches = api.called(detach)
+		}
+	}
+	if n := api.called(attach); n != 1 {
+		t.Errorf("%d attach calls, want 1", n)
+	}
+	if n := api.called(detach) - detaches; n != 0 {
+		t.Errorf("attaching an attached volume detached it %d times", n)
+	}
+	mounts := 0
+	for _, c := range m.called() {
+		if strings.HasPrefix(c, "format-mount ") || strings.HasPrefix(c, "mount ") {
+			mounts++
+		}
+	}
+	if mounts != 1 || m.mounted("/srv/web") != api.volume(id).FilesystemPath {
+		t.Errorf("calls = %v, want a single mount on /srv/web", m.called())
+	}
+	if a := readState(t).attachment("web-1", "web-1-data"); a == nil || a.MountPoint != "/srv/web" {
+		t.Errorf("state = %+v", a)
+	}
+}
+
+// dryRunParity runs the command line for real, then with --dry-run, each
+// against a fake API prepared by setup.  The dry run must exit like the real
+// one without changing anything
+func dryRunParity(t *testing.T, setup func(api *fakeAPI), args ...string) {
+	t.Helper()
+	api, _ := setupTest(t)
+	setup(api)
+	want, _ := runCommand(t, args...)
+
+	api, _ = setupTest(t)
+	setup(api)
+	*dryRunPtr = true
+	got, _ := runCommand(t, args...)
+	if got != want {
+		t.Errorf("%s --dry-run = %d, the real run exits %d", strings.Join(args, " "), got, want)
+	}
+	for _, c := range api.calls {
+		if !strings.HasPrefix(c, "GET ") {
+			t.Errorf("%s --dry-run called %s", strings.Join(args, " "), c)
+		}
+	}
+}
+
+func TestRunDryRun(t *testing.T) {
+	lease := func(api *fakeAPI) { *leasePtr = true }
+	attached := func(api *fakeAPI, tags ...string) {
+		id := api.addVolume("data", "us-east", 20, 1, tags...)
+		if err := recordAttachment(*statePtr, "", "web1", &AttachmentState{VolumeID: id, Label: "data", LinodeID: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	leasedAttached := func(api *fakeAPI) {
+		*leasePtr = true
+		attached(api, Lease{Host: "web1", Expiry: time.Now().Add(time.Hour)}.Tag())
+	}
+	full := func(api *fakeAPI) {
+		for i := 0; i < 6; i++ {
+			api.addVolume(fmt.Sprintf("web-%d", i), "us-east", 20, 1)
+		}
+		api.addVolume("data", "us-east", 20, 0)
+	}
+	manifest := filepath.Join(t.TempDir(), "manifest.properties")
+	data := "volumes.data.linode = web1\nvolumes.data.size = 40\nvolumes.data.mount = /srv/data\nvolumes.new.linode = web1\nvolumes.new.mount = /srv/new\n"
+	if err := ioutil.WriteFile(manifest, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mapped := func(api *fakeAPI) {
+		*leasePtr = true
+		volumeMap := "containers:\n  web:\n    volumes:\n      - label: web-data\n        mount: /srv/web\n        create: true\n"
+		if err := ioutil.WriteFile(*volumeMapPtr, []byte(volumeMap), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := *namePtr
+	defer func() { *namePtr = name }()
+	*namePtr = "web"
+	spare := func(api *fakeAPI) { api.addVolume("data", "us-east", 20, 0) }
+	leasedSpare := func(api *fakeAPI) { *leasePtr = true; spare(api) }
+
+	tests := []struct {
+		name  string
+		setup func(api *fakeAPI)
+		args  []string
+	}{
+		{"create and attach", func(*fakeAPI) {}, []string{"create", "--attach", "--size", "20", "new"}},
+		{"create and attach with a lease", lease, []string{"create", "--attach", "--size", "20", "new"}},
+		{"create and attach a mapped volume with a lease", mapped, []string{"attach"}},
+		{"detach", func(api *fakeAPI) { attached(api) }, []string{"detach", "data"}},
+		{"detach with a lease", leasedAttached, []string{"detach", "data"}},
+		{"attach to a full linode", full, []string{"attach", "data"}},
+		{"apply", spare, []string{"apply", "--manifest", manifest}},
+		{"apply with a lease", leasedSpare, []string{"apply", "--manifest", manifest}},
+		{"apply of a missing manifest", spare, []string{"apply", "--manifest", manifest + ".missing"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dryRunParity(t, tt.setup, tt.args...)
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/libgolang/log"
+)
+
+// configDeviceSlots block device slots of a config profile volumes can take.
+// sda and sdb hold the disks of the linode
+var configDeviceSlots = []string{"sdc", "sdd", "sde", "sdf", "sdg", "sdh"}
+
+// ConfigDevice a block device of a config profile, a disk or a volume
+type ConfigDevice struct {
+	DiskID   *int `json:"disk_id"`
+	VolumeID *int `json:"volume_id"`
+}
+
+// LinodeConfig linode config profile
+type LinodeConfig struct {
+	ID      int                      `json:"id"`
+	Label   string                   `json:"label"`
+	Devices map[string]*ConfigDevice `json:"devices"`
+}
+
+// ListConfigResponse list config profiles response
+type ListConfigResponse struct {
+	Data    []LinodeConfig `json:"data"`
+	Page    int            `json:"page"`
+	Pages   int            `json:"pages"`
+	Results int            `json:"results"`
+}
+
+// UpdateConfigRequest config profile update request
+type UpdateConfigRequest struct {
+	Devices map[string]*ConfigDevice `json:"devices"`
+}
+
+// Event linode account event
+type Event struct {
+	ID              int          `json:"id"`
+	Action          string       `json:"action"`
+	Entity          *EventEntity `json:"entity"`
+	SecondaryEntity *EventEntity `json:"secondary_entity"`
+}
+
+// EventEntity object an event is about
+type EventEntity struct {
+	ID   int    `json:"id"`
+	Type string `json:"type"`
+}
+
+// ListEventResponse list events response
+type ListEventResponse struct {
+	Data    []Event `json:"data"`
+	Page    int     `json:"page"`
+	Pages   int     `json:"pages"`
+	Results int     `json:"results"`
+}
+
+// listConfigs returns the config profiles of the linode
+func listConfigs(linodeID int) ([]LinodeConfig, error) {
+	var configs []LinodeConfig
+	pages := 1
+	for page := 1; page <= pages; page++ {
+		url := fmt.Sprintf("%s/linode/instances/%d/configs?page=%d", *apiURLPtr, linodeID, page)
+		it, err := Get(url, &ListConfigResponse{})
+		if err != nil {
+			return nil, err
+		}
+		resp, ok := it.(*ListConfigResponse)
+		if !ok {
+			return nil, fmt.Errorf("Error casting to ListConfigResponse")
+		}
+		pages = resp.Pages
+		configs = append(configs, resp.Data...)
+	}
+	return configs, nil
+}
+
+// resolveConfig returns the config profile of the linode with the given
+// label.  An empty label is the profile the API attaches volumes with when
+// no config_id is given: the one the linode last booted.  Returns nil when
+// the linode has no config profile
+func resolveConfig(linodeID int, label string) (*LinodeConfig, error) {
+	configs, err := listConfigs(linodeID)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list config profiles of linode %d: %s", linodeID, err)
+	}
+	if label == "" {
+		switch len(configs) {
+		case 0:
+			log.Warn("Linode %d has no config profile", linodeID)
+			return nil, nil
+		case 1:
+			return &configs[0], nil
+		}
+		booted, err := lastBootedConfig(linodeID)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to find the config profile linode %d last booted: %s", linodeID, err)
+		}
+		for i := range configs {
+			if configs[i].ID == booted {
+				return &configs[i], nil
+			}
+		}
+		return nil, fmt.Errorf("linode %d has %d config profiles and no boot event telling which one it runs. Set --config-profile", linodeID, len(configs))
+	}
+	labels := make([]string, 0, len(configs))
+	for i := range configs {
+		if configs[i].Label == label {
+			return &configs[i], nil
+		}
+		labels = append(labels, configs[i].Label)
+	}
+	return nil, fmt.Errorf("linode %d has no config profile %q. Config profiles: %s", linodeID, label, strings.Join(labels, ", "))
+}
+
+// lastBootedConfig returns the id of the config profile of the latest boot
+// or reboot event of the linode, 0 when there is none
+func lastBootedConfig(linodeID int) (int, error) {
+	filter := fmt.Sprintf(`{"entity.type":"linode","entity.id":%d,"+order_by":"created","+order":"desc"}`, linodeID)
+	pages := 1
+	for page := 1; page <= pages; page++ {
+		url := fmt.Sprintf("%s/account/events?page=%d", *apiURLPtr, page)
+		it, err := GetFiltered(url, filter, &ListEventResponse{})
+		if err != nil {
+			return 0, err
+		}
+		resp, ok := it.(*ListEventResponse)
+		if !ok {
+			return 0, fmt.Errorf("Error casting to ListEventResponse")
+		}
+		pages = resp.Pages
+		for _, ev := range resp.Data {
+			if ev.Action != "linode_boot" && ev.Action != "linode_reboot" {
+				continue
+			}
+			if ev.Entity == nil || ev.Entity.ID != linodeID || ev.SecondaryEntity == nil {
+				continue
+			}
+			return ev.SecondaryEntity.ID, nil
+		}
+	}
+	return 0, nil
+}
+
+// updateConfigDevices replaces the devices of the config profile
+func updateConfigDevices(linodeID int, cfg *LinodeConfig) error {
+	url := fmt.Sprintf("%s/linode/instances/%d/configs/%d", *apiURLPtr, linodeID, cfg.ID)
+	_, err := Put(url, UpdateConfigRequest{Devices: cfg.Devices}, nil)
+	return err
+}
+
+// persistVolumeDevice puts the volume in the first free sdc..sdh slot of the
+// config profile so it keeps its device across reboots.  The profile is read
+// again, the attach may have taken a slot
+func persistVolumeDevice(linodeID, configID, volumeID int) error {
+	configs, err := listConfigs(linodeID)
+	if err != nil {
+		return fmt.Errorf("Unable to list config profiles of linode %d: %s", linodeID, err)
+	}
+	var cfg *LinodeConfig
+	for i := range configs {
+		if configs[i].ID == configID {
+			cfg = &configs[i]
+		}
+	}
+	if cfg == nil {
+		return fmt.Errorf("linode %d has no config profile %d", linodeID, configID)
+	}
+	if cfg.Devices == nil {
+		cfg.Devices = make(map[string]*ConfigDevice)
+	}
+	free := ""
+	for _, slot := range configDeviceSlots {
+		d := cfg.Devices[slot]
+		if d != nil && d.VolumeID != nil && *d.VolumeID == volumeID {
+			return nil // already there
+		}
+		if free == "" && (d == nil || (d.DiskID == nil && d.VolumeID == nil)) {
+			free = slot
+		}
+	}
+	if free == "" {
+		return fmt.Errorf("config profile %s of linode %d has no free device slot for volume %d", cfg.Label, linodeID, volumeID)
+	}
+	log.Info("Adding volume %d to config profile %s of linode %d as %s", volumeID, cfg.Label, linodeID, free)
+	cfg.Devices[free] = &ConfigDevice{VolumeID: &volumeID}
+	return updateConfigDevices(linodeID, cfg)
+}
+
+// clearVolumeDevice removes the volume from the config profiles of the linode
+func clearVolumeDevice(linodeID, volumeID int) error {
+	configs, err := listConfigs(linodeID)
+	if err != nil {
+		return fmt.Errorf("Unable to list config profiles of linode %d: %s", linodeID, err)
+	}
+	for i := range configs {
+		cfg := &configs[i]
+		changed := false
+		for slot, d := range cfg.Devices {
+			if d != nil && d.VolumeID != nil && *d.VolumeID == volumeID {
+				log.Info("Removing volume %d from %s of config profile %s of linode %d", volumeID, slot, cfg.Label, linodeID)
+				cfg.Devices[slot] = nil
+				changed = true
+			}
+		}
+		if changed {
+			if err := updateConfigDevices(linodeID, cfg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
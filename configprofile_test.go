@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestResolveConfig(t *testing.T) {
+	api, _ := setupTest(t)
+	if cfg, err := resolveConfig(1, ""); err != nil || cfg == nil || cfg.ID != 100 {
+		t.Errorf("resolveConfig of a single profile = %+v, %v, want 100", cfg, err)
+	}
+	if n := api.called("GET /account/events"); n != 0 {
+		t.Errorf("a single profile looked up %d boot events", n)
+	}
+
+	rescue := api.addConfig(1, "rescue")
+	if _, err := resolveConfig(1, ""); err == nil || !strings.Contains(err.Error(), "--config-profile") {
+		t.Errorf("resolveConfig without boot events = %v, want an error asking for --config-profile", err)
+	}
+	api.boot(1, 100)
+	api.boot(2, 200)
+	api.boot(1, rescue)
+	if cfg, err := resolveConfig(1, ""); err != nil || cfg == nil || cfg.ID != rescue {
+		t.Errorf("resolveConfig = %+v, %v, want the last booted profile %d", cfg, err, rescue)
+	}
+	if cfg, err := resolveConfig(1, "default"); err != nil || cfg == nil || cfg.ID != 100 {
+		t.Errorf("resolveConfig(default) = %+v, %v", cfg, err)
+	}
+	if _, err := resolveConfig(1, "missing"); err == nil || !strings.Contains(err.Error(), "default, rescue") {
+		t.Errorf("resolveConfig(missing) = %v, want the profiles listed", err)
+	}
+}
+
+func TestPersistVolumeDeviceRereadsProfile(t *testing.T) {
+	api, _ := setupTest(t)
+	other := api.addVolume("other", "us-east", 20, 0)
+	id := api.addVolume("data", "us-east", 20, 0)
+
+	// the attach of another volume takes sdc after the profile was resolved
+	stale, err := resolveConfig(1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.mu.Lock()
+	api.configs[1][0].Devices["sdc"] = &ConfigDevice{VolumeID: &other}
+	api.mu.Unlock()
+
+	if err := persistVolumeDevice(1, stale.ID, id); err != nil {
+		t.Fatalf("persistVolumeDevice: %s", err)
+	}
+	devices := api.config(1, stale.ID).Devices
+	if d := devices["sdc"]; d == nil || d.VolumeID == nil || *d.VolumeID != other {
+		t.Errorf("sdc = %+v, want volume %d kept", d, other)
+	}
+	if d := devices["sdd"]; d == nil || d.VolumeID == nil || *d.VolumeID != id {
+		t.Errorf("sdd = %+v, want volume %d", d, id)
+	}
+}
+
+func TestAttachPersistDevices(t *testing.T) {
+	api, _ := setupTest(t)
+	*persistDevicesPtr = true
+	rescue := api.addConfig(1, "rescue")
+	api.boot(1, rescue)
+	id := api.addVolume("data", "us-east", 20, 0)
+
+	if _, err := attachLinode("web1", "data", false); err != nil {
+		t.Fatalf("attachLinode: %s", err)
+	}
+	if d := api.config(1, rescue).Devices["sdc"]; d == nil || d.VolumeID == nil || *d.VolumeID != id {
+		t.Errorf("devices of the last booted profile = %v, want the volume in sdc", api.config(1, rescue).Devices)
+	}
+	if n := len(api.config(1, 100).Devices); n != 0 {
+		t.Errorf("the profile not booted got %d devices", n)
+	}
+	// the attach already put the volume in the profile
+	if n := api.called("PUT /linode/instances/1/configs/" + strconv.Itoa(rescue)); n != 0 {
+		t.Errorf("the profile was updated %d times, want the device of the attach kept", n)
+	}
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/libgolang/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The CSI driver serves the Identity, Controller and Node services on a
+// unix socket.  Volume ids are linode volume ids and node ids linode labels.
+// ControllerPublish attaches the volume to the linode of the node, NodeStage
+// formats and mounts it on the staging path and NodePublish bind mounts the
+// staging path on the target path
+const (
+	csiDriverName    = "csi.one-linode"
+	csiDriverVersion = "1.0.0"
+	// csiTopologyRegion topology segment holding the linode region
+	csiTopologyRegion = "topology.one-linode/region"
+	// csiDevicePath publish context key of the device of the attached volume
+	csiDevicePath = "devicePath"
+	gib           = 1 << 30
+)
+
+// csiDriver CSI services backed by linode volumes
+type csiDriver struct {
+	csi.UnimplementedIdentityServer
+	csi.UnimplementedControllerServer
+	csi.UnimplementedNodeServer
+
+	nodeID     string // linode label of the node
+	fsType     string // filesystem of volumes whose capability has none
+	deviceWait time.Duration
+	mounter    Mounter
+}
+
+// runCSI csi command.  Serves the CSI services until interrupted
+func runCSI(c *command, args []string) (interface{}, error) {
+	fs := c.flagSet()
+	endpoint := fs.String("endpoint", "unix:///run/csi/one-linode.sock", "CSI endpoint, a unix socket")
+	fsType := fs.String("fs", "ext4", "Filesystem created on empty volumes whose capability has no fs type")
+	if err := c.parse(fs, args); err != nil {
+		return nil, err
+	}
+	socket := strings.TrimPrefix(*endpoint, "unix://")
+	if strings.Contains(socket, "://") {
+		return nil, usageError{"--endpoint must be a unix socket"}
+	}
+
+	d := &csiDriver{
+		nodeID:     *hostPtr,
+		fsType:     *fsType,
+		deviceWait: 2 * time.Minute,
+		mounter:    hostMounter,
+	}
+
+	if err := os.MkdirAll(filepath.Dir(socket), 0755); err != nil {
+		return nil, err
+	}
+	_ = os.Remove(socket) // stale socket of a previous run
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = os.Remove(socket) }()
+
+	srv := grpc.NewServer(grpc.UnaryInterceptor(csiLogCalls))
+	d.register(srv)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		srv.GracefulStop()
+	}()
+
+	log.Info("Serving the CSI driver %s on %s", csiDriverName, socket)
+	if err := srv.Serve(l); err != nil {
+		return nil, err
+	}
+	return []*VolumeResult{}, nil
+}
+
+// register registers the CSI services on the grpc server
+func (d *csiDriver) register(s *grpc.Server) {
+	csi.RegisterIdentityServer(s, d)
+	csi.RegisterControllerServer(s, d)
+	csi.RegisterNodeServer(s, d)
+}
+
+// csiLogCalls logs the calls and their errors
+func csiLogCalls(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	log.Debug("%s %v", info.FullMethod, req)
+	resp, err := handler(ctx, req)
+	if err != nil {
+		log.Error("%s: %s", info.FullMethod, err)
+	}
+	return resp, err
+}
+
+// GetPluginInfo implementation of csi.IdentityServer
+func (d *csiDriver) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
+	return &csi.GetPluginInfoResponse{Name: csiDriverName, VendorVersion: csiDriverVersion}, nil
+}
+
+// GetPluginCapabilities implementation of csi.IdentityServer
+func (d *csiDriver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	var caps []*csi.PluginCapability
+	for _, t := range []csi.PluginCapability_Service_Type{
+		csi.PluginCapability_Service_CONTROLLER_SERVICE,
+		csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+	} {
+		caps = append(caps, &csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{Service: &csi.PluginCapability_Service{Type: t}},
+		})
+	}
+	return &csi.GetPluginCapabilitiesResponse{Capabilities: caps}, nil
+}
+
+// Probe implementation of csi.IdentityServer
+func (d *csiDriver) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	return &csi.ProbeResponse{}, nil
+}
+
+// CreateVolume implementation of csi.ControllerServer.  The volume label is
+// the name, cut to fit linode labels.  An existing volume with the label is
+// returned when its size is in the capacity range
+func (d *csiDriver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "name is required")
+	}
+	if err := csiCheckCapabilities(req.GetVolumeCapabilities()); err != nil {
+		return nil, err
+	}
+	size, err := csiSizeGB(req.GetCapacityRange())
+	if err != nil {
+		return nil, err
+	}
+	label := fitLabel(req.GetName(), linodeLabelMax)
+
+	lock, err := lockVolume(label)
+	if err != nil {
+		return nil, status.Errorf(codes.Aborted, "Unable to lock volume %s: %s", label, err)
+	}
+	defer lock.Release()
+
+	vol, err := getVolumeByName(label)
+	switch {
+	case err == nil:
+		bytes := int64(vol.Size) * gib
+		r := req.GetCapacityRange()
+		if bytes < r.GetRequiredBytes() || (r.GetLimitBytes() > 0 && bytes > r.GetLimitBytes()) {
+			return nil, status.Errorf(codes.AlreadyExists, "volume %s exists with %dGB", label, vol.Size)
+		}
+	case err == errVolumeNotFound:
+		region, err := d.createRegion(req)
+		if err != nil {
+			return nil, err
+		}
+		if vol, err = createVolume(CreateVolumeRequest{Label: label, Region: region, Size: size}); err != nil {
+			return nil, status.Errorf(codes.Internal, "Unable to create volume %s: %s", label, err)
+		}
+	default:
+		return nil, status.Errorf(codes.Internal, "Unable to get Volume ID by name(%s): %s", label, err)
+	}
+	return &csi.CreateVolumeResponse{Volume: csiVolume(vol)}, nil
+}
+
+// createRegion region of a new volume: the region parameter, the region of
+// the topology asked for or the region of the linode of the driver
+func (d *csiDriver) createRegion(req *csi.CreateVolumeRequest) (string, error) {
+	if r := req.GetParameters()["region"]; r != "" {
+		return r, nil
+	}
+	reqs := req.GetAccessibilityRequirements()
+	for _, t := range append(reqs.GetPreferred(), reqs.GetRequisite()...) {
+		if r := t.GetSegments()[csiTopologyRegion]; r != "" {
+			return r, nil
+		}
+	}
+	node, err := getLinodeByName(d.nodeID)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "Unable to get Linode by name(%s): %s", d.nodeID, err)
+	}
+	return node.Region, nil
+}
+
+// DeleteVolume implementation of csi.ControllerServer
+func (d *csiDriver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	vol, err := csiLookupVolume(req.GetVolumeId())
+	if status.Code(err) == codes.NotFound {
+		return &csi.DeleteVolumeResponse{}, nil // already deleted
+	} else if err != nil {
+		return nil, err
+	}
+
+	lock, err := lockVolume(vol.Label)
+	if err != nil {
+		return nil, status.Errorf(codes.Aborted, "Unable to lock volume %s: %s", vol.Label, err)
+	}
+	defer lock.Release()
+
+	if vol.LinodeID != 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is attached to linode %d", vol.Label, vol.LinodeID)
+	}
+	if err := deleteVolume(vol.ID); err != nil {
+		return nil, status.Errorf(codes.Internal, "Unable to delete volume %s: %s", vol.Label, err)
+	}
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+// ControllerPublishVolume implementation of csi.ControllerServer.  Attaches
+// the volume to the linode of the node.  Volumes attached to another linode
+// are not taken from it
+func (d *csiDriver) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	if req.GetNodeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "node id is required")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume capability is required")
+	}
+	if err := csiCheckCapabilities([]*csi.VolumeCapability{req.GetVolumeCapability()}); err != nil {
+		return nil, err
+	}
+	vol, err := csiLookupVolume(req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	node, err := getLinodeByName(req.GetNodeId())
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "Unable to get Linode by name(%s): %s", req.GetNodeId(), err)
+	}
+
+	lock, err := lockVolume(vol.Label)
+	if err != nil {
+		return nil, status.Errorf(codes.Aborted, "Unable to lock volume %s: %s", vol.Label, err)
+	}
+	defer lock.Release()
+
+	// read again, a concurrent call may have published it
+	if vol, err = csiLookupVolume(req.GetVolumeId()); err != nil {
+		return nil, err
+	}
+	switch vol.LinodeID {
+	case node.ID:
+		log.Info("Volume %s is already attached to %s", vol.Label, node.Label)
+	case 0:
+		if _, err := attachLinode(node.Label, vol.Label, cloneBeforeAttach(vol.Label)); err != nil {
+			return nil, status.Errorf(codes.Internal, "Unable to attach volume %s to %s: %s", vol.Label, node.Label, err)
+		}
+	default:
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is attached to linode %d", vol.Label, vol.LinodeID)
+	}
+	return &csi.ControllerPublishVolumeResponse{
+		PublishContext: map[string]string{csiDevicePath: vol.FilesystemPath},
+	}, nil
+}
+
+// ControllerUnpublishVolume implementation of csi.ControllerServer.  Detaches
+// the volume from the linode of the node, or from any linode when the node
+// id is empty
+func (d *csiDriver) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	vol, err := csiLookupVolume(req.GetVolumeId())
+	if status.Code(err) == codes.NotFound {
+		return &csi.ControllerUnpublishVolumeResponse{}, nil // nothing left to detach
+	} else if err != nil {
+		return nil, err
+	}
+	if vol.LinodeID == 0 {
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+
+	nodeID := req.GetNodeId()
+	if nodeID == "" {
+		labels, err := linodeLabels()
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Unable to list linodes: %s", err)
+		}
+		nodeID = labels[vol.LinodeID]
+	}
+
+	lock, err := lockVolume(vol.Label)
+	if err != nil {
+		return nil, status.Errorf(codes.Aborted, "Unable to lock volume %s: %s", vol.Label, err)
+	}
+	defer lock.Release()
+
+	// detachLinode leaves volumes attached to other linodes alone
+	if _, err := detachLinode(nodeID, vol.Label); err != nil {
+		return nil, status.Errorf(codes.Internal, "Unable to detach volume %s from %s: %s", vol.Label, nodeID, err)
+	}
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
+
+// ValidateVolumeCapabilities implementation of csi.ControllerServer
+func (d *csiDriver) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume capabilities are required")
+	}
+	if _, err := csiLookupVolume(req.GetVolumeId()); err != nil {
+		return nil, err
+	}
+	if err := csiCheckCapabilities(req.GetVolumeCapabilities()); err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: status.Convert(err).Message()}, nil
+	}
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: req.GetVolumeCapabilities(),
+			Parameters:         req.GetParameters(),
+		},
+	}, nil
+}
+
+// ControllerGetCapabilities implementation of csi.ControllerServer
+func (d *csiDriver) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
+	var caps []*csi.ControllerServiceCapability
+	for _, t := range []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+	} {
+		caps = append(caps, &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{Rpc: &csi.ControllerServiceCapability_RPC{Type: t}},
+		})
+	}
+	return &csi.ControllerGetCapabilitiesResponse{Capabilities: caps}, nil
+}
+
+// NodeStageVolume implementation of csi.NodeServer.  Formats the volume when
+// it has no filesystem and mounts it on the staging path
+func (d *csiDriver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is required")
+	}
+	if req.GetStagingTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "staging target path is required")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume capability is required")
+	}
+	if err := csiCheckCapabilities([]*csi.VolumeCapability{req.GetVolumeCapability()}); err != nil {
+		return nil, err
+	}
+	device := req.GetPublishContext()[csiDevicePath]
+	if device == "" {
+		vol, err := csiLookupVolume(req.GetVolumeId())
+		if err != nil {
+			return nil, err
+		}
+		device = vol.FilesystemPath
+	}
+
+	staging := req.GetStagingTargetPath()
+	if mounted, err := d.mounter.IsMounted(staging); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	} else if mounted {
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+	if err := d.mounter.WaitForDevice(device, d.deviceWait); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	mnt := req.GetVolumeCapability().GetMount()
+	fstype := mnt.GetFsType()
+	if fstype == "" {
+		fstype = d.fsType
+	}
+	if err := d.mounter.FormatAndMount(device, staging, fstype, strings.Join(mnt.GetMountFlags(), ",")); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// NodeUnstageVolume implementation of csi.NodeServer
+func (d *csiDriver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is required")
+	}
+	if req.GetStagingTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "staging target path is required")
+	}
+	if err := d.unmount(req.GetStagingTargetPath()); err != nil {
+		return nil, err
+	}
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+// NodePublishVolume implementation of csi.NodeServer.  Bind mounts the
+// staging path on the target path
+func (d *csiDriver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is required")
+	}
+	if req.GetStagingTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "staging target path is required")
+	}
+	if req.GetTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "target path is required")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume capability is required")
+	}
+	if err := csiCheckCapabilities([]*csi.VolumeCapability{req.GetVolumeCapability()}); err != nil {
+		return nil, err
+	}
+
+	target := req.GetTargetPath()
+	if mounted, err := d.mounter.IsMounted(target); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	} else if mounted {
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+	options := "bind"
+	if req.GetReadonly() {
+		options += ",ro"
+	}
+	if err := d.mounter.Mount(req.GetStagingTargetPath(), target, options); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// NodeUnpublishVolume implementation of csi.NodeServer
+func (d *csiDriver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is required")
+	}
+	if req.GetTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "target path is required")
+	}
+	if err := d.unmount(req.GetTargetPath()); err != nil {
+		return nil, err
+	}
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// NodeGetCapabilities implementation of csi.NodeServer
+func (d *csiDriver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	return &csi.NodeGetCapabilitiesResponse{Capabilities: []*csi.NodeServiceCapability{{
+		Type: &csi.NodeServiceCapability_Rpc{Rpc: &csi.NodeServiceCapability_RPC{
+			Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+		}},
+	}}}, nil
+}
+
+// NodeGetInfo implementation of csi.NodeServer.  Volumes take the sdc..sdh
+// slots of the linode
+func (d *csiDriver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	node, err := getLinodeByName(d.nodeID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Unable to get Linode by name(%s): %s", d.nodeID, err)
+	}
+	return &csi.NodeGetInfoResponse{
+		NodeId:             node.Label,
+		MaxVolumesPerNode:  int64(len(configDeviceSlots)),
+		AccessibleTopology: &csi.Topology{Segments: map[string]string{csiTopologyRegion: node.Region}},
+	}, nil
+}
+
+// unmount unmounts target when something is mounted on it
+func (d *csiDriver) unmount(target string) error {
+	mounted, err := d.mounter.IsMounted(target)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if !mounted {
+		return nil
+	}
+	if err := d.mounter.Unmount(target); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+// csiLookupVolume returns the volume with the given CSI volume id
+func csiLookupVolume(volumeID string) (*Volume, error) {
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is required")
+	}
+	id, err := strconv.Atoi(volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "no volume %s", volumeID)
+	}
+	vols, err := listVolumes()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Unable to list volumes: %s", err)
+	}
+	for i := range vols {
+		if vols[i].ID == id {
+			return &vols[i], nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "no volume %s", volumeID)
+}
+
+// csiVolume the CSI representation of the volume
+func csiVolume(vol *Volume) *csi.Volume {
+	return &csi.Volume{
+		VolumeId:           strconv.Itoa(vol.ID),
+		CapacityBytes:      int64(vol.Size) * gib,
+		AccessibleTopology: []*csi.Topology{{Segments: map[string]string{csiTopologyRegion: vol.Region}}},
+	}
+}
+
+// csiSizeGB size in GB of a volume created for the capacity range
+func csiSizeGB(r *csi.CapacityRange) (int, error) {
+	size := volumeMinSizeGB
+	if required := r.GetRequiredBytes(); required > int64(size)*gib {
+		size = int((required + gib - 1) / gib)
+	}
+	if limit := r.GetLimitBytes(); limit > 0 && int64(size)*gib > limit {
+		return 0, status.Errorf(codes.OutOfRange, "limit of %d bytes is below the %dGB the volume needs", limit, size)
+	}
+	return size, nil
+}
+
+// csiCheckCapabilities fails on the capabilities linode volumes lack: block
+// access and access from several nodes
+func csiCheckCapabilities(caps []*csi.VolumeCapability) error {
+	if len(caps) == 0 {
+		return status.Error(codes.InvalidArgument, "volume capabilities are required")
+	}
+	for _, c := range caps {
+		if c.GetMount() == nil {
+			return status.Error(codes.InvalidArgument, "only mount volumes are supported")
+		}
+		switch mode := c.GetAccessMode().GetMode(); mode {
+		case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+			csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+			csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER:
+		default:
+			return status.Errorf(codes.InvalidArgument, "access mode %s is not supported, linode volumes attach to a single linode", mode)
+		}
+	}
+	return nil
+}
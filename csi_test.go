@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// csiClients clients of the services of the driver
+type csiClients struct {
+	csi.IdentityClient
+	csi.ControllerClient
+	csi.NodeClient
+}
+
+// startCSI serves the driver of web1 on a unix socket and returns clients of it
+func startCSI(t *testing.T, m *fakeMounter) *csiClients {
+	t.Helper()
+	d := &csiDriver{nodeID: "web1", fsType: "ext4", deviceWait: time.Second, mounter: m}
+	socket := filepath.Join(t.TempDir(), "csi.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer(grpc.UnaryInterceptor(csiLogCalls))
+	d.register(srv)
+	go func() { _ = srv.Serve(l) }()
+
+	conn, err := grpc.NewClient("unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+		srv.Stop()
+	})
+	return &csiClients{csi.NewIdentityClient(conn), csi.NewControllerClient(conn), csi.NewNodeClient(conn)}
+}
+
+// mountCapability single node writer mount capability with fstype
+func mountCapability(fstype string, flags ...string) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fstype, MountFlags: flags}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+}
+
+// wantCode fails the test unless err has the code
+func wantCode(t *testing.T, call string, err error, code codes.Code) {
+	t.Helper()
+	if status.Code(err) != code {
+		t.Errorf("%s = %v, want %s", call, err, code)
+	}
+}
+
+func TestCSIIdentity(t *testing.T) {
+	_, m := setupTest(t)
+	c := startCSI(t, m)
+	ctx := context.Background()
+
+	info, err := c.GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+	if err != nil || info.GetName() != csiDriverName || info.GetVendorVersion() != csiDriverVersion {
+		t.Errorf("GetPluginInfo = %v, %v", info, err)
+	}
+	caps, err := c.GetPluginCapabilities(ctx, &csi.GetPluginCapabilitiesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var services []string
+	for _, pc := range caps.GetCapabilities() {
+		services = append(services, pc.GetService().GetType().String())
+	}
+	if strings.Join(services, ",") != "CONTROLLER_SERVICE,VOLUME_ACCESSIBILITY_CONSTRAINTS" {
+		t.Errorf("plugin capabilities = %v", services)
+	}
+	if _, err := c.Probe(ctx, &csi.ProbeRequest{}); err != nil {
+		t.Errorf("Probe: %s", err)
+	}
+
+	node, err := c.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.GetNodeId() != "web1" || node.GetMaxVolumesPerNode() != int64(len(configDeviceSlots)) ||
+		node.GetAccessibleTopology().GetSegments()[csiTopologyRegion] != "us-east" {
+		t.Errorf("NodeGetInfo = %v", node)
+	}
+}
+
+func TestCSILifecycle(t *testing.T) {
+	api, m := setupTest(t)
+	c := startCSI(t, m)
+	ctx := context.Background()
+	capability := mountCapability("xfs", "noatime")
+
+	create := &csi.CreateVolumeRequest{
+		Name:               "pvc-0123456789abcdef0123456789abcdef",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 15 * gib},
+		VolumeCapabilities: []*csi.VolumeCapability{capability},
+	}
+	created, err := c.CreateVolume(ctx, create)
+	if err != nil {
+		t.Fatalf("CreateVolume: %s", err)
+	}
+	vol := created.GetVolume()
+	id, _ := strconv.Atoi(vol.GetVolumeId())
+	v := api.volume(id)
+	if v == nil || v.Size != 15 || v.Region != "us-east" || len(v.Label) > linodeLabelMax {
+		t.Fatalf("created volume = %+v, want 15GB in us-east with a label that fits", v)
+	}
+	if vol.GetCapacityBytes() != 15*gib || vol.GetAccessibleTopology()[0].GetSegments()[csiTopologyRegion] != "us-east" {
+		t.Errorf("CreateVolume = %v", vol)
+	}
+	// retried creates return the same volume
+	again, err := c.CreateVolume(ctx, create)
+	if err != nil || again.GetVolume().GetVolumeId() != vol.GetVolumeId() {
+		t.Errorf("second CreateVolume = %v, %v, want volume %s", again, err, vol.GetVolumeId())
+	}
+	if n := api.called("POST /volumes"); n != 1 {
+		t.Errorf("%d volumes created, want 1", n)
+	}
+
+	publish := &csi.ControllerPublishVolumeRequest{VolumeId: vol.GetVolumeId(), NodeId: "web1", VolumeCapability: capability}
+	published, err := c.ControllerPublishVolume(ctx, publish)
+	if err != nil {
+		t.Fatalf("ControllerPublishVolume: %s", err)
+	}
+	device := published.GetPublishContext()[csiDevicePath]
+	if api.volume(id).LinodeID != 1 || device != v.FilesystemPath {
+		t.Fatalf("published to %d with device %q", api.volume(id).LinodeID, device)
+	}
+	if _, err := c.ControllerPublishVolume(ctx, publish); err != nil {
+		t.Errorf("second ControllerPublishVolume: %s", err)
+	}
+
+	staging, target := "/var/lib/kubelet/staging/pv", "/var/lib/kubelet/pods/a/volumes/pv"
+	stage := &csi.NodeStageVolumeRequest{VolumeId: vol.GetVolumeId(), PublishContext: published.GetPublishContext(), StagingTargetPath: staging, VolumeCapability: capability}
+	for i := 0; i < 2; i++ {
+		if _, err := c.NodeStageVolume(ctx, stage); err != nil {
+			t.Fatalf("NodeStageVolume: %s", err)
+		}
+	}
+	nodePublish := &csi.NodePublishVolumeRequest{VolumeId: vol.GetVolumeId(), StagingTargetPath: staging, TargetPath: target, VolumeCapability: capability, Readonly: true}
+	for i := 0; i < 2; i++ {
+		if _, err := c.NodePublishVolume(ctx, nodePublish); err != nil {
+			t.Fatalf("NodePublishVolume: %s", err)
+		}
+	}
+	want := []string{
+		"wait " + device,
+		"format-mount " + device + " " + staging + " xfs noatime",
+		"mount " + staging + " " + target + " bind,ro",
+	}
+	if calls := m.called(); strings.Join(calls, "\n") != strings.Join(want, "\n") {
+		t.Errorf("mounter calls = %q, want %q", calls, want)
+	}
+
+	// attached volumes are not deleted
+	_, err = c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: vol.GetVolumeId()})
+	wantCode(t, "DeleteVolume of an attached volume", err, codes.FailedPrecondition)
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: vol.GetVolumeId(), TargetPath: target}); err != nil {
+			t.Fatalf("NodeUnpublishVolume: %s", err)
+		}
+		if _, err := c.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: vol.GetVolumeId(), StagingTargetPath: staging}); err != nil {
+			t.Fatalf("NodeUnstageVolume: %s", err)
+		}
+		if _, err := c.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: vol.GetVolumeId(), NodeId: "web1"}); err != nil {
+			t.Fatalf("ControllerUnpublishVolume: %s", err)
+		}
+	}
+	if m.mounted(staging) != "" || m.mounted(target) != "" || api.volume(id).LinodeID != 0 {
+		t.Errorf("left mounted or attached: %v", m.called())
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: vol.GetVolumeId()}); err != nil {
+			t.Fatalf("DeleteVolume: %s", err)
+		}
+	}
+	if api.volume(id) != nil {
+		t.Error("DeleteVolume left the volume")
+	}
+}
+
+func TestCSICreateVolumeErrors(t *testing.T) {
+	api, m := setupTest(t)
+	c := startCSI(t, m)
+	ctx := context.Background()
+	caps := []*csi.VolumeCapability{mountCapability("")}
+	api.addVolume("taken", "us-east", 20, 0)
+
+	_, err := c.CreateVolume(ctx, &csi.CreateVolumeRequest{VolumeCapabilities: caps})
+	wantCode(t, "CreateVolume without name", err, codes.InvalidArgument)
+
+	block := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	_, err = c.CreateVolume(ctx, &csi.CreateVolumeRequest{Name: "a", VolumeCapabilities: []*csi.VolumeCapability{block}})
+	wantCode(t, "CreateVolume of a block volume", err, codes.InvalidArgument)
+
+	shared := mountCapability("")
+	shared.AccessMode.Mode = csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER
+	_, err = c.CreateVolume(ctx, &csi.CreateVolumeRequest{Name: "a", VolumeCapabilities: []*csi.VolumeCapability{shared}})
+	wantCode(t, "CreateVolume of a multi node volume", err, codes.InvalidArgument)
+
+	_, err = c.CreateVolume(ctx, &csi.CreateVolumeRequest{Name: "a", VolumeCapabilities: caps, CapacityRange: &csi.CapacityRange{LimitBytes: gib}})
+	wantCode(t, "CreateVolume below the minimum size", err, codes.OutOfRange)
+
+	_, err = c.CreateVolume(ctx, &csi.CreateVolumeRequest{Name: "taken", VolumeCapabilities: caps, CapacityRange: &csi.CapacityRange{RequiredBytes: 30 * gib}})
+	wantCode(t, "CreateVolume of an existing smaller volume", err, codes.AlreadyExists)
+
+	// the topology asked for gives the region
+	res, err := c.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "eu",
+		VolumeCapabilities: caps,
+		AccessibilityRequirements: &csi.TopologyRequirement{
+			Preferred: []*csi.Topology{{Segments: map[string]string{csiTopologyRegion: "eu-west"}}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume: %s", err)
+	}
+	if v := api.volumeByLabel("eu"); v == nil || v.Region != "eu-west" || v.Size != volumeMinSizeGB {
+		t.Errorf("volume = %+v, want %dGB in eu-west", v, volumeMinSizeGB)
+	}
+	if res.GetVolume().GetCapacityBytes() != volumeMinSizeGB*gib {
+		t.Errorf("capacity = %d", res.GetVolume().GetCapacityBytes())
+	}
+}
+
+func TestCSIPublishErrors(t *testing.T) {
+	api, m := setupTest(t)
+	c := startCSI(t, m)
+	ctx := context.Background()
+	capability := mountCapability("")
+	elsewhere := strconv.Itoa(api.addVolume("db-data", "us-east", 20, 2))
+	free := strconv.Itoa(api.addVolume("free", "us-east", 20, 0))
+
+	_, err := c.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: elsewhere, NodeId: "web1", VolumeCapability: capability})
+	wantCode(t, "ControllerPublishVolume of a volume attached elsewhere", err, codes.FailedPrecondition)
+	_, err = c.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: free, NodeId: "gone", VolumeCapability: capability})
+	wantCode(t, "ControllerPublishVolume to an unknown node", err, codes.NotFound)
+	_, err = c.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: "999", NodeId: "web1", VolumeCapability: capability})
+	wantCode(t, "ControllerPublishVolume of an unknown volume", err, codes.NotFound)
+	_, err = c.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: free, VolumeCapability: capability})
+	wantCode(t, "ControllerPublishVolume without node", err, codes.InvalidArgument)
+	_, err = c.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: free, NodeId: "web1"})
+	wantCode(t, "ControllerPublishVolume without capability", err, codes.InvalidArgument)
+
+	// an empty node id detaches from whichever linode holds it
+	if _, err := c.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: elsewhere}); err != nil {
+		t.Fatalf("ControllerUnpublishVolume: %s", err)
+	}
+	if id, _ := strconv.Atoi(elsewhere); api.volume(id).LinodeID != 0 {
+		t.Error("volume still attached to db1")
+	}
+	if _, err := c.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: "not-a-number", NodeId: "web1"}); err != nil {
+		t.Errorf("ControllerUnpublishVolume of an unknown volume: %s", err)
+	}
+
+	_, err = c.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{VolumeId: free, VolumeCapability: capability})
+	wantCode(t, "NodeStageVolume without staging path", err, codes.InvalidArgument)
+	_, err = c.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{VolumeId: free, StagingTargetPath: "/s", VolumeCapability: capability})
+	wantCode(t, "NodePublishVolume without target path", err, codes.InvalidArgument)
+	_, err = c.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{TargetPath: "/t"})
+	wantCode(t, "NodeUnpublishVolume without volume id", err, codes.InvalidArgument)
+}
+
+func TestCSIValidateVolumeCapabilities(t *testing.T) {
+	api, m := setupTest(t)
+	c := startCSI(t, m)
+	ctx := context.Background()
+	id := strconv.Itoa(api.addVolume("data", "us-east", 20, 0))
+
+	res, err := c.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{VolumeId: id, VolumeCapabilities: []*csi.VolumeCapability{mountCapability("ext4")}})
+	if err != nil || res.GetConfirmed() == nil {
+		t.Errorf("ValidateVolumeCapabilities = %v, %v, want confirmed", res, err)
+	}
+	shared := mountCapability("ext4")
+	shared.AccessMode.Mode = csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+	res, err = c.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{VolumeId: id, VolumeCapabilities: []*csi.VolumeCapability{shared}})
+	if err != nil || res.GetConfirmed() != nil || res.GetMessage() == "" {
+		t.Errorf("ValidateVolumeCapabilities of a multi node capability = %v, %v, want a message", res, err)
+	}
+	_, err = c.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{VolumeId: "999", VolumeCapabilities: []*csi.VolumeCapability{shared}})
+	wantCode(t, "ValidateVolumeCapabilities of an unknown volume", err, codes.NotFound)
+}
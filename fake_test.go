@@ -0,0 +1,597 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libgolang/log"
+)
+
+func TestMain(m *testing.M) {
+	log.SetWriters([]log.Writer{&stderrWriter{level: log.OTHER}}) // quiet
+	os.Exit(m.Run())
+}
+
+// fakeAPI in-memory Linode API serving the endpoints one-linode calls
+type fakeAPI struct {
+	mu       sync.Mutex
+	nodes    []Node
+	volumes  map[int]*Volume
+	disks    map[int][]Disk
+	configs  map[int][]LinodeConfig
+	events   []Event // newest first
+	nextID   int
+	calls    []string        // METHOD path of the requests
+	fail     map[string]int  // status returned for METHOD path
+	resizing map[int]int     // volume id to the GETs left before a resize lands
+	newSize  map[int]int     // size of the volumes being resized
+	onPut    func(v *Volume) // called after the tags of a volume are replaced
+	// putGate when set, tag updates signal putArrived and wait for it to be closed
+	putGate    chan struct{}
+	putArrived chan struct{}
+}
+
+// newFakeAPI returns an API holding linode web1 (id 1) and db1 (id 2) in
+// us-east and web2 (id 3) in eu-west, each with a config profile
+func newFakeAPI() *fakeAPI {
+	api := &fakeAPI{
+		volumes:  make(map[int]*Volume),
+		disks:    make(map[int][]Disk),
+		configs:  make(map[int][]LinodeConfig),
+		nextID:   100,
+		fail:     make(map[string]int),
+		resizing: make(map[int]int),
+		newSize:  make(map[int]int),
+	}
+	for _, n := range []Node{{ID: 1, Label: "web1", Region: "us-east"}, {ID: 2, Label: "db1", Region: "us-east"}, {ID: 3, Label: "web2", Region: "eu-west"}} {
+		api.nodes = append(api.nodes, n)
+		api.disks[n.ID] = []Disk{{ID: n.ID * 10, Label: "boot"}, {ID: n.ID*10 + 1, Label: "swap"}}
+		api.configs[n.ID] = []LinodeConfig{{ID: n.ID * 100, Label: "default", Devices: map[string]*ConfigDevice{}}}
+	}
+	return api
+}
+
+// addVolume adds an active volume and returns its id
+func (api *fakeAPI) addVolume(label, region string, size, linodeID int, tags ...string) int {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return api.add(&Volume{Label: label, Region: region, Size: size, LinodeID: linodeID, Tags: tags})
+}
+
+// add stores the volume under a new id
+func (api *fakeAPI) add(v *Volume) int {
+	api.nextID++
+	v.ID = api.nextID
+	v.FilesystemPath = "/dev/disk/by-id/scsi-0Linode_Volume_" + v.Label
+	if v.Status == "" {
+		v.Status = VolumeActive
+	}
+	if v.Tags == nil {
+		v.Tags = []string{}
+	}
+	api.volumes[v.ID] = v
+	return v.ID
+}
+
+// volume returns a copy of the volume, nil when deleted
+func (api *fakeAPI) volume(id int) *Volume {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	v, ok := api.volumes[id]
+	if !ok {
+		return nil
+	}
+	cp := *v
+	cp.Tags = append([]string{}, v.Tags...)
+	return &cp
+}
+
+// volumeByLabel returns a copy of the volume with the label, nil when missing
+func (api *fakeAPI) volumeByLabel(label string) *Volume {
+	api.mu.Lock()
+	id := 0
+	for _, v := range api.volumes {
+		if v.Label == label {
+			id = v.ID
+		}
+	}
+	api.mu.Unlock()
+	return api.volume(id)
+}
+
+// addConfig adds a config profile to the linode and returns its id
+func (api *fakeAPI) addConfig(linodeID int, label string) int {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	id := linodeID*100 + len(api.configs[linodeID])
+	api.configs[linodeID] = append(api.configs[linodeID], LinodeConfig{ID: id, Label: label, Devices: map[string]*ConfigDevice{}})
+	return id
+}
+
+// boot records the boot of the linode with the config profile
+func (api *fakeAPI) boot(linodeID, configID int) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	ev := Event{ID: len(api.events) + 1, Action: "linode_boot", Entity: &EventEntity{ID: linodeID, Type: "linode"}, SecondaryEntity: &EventEntity{ID: configID, Type: "linode_config"}}
+	api.events = append([]Event{ev}, api.events...)
+}
+
+// config returns the config profile of the linode
+func (api *fakeAPI) config(linodeID, configID int) *LinodeConfig {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	for i := range api.configs[linodeID] {
+		if api.configs[linodeID][i].ID == configID {
+			return &api.configs[linodeID][i]
+		}
+	}
+	return nil
+}
+
+// attachDevice puts the attached volume in the first free sdc..sdh slot of
+// the config profile, the last booted one when configID is nil, like the API
+func (api *fakeAPI) attachDevice(v *Volume, configID *int) {
+	if configID == nil {
+		for _, ev := range api.events {
+			if ev.Entity.ID == v.LinodeID {
+				configID = &ev.SecondaryEntity.ID
+				break
+			}
+		}
+	}
+	configs := api.configs[v.LinodeID]
+	cfg := -1
+	for i := range configs {
+		if configID == nil || configs[i].ID == *configID {
+			cfg = i
+			break
+		}
+	}
+	if cfg < 0 {
+		return
+	}
+	for _, slot := range configDeviceSlots {
+		if d := configs[cfg].Devices[slot]; d == nil || (d.DiskID == nil && d.VolumeID == nil) {
+			id := v.ID
+			configs[cfg].Devices[slot] = &ConfigDevice{VolumeID: &id}
+			return
+		}
+	}
+}
+
+// called returns the number of requests made to METHOD path
+func (api *fakeAPI) called(call string) int {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	n := 0
+	for _, c := range api.calls {
+		if c == call {
+			n++
+		}
+	}
+	return n
+}
+
+// failOn makes METHOD path answer with status
+func (api *fakeAPI) failOn(call string, status int) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.fail[call] = status
+}
+
+func (api *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	call := r.Method + " " + r.URL.Path
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if api.putGate != nil && r.Method == "PUT" && len(parts) == 2 && parts[0] == "volumes" {
+		select {
+		case api.putArrived <- struct{}{}:
+		default:
+		}
+		<-api.putGate
+	}
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.calls = append(api.calls, call)
+	if status, ok := api.fail[call]; ok {
+		w.WriteHeader(status)
+		return
+	}
+
+	switch {
+	case call == "GET /linode/instances":
+		api.write(w, &ListNodeResponse{Data: api.nodes, Page: 1, Pages: 1, Results: len(api.nodes)})
+	case len(parts) == 4 && parts[0] == "linode" && r.Method == "GET":
+		id, _ := strconv.Atoi(parts[2])
+		switch parts[3] {
+		case "disks":
+			api.write(w, &ListDiskResponse{Data: api.disks[id], Page: 1, Pages: 1})
+		case "volumes":
+			vols := []Volume{}
+			for _, v := range api.sorted() {
+				if v.LinodeID == id {
+					vols = append(vols, *v)
+				}
+			}
+			api.write(w, &ListVolumeResponse{Data: vols, Page: 1, Pages: 1})
+		case "configs":
+			api.write(w, &ListConfigResponse{Data: api.configs[id], Page: 1, Pages: 1})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case len(parts) == 5 && parts[0] == "linode" && parts[3] == "configs" && r.Method == "PUT":
+		id, _ := strconv.Atoi(parts[2])
+		cid, _ := strconv.Atoi(parts[4])
+		req := &UpdateConfigRequest{}
+		_ = json.NewDecoder(r.Body).Decode(req)
+		for i := range api.configs[id] {
+			if api.configs[id][i].ID == cid {
+				api.configs[id][i].Devices = req.Devices
+			}
+		}
+		api.write(w, struct{}{})
+	case call == "GET /account/events":
+		api.write(w, &ListEventResponse{Data: api.events, Page: 1, Pages: 1, Results: len(api.events)})
+	case call == "GET /volumes":
+		vols := []Volume{}
+		for _, v := range api.sorted() {
+			vols = append(vols, *v)
+		}
+		api.write(w, &ListVolumeResponse{Data: vols, Page: 1, Pages: 1, Results: len(vols)})
+	case call == "POST /volumes":
+		req := &CreateVolumeRequest{}
+		_ = json.NewDecoder(r.Body).Decode(req)
+		v := &Volume{Label: req.Label, Region: req.Region, Size: req.Size, LinodeID: req.LinodeID, Tags: req.Tags}
+		api.add(v)
+		api.write(w, v)
+	case len(parts) >= 2 && parts[0] == "volumes":
+		id, _ := strconv.Atoi(parts[1])
+		v, ok := api.volumes[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		api.serveVolume(w, r, v, parts[2:])
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// serveVolume serves /volumes/{id} and its actions
+func (api *fakeAPI) serveVolume(w http.ResponseWriter, r *http.Request, v *Volume, action []string) {
+	switch {
+	case len(action) == 0 && r.Method == "GET":
+		if left, ok := api.resizing[v.ID]; ok {
+			if left <= 0 {
+				v.Size, v.Status = api.newSize[v.ID], VolumeActive
+				delete(api.resizing, v.ID)
+			} else {
+				api.resizing[v.ID] = left - 1
+			}
+		}
+		api.write(w, v)
+	case len(action) == 0 && r.Method == "PUT":
+		req := struct {
+			Tags []string `json:"tags"`
+		}{}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		v.Tags = req.Tags
+		if api.onPut != nil {
+			api.onPut(v)
+		}
+		api.write(w, v)
+	case len(action) == 0 && r.Method == "DELETE":
+		if v.LinodeID != 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		delete(api.volumes, v.ID)
+		api.write(w, struct{}{})
+	case action[0] == "attach":
+		req := &AttachRequest{}
+		_ = json.NewDecoder(r.Body).Decode(req)
+		if v.LinodeID != 0 || req.LinodeID == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		v.LinodeID = *req.LinodeID
+		api.attachDevice(v, req.ConfigID)
+		api.write(w, v)
+	case action[0] == "detach":
+		for _, cfg := range api.configs[v.LinodeID] {
+			for slot, d := range cfg.Devices {
+				if d != nil && d.VolumeID != nil && *d.VolumeID == v.ID {
+					delete(cfg.Devices, slot)
+				}
+			}
+		}
+		v.LinodeID = 0
+		api.write(w, struct{}{})
+	case action[0] == "resize":
+		req := &ResizeVolumeRequest{}
+		_ = json.NewDecoder(r.Body).Decode(req)
+		if req.Size < v.Size {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		v.Status = VolumeResizing
+		api.newSize[v.ID] = req.Size
+		if _, ok := api.resizing[v.ID]; !ok {
+			api.resizing[v.ID] = 0
+		}
+		api.write(w, struct{}{})
+	case action[0] == "clone":
+		req := &CloneVolumeRequest{}
+		_ = json.NewDecoder(r.Body).Decode(req)
+		c := &Volume{Label: req.Label, Region: v.Region, Size: v.Size}
+		api.add(c)
+		api.write(w, c)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// sorted returns the volumes by id
+func (api *fakeAPI) sorted() []*Volume {
+	vols := make([]*Volume, 0, len(api.volumes))
+	for _, v := range api.volumes {
+		vols = append(vols, v)
+	}
+	sort.Slice(vols, func(i, j int) bool { return vols[i].ID < vols[j].ID })
+	return vols
+}
+
+func (api *fakeAPI) write(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// fakeMounter Mounter keeping the mounts and links in memory
+type fakeMounter struct {
+	mu        sync.Mutex
+	mounts    map[string]string // target to device
+	links     map[string]string // path to device
+	formatted map[string]string // device to fstype
+	usage     map[string][2]uint64
+	calls     []string
+	fail      map[string]error // error returned by an operation, e.g: mount
+	// mountGate when set, Mount and FormatAndMount wait for it to be closed
+	mountGate chan struct{}
+	mounting  chan string // receives the target of each mount reaching the gate
+}
+
+func newFakeMounter() *fakeMounter {
+	return &fakeMounter{
+		mounts:    make(map[string]string),
+		links:     make(map[string]string),
+		formatted: make(map[string]string),
+		usage:     make(map[string][2]uint64),
+		fail:      make(map[string]error),
+	}
+}
+
+// failOn makes the operation, e.g: mount, return err
+func (m *fakeMounter) failOn(op string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fail[op] = err
+}
+
+func (m *fakeMounter) record(format string, args ...interface{}) {
+	m.calls = append(m.calls, fmt.Sprintf(format, args...))
+}
+
+// called returns the calls recorded, e.g: mount /dev/x /mnt bind
+func (m *fakeMounter) called() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string{}, m.calls...)
+}
+
+// mounted returns the device mounted on target, empty when none
+func (m *fakeMounter) mounted(target string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.mounts[target]
+}
+
+func (m *fakeMounter) gate(target string) {
+	if m.mountGate == nil {
+		return
+	}
+	if m.mounting != nil {
+		m.mounting <- target
+	}
+	<-m.mountGate
+}
+
+func (m *fakeMounter) WaitForDevice(device string, timeout time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("wait %s", device)
+	return m.fail["wait"]
+}
+
+func (m *fakeMounter) Format(device, fstype string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("format %s %s", device, fstype)
+	if _, ok := m.formatted[device]; !ok {
+		m.formatted[device] = fstype
+	}
+	return nil
+}
+
+func (m *fakeMounter) FormatAndMount(device, target, fstype, options string) error {
+	m.gate(target)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("format-mount %s %s %s %s", device, target, fstype, options)
+	if err := m.fail["mount"]; err != nil {
+		return err
+	}
+	if _, ok := m.formatted[device]; !ok {
+		m.formatted[device] = fstype
+	}
+	m.mounts[target] = device
+	return nil
+}
+
+func (m *fakeMounter) Mount(device, target, options string) error {
+	m.gate(target)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("mount %s %s %s", device, target, options)
+	if err := m.fail["mount"]; err != nil {
+		return err
+	}
+	m.mounts[target] = device
+	return nil
+}
+
+func (m *fakeMounter) Unmount(target string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("unmount %s", target)
+	if _, ok := m.mounts[target]; !ok {
+		return fmt.Errorf("%s is not mounted", target)
+	}
+	delete(m.mounts, target)
+	return nil
+}
+
+func (m *fakeMounter) IsMounted(target string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.mounts[target]
+	return ok, nil
+}
+
+func (m *fakeMounter) MountedFrom(device, target string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.mounts[target] == device, nil
+}
+
+func (m *fakeMounter) Link(device, path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("link %s %s", device, path)
+	m.links[path] = device
+	return nil
+}
+
+func (m *fakeMounter) Unlink(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("unlink %s", path)
+	delete(m.links, path)
+	return nil
+}
+
+func (m *fakeMounter) Chown(path, owner string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("chown %s %s", path, owner)
+	return nil
+}
+
+func (m *fakeMounter) Rescan(device string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("rescan %s", device)
+	return nil
+}
+
+func (m *fakeMounter) GrowFilesystem(device, target string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("grow %s %s", device, target)
+	return nil
+}
+
+func (m *fakeMounter) Usage(target string) (uint64, uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.usage[target]
+	if !ok {
+		return 0, 0, fmt.Errorf("%s is not mounted", target)
+	}
+	return u[0], u[1], nil
+}
+
+// setupTest points the commands at a fake API and a fake mounter, with the
+// state file and locks in a temporary directory, as linode web1
+func setupTest(t *testing.T) (*fakeAPI, *fakeMounter) {
+	t.Helper()
+	api := newFakeAPI()
+	srv := httptest.NewServer(api)
+	m := newFakeMounter()
+	dir := t.TempDir()
+
+	apiURL, state, lockDir, lockWait, host, token := *apiURLPtr, *statePtr, *lockDirPtr, *lockWaitPtr, *hostPtr, *tokenPtr
+	volumeWait, lease, leaseTTL, dryRun, persist, backup := *volumeWaitPtr, *leasePtr, *leaseTTLPtr, *dryRunPtr, *persistDevicesPtr, *backupPtr
+	backupKeep, backupMaxAge, volumeMap, output := *backupKeepPtr, *backupMaxAgePtr, *volumeMapPtr, *outputPtr
+	hook, template, vmID := *hookTypePtr, *templatePtr, *vmIDPtr
+	poll, settle, hm, mf := volumePollInterval, leaseSettle, hostMounter, mounterFor
+	t.Cleanup(func() {
+		srv.Close()
+		*apiURLPtr, *statePtr, *lockDirPtr, *lockWaitPtr, *hostPtr, *tokenPtr = apiURL, state, lockDir, lockWait, host, token
+		*volumeWaitPtr, *leasePtr, *leaseTTLPtr, *dryRunPtr, *persistDevicesPtr, *backupPtr = volumeWait, lease, leaseTTL, dryRun, persist, backup
+		*backupKeepPtr, *backupMaxAgePtr, *volumeMapPtr, *outputPtr = backupKeep, backupMaxAge, volumeMap, output
+		*hookTypePtr, *templatePtr, *vmIDPtr = hook, template, vmID
+		volumePollInterval, leaseSettle, hostMounter, mounterFor = poll, settle, hm, mf
+		mappedVolumes = make(map[string]*volumeSpec)
+		dryRunVolumes = make(map[string]*Volume)
+	})
+
+	*apiURLPtr = srv.URL
+	*statePtr = filepath.Join(dir, "state.json")
+	*lockDirPtr = filepath.Join(dir, "locks")
+	*lockWaitPtr = 5
+	*hostPtr = "web1"
+	*tokenPtr = "test-token"
+	*volumeWaitPtr = 2
+	*leasePtr = false
+	*leaseTTLPtr = 3600
+	*dryRunPtr = false
+	*persistDevicesPtr = false
+	*backupPtr = false
+	*backupKeepPtr = 3
+	*backupMaxAgePtr = 0
+	*volumeMapPtr = filepath.Join(dir, "volumes.yaml")
+	*outputPtr = "plain"
+	*hookTypePtr = ""
+	*templatePtr = ""
+	*vmIDPtr = -1
+	volumePollInterval = time.Millisecond
+	leaseSettle = 10 * time.Millisecond
+	hostMounter = m
+	mounterFor = func(string) Mounter { return m }
+	mappedVolumes = make(map[string]*volumeSpec)
+	dryRunVolumes = make(map[string]*Volume)
+	return api, m
+}
+
+// readState returns the state file of the test
+func readState(t *testing.T) *State {
+	t.Helper()
+	st, err := loadState(*statePtr)
+	if err != nil {
+		t.Fatalf("loadState: %s", err)
+	}
+	return st
+}
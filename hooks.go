@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/libgolang/log"
+)
+
+// oneHook an OpenNebula VM state hook
+type oneHook struct {
+	name     string
+	state    string
+	lcmState string
+	args     string // one-linode arguments
+}
+
+// oneHooks the state hooks one-linode needs.  Volumes are attached when the
+// VM is prologued on a host and detached when it leaves it
+var oneHooks = []oneHook{
+	{name: "prolog", state: "ACTIVE", lcmState: "PROLOG", args: "--hook pre --template $TEMPLATE"},
+	{name: "prolog-resume", state: "ACTIVE", lcmState: "PROLOG_RESUME", args: "--hook pre --template $TEMPLATE"},
+	{name: "prolog-undeploy", state: "ACTIVE", lcmState: "PROLOG_UNDEPLOY", args: "--hook pre --template $TEMPLATE"},
+	{name: "migrate", state: "ACTIVE", lcmState: "MIGRATE", args: "--template $TEMPLATE migrate"},
+	{name: "prolog-migrate", state: "ACTIVE", lcmState: "PROLOG_MIGRATE", args: "--template $TEMPLATE migrate"},
+	{name: "epilog", state: "ACTIVE", lcmState: "EPILOG", args: "--hook post --template $TEMPLATE"},
+	{name: "stop", state: "STOPPED", lcmState: "LCM_INIT", args: "--hook post --template $TEMPLATE"},
+	{name: "undeploy", state: "UNDEPLOYED", lcmState: "LCM_INIT", args: "--hook post --template $TEMPLATE"},
+}
+
+// HookResult a hook registered in OpenNebula
+type HookResult struct {
+	Hook     string `json:"hook"`
+	HookID   int    `json:"hook_id"`
+	State    string `json:"state"`
+	Existing bool   `json:"existing"` // registered by an earlier run and left as is
+}
+
+// template returns the OpenNebula 5.10+ hook template
+func (h oneHook) template(prefix, command string) string {
+	lines := []string{
+		fmt.Sprintf("NAME = %q", prefix+"-"+h.name),
+		`TYPE = "state"`,
+		`RESOURCE = "VM"`,
+		`ON = "CUSTOM"`,
+		fmt.Sprintf("STATE = %q", h.state),
+		fmt.Sprintf("LCM_STATE = %q", h.lcmState),
+		fmt.Sprintf("COMMAND = %q", command),
+		fmt.Sprintf("ARGUMENTS = %q", h.args),
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// runInstallHooks install-hooks command
+func runInstallHooks(c *command, args []string) (interface{}, error) {
+	fs := c.flagSet()
+	printOnly := fs.Bool("print", false, "Print the hook templates instead of registering them")
+	command := fs.String("command", "/usr/bin/one-linode", "Path of one-linode on the front-end")
+	prefix := fs.String("prefix", "one-linode", "Prefix of the hook names")
+	if err := c.parse(fs, args); err != nil {
+		return nil, err
+	}
+
+	if *printOnly {
+		for i, h := range oneHooks {
+			if i > 0 {
+				fmt.Fprintln(os.Stdout)
+			}
+			fmt.Fprint(os.Stdout, h.template(*prefix, *command))
+		}
+		return nil, nil
+	}
+
+	client, err := newOneClient()
+	if err != nil {
+		return nil, err
+	}
+	existing, err := client.hookIDs()
+	if err != nil {
+		return nil, err
+	}
+	results := []HookResult{}
+	for _, h := range oneHooks {
+		name := *prefix + "-" + h.name
+		res := HookResult{Hook: name, State: h.state + "/" + h.lcmState}
+		if id, ok := existing[name]; ok {
+			log.Info("Hook %s is already registered as hook %d", name, id)
+			res.HookID, res.Existing = id, true
+			results = append(results, res)
+			continue
+		}
+		id, err := client.call("one.hook.allocate", h.template(*prefix, *command))
+		if err != nil {
+			return results, err
+		}
+		res.HookID, _ = id.(int)
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// hookIDs returns the ids of the registered hooks by name
+func (c *oneClient) hookIDs() (map[string]int, error) {
+	data, err := c.callXML("one.hooklist.info", -2, -1, -1)
+	if err != nil {
+		return nil, err
+	}
+	root := &xmlNode{}
+	if err := xml.Unmarshal(data, root); err != nil {
+		return nil, fmt.Errorf("unable to parse hook pool: %s", err)
+	}
+	ids := make(map[string]int)
+	for _, h := range root.children("HOOK") {
+		if id, err := strconv.Atoi(h.text("ID")); err == nil {
+			ids[h.text("NAME")] = id
+		}
+	}
+	return ids, nil
+}
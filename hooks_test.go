@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInstallHooks(t *testing.T) {
+	setupTest(t)
+	s := startOneStub(t)
+	// prolog was registered by an earlier run
+	s.hooks = []string{"other-hook", "one-linode-prolog"}
+
+	code, out := runCommand(t, "install-hooks")
+	if code != 0 {
+		t.Fatalf("install-hooks = %d", code)
+	}
+	if len(s.hooks) != 2+len(oneHooks)-1 {
+		t.Errorf("hooks = %v, want each one-linode hook once", s.hooks)
+	}
+	seen := make(map[string]int)
+	for _, name := range s.hooks {
+		seen[name]++
+	}
+	for _, h := range oneHooks {
+		if n := seen["one-linode-"+h.name]; n != 1 {
+			t.Errorf("hook %s registered %d times", h.name, n)
+		}
+	}
+	if !strings.HasPrefix(out, "hook=one-linode-prolog hook_id=1 state=ACTIVE/PROLOG existing=true\n") {
+		t.Errorf("install-hooks printed %q", out)
+	}
+
+	// a second run registers nothing
+	n := len(s.hooks)
+	if code, out := runCommand(t, "install-hooks"); code != 0 || strings.Count(out, "existing=true") != len(oneHooks) {
+		t.Errorf("second install-hooks = %d %q", code, out)
+	}
+	if len(s.hooks) != n {
+		t.Errorf("second run registered %d hooks", len(s.hooks)-n)
+	}
+}
+
+func TestInstallHooksPrint(t *testing.T) {
+	setupTest(t)
+	s := startOneStub(t)
+	code, out := runCommand(t, "install-hooks", "--print", "--prefix", "ol", "--command", "/opt/one-linode")
+	if code != 0 || len(s.calls) != 0 {
+		t.Fatalf("install-hooks --print = %d with %d calls", code, len(s.calls))
+	}
+	want := `NAME = "ol-prolog"
+TYPE = "state"
+RESOURCE = "VM"
+ON = "CUSTOM"
+STATE = "ACTIVE"
+LCM_STATE = "PROLOG"
+COMMAND = "/opt/one-linode"
+ARGUMENTS = "--hook pre --template $TEMPLATE"
+
+`
+	if !strings.HasPrefix(out, want) || strings.Count(out, "NAME = ") != len(oneHooks) {
+		t.Errorf("install-hooks --print printed\n%s", out)
+	}
+}
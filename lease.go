@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/libgolang/log"
+)
+
+const leaseTagPrefix = "one-linode-lease:"
+
+// leaseSettle time to let a concurrent tag update from another host land
+// before checking whether our lease won
+var leaseSettle = 2 * time.Second
+
+// Lease a cluster-wide claim on a volume stored as a volume tag of the form
+// one-linode-lease:<host>:<expiry unix seconds>
+type Lease struct {
+	Host   string
+	Expiry time.Time
+}
+
+// Tag returns the tag representation of the lease
+func (l Lease) Tag() string {
+	return fmt.Sprintf("%s%s:%d", leaseTagPrefix, l.Host, l.Expiry.Unix())
+}
+
+// Expired whether the lease is no longer valid
+func (l Lease) Expired() bool {
+	return !time.Now().Before(l.Expiry)
+}
+
+// parseLease parses a lease tag, ok is false for non lease tags
+func parseLease(tag string) (lease Lease, ok bool) {
+	if !strings.HasPrefix(tag, leaseTagPrefix) {
+		return lease, false
+	}
+	rest := strings.TrimPrefix(tag, leaseTagPrefix)
+	i := strings.LastIndex(rest, ":")
+	if i <= 0 {
+		return lease, false
+	}
+	expiry, err := strconv.ParseInt(rest[i+1:], 10, 64)
+	if err != nil {
+		return lease, false
+	}
+	return Lease{Host: rest[:i], Expiry: time.Unix(expiry, 0)}, true
+}
+
+// splitLeaseTags separates the lease tags of a volume from the rest of its tags
+func splitLeaseTags(tags []string) (leases []Lease, others []string) {
+	for _, t := range tags {
+		if l, ok := parseLease(t); ok {
+			leases = append(leases, l)
+		} else {
+			others = append(others, t)
+		}
+	}
+	return leases, others
+}
+
+// acquireLease claims the volume for host.  The lease is only taken when no
+// other host holds an unexpired lease.  The Linode API has no conditional
+// update, so after writing the tag the volume is read back.  When the tags of
+// concurrent hosts landed, the lowest unexpired lease tag wins and the other
+// hosts remove their own lease
+func acquireLease(volume *Volume, host string, ttl time.Duration) error {
+	current, err := readVolumeTags(volume)
+	if err != nil {
+		return err
+	}
+	leases, others := splitLeaseTags(current.Tags)
+	for _, l := range leases {
+		if l.Host != host && !l.Expired() {
+			return fmt.Errorf("volume %s is leased by %s until %s", volume.Label, l.Host, l.Expiry.Format(time.RFC3339))
+		}
+	}
+
+	lease := Lease{Host: host, Expiry: time.Now().Add(ttl)}
+	log.Info("Taking lease %s on volume %d", lease.Tag(), volume.ID)
+	if err := updateVolumeTags(volume.ID, append(others, lease.Tag())); err != nil {
+		return err
+	}
+	if *dryRunPtr {
+		return nil // the tags did not change, nothing to verify
+	}
+
+	time.Sleep(leaseSettle)
+	check, err := getVolume(volume.ID)
+	if err != nil {
+		return err
+	}
+	leases, _ = splitLeaseTags(check.Tags)
+	ours := false
+	winner := ""
+	for _, l := range leases {
+		if l.Expired() {
+			continue
+		}
+		ours = ours || l.Tag() == lease.Tag()
+		if winner == "" || l.Tag() < winner {
+			winner = l.Tag()
+		}
+	}
+	if !ours {
+		return fmt.Errorf("lost lease race on volume %s: found leases %v", volume.Label, leases)
+	}
+	if winner != lease.Tag() {
+		log.Info("Lease %s on volume %d lost to %s, removing it", lease.Tag(), volume.ID, winner)
+		var tags []string
+		for _, t := range check.Tags {
+			if t != lease.Tag() {
+				tags = append(tags, t)
+			}
+		}
+		if err := updateVolumeTags(volume.ID, tags); err != nil {
+			log.Warn("Unable to remove lease %s from volume %d: %s", lease.Tag(), volume.ID, err)
+		}
+		return fmt.Errorf("lost lease race on volume %s: found leases %v", volume.Label, leases)
+	}
+	return nil
+}
+
+// releaseLease removes the leases held by host from the volume.  Leases
+// held by other hosts are left untouched
+func releaseLease(volume *Volume, host string) error {
+	current, err := readVolumeTags(volume)
+	if err != nil {
+		return err
+	}
+	leases, others := splitLeaseTags(current.Tags)
+	tags := others
+	released := false
+	for _, l := range leases {
+		if l.Host == host {
+			released = true
+			continue
+		}
+		log.Warn("Volume %s is leased by %s, not releasing", volume.Label, l.Host)
+		tags = append(tags, l.Tag())
+	}
+	if !released {
+		return nil
+	}
+	log.Info("Releasing lease of %s on volume %d", host, volume.ID)
+	return updateVolumeTags(volume.ID, tags)
+}
+
+// readVolumeTags reads the volume back for its current tags.  A --dry-run
+// placeholder has only the tags it was created with
+func readVolumeTags(volume *Volume) (*Volume, error) {
+	if dryRunPlaceholder(volume) {
+		return volume, nil
+	}
+	return getVolume(volume.ID)
+}
+
+// getVolume returns the volume with the given id
+func getVolume(volumeID int) (*Volume, error) {
+	it, err := Get(fmt.Sprintf("%s/volumes/%d", *apiURLPtr, volumeID), &Volume{})
+	if err != nil {
+		return nil, err
+	}
+	return it.(*Volume), nil
+}
+
+// updateVolumeTags replaces the tags of a volume
+func updateVolumeTags(volumeID int, tags []string) error {
+	if tags == nil {
+		tags = []string{}
+	}
+	body := map[string]interface{}{"tags": tags}
+	_, err := Put(fmt.Sprintf("%s/volumes/%d", *apiURLPtr, volumeID), body, nil)
+	return err
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseLease(t *testing.T) {
+	tests := []struct {
+		tag  string
+		ok   bool
+		host string
+		unix int64
+	}{
+		{"one-linode-lease:web1:1500000000", true, "web1", 1500000000},
+		{"one-linode-lease:web1.example.com:42", true, "web1.example.com", 42},
+		{"one-linode-lease:host:with:colons:7", true, "host:with:colons", 7},
+		{"one-linode-lease::42", false, "", 0},
+		{"one-linode-lease:web1", false, "", 0},
+		{"one-linode-lease:web1:soon", false, "", 0},
+		{"one-linode-backup-of:12", false, "", 0},
+		{"other", false, "", 0},
+	}
+	for _, tt := range tests {
+		l, ok := parseLease(tt.tag)
+		if ok != tt.ok {
+			t.Errorf("parseLease(%q) ok = %v, want %v", tt.tag, ok, tt.ok)
+			continue
+		}
+		if ok && (l.Host != tt.host || l.Expiry.Unix() != tt.unix) {
+			t.Errorf("parseLease(%q) = %s %d, want %s %d", tt.tag, l.Host, l.Expiry.Unix(), tt.host, tt.unix)
+		}
+		if ok && l.Tag() != tt.tag {
+			t.Errorf("parseLease(%q).Tag() = %q", tt.tag, l.Tag())
+		}
+	}
+}
+
+// leases returns the lease tags of the volume
+func leases(api *fakeAPI, id int) []Lease {
+	l, _ := splitLeaseTags(api.volume(id).Tags)
+	return l
+}
+
+func TestAcquireLeaseKeepsOtherTags(t *testing.T) {
+	api, _ := setupTest(t)
+	expired := Lease{Host: "web1", Expiry: time.Now().Add(-time.Hour)}.Tag()
+	id := api.addVolume("data", "us-east", 20, 0, "env:prod", expired)
+
+	if err := acquireLease(api.volume(id), "web1", time.Hour); err != nil {
+		t.Fatalf("acquireLease: %s", err)
+	}
+	v := api.volume(id)
+	l := leases(api, id)
+	if len(l) != 1 || l[0].Host != "web1" || l[0].Expired() {
+		t.Errorf("leases = %v, want one unexpired lease of web1", l)
+	}
+	if v.Tags[0] != "env:prod" {
+		t.Errorf("tags = %v, lost env:prod", v.Tags)
+	}
+}
+
+func TestAcquireLeaseHeldByOtherHost(t *testing.T) {
+	api, _ := setupTest(t)
+	held := Lease{Host: "db1", Expiry: time.Now().Add(time.Hour)}.Tag()
+	id := api.addVolume("data", "us-east", 20, 0, held)
+
+	err := acquireLease(api.volume(id), "web1", time.Hour)
+	if err == nil || !strings.Contains(err.Error(), "leased by db1") {
+		t.Fatalf("acquireLease = %v, want leased by db1", err)
+	}
+	if tags := api.volume(id).Tags; len(tags) != 1 || tags[0] != held {
+		t.Errorf("tags = %v, want the lease of db1 untouched", tags)
+	}
+}
+
+func TestAcquireLeaseTakesExpiredLease(t *testing.T) {
+	api, _ := setupTest(t)
+	id := api.addVolume("data", "us-east", 20, 0, Lease{Host: "db1", Expiry: time.Now().Add(-time.Minute)}.Tag())
+
+	if err := acquireLease(api.volume(id), "web1", time.Hour); err != nil {
+		t.Fatalf("acquireLease: %s", err)
+	}
+	if l := leases(api, id); len(l) != 1 || l[0].Host != "web1" {
+		t.Errorf("leases = %v, want only web1", l)
+	}
+}
+
+func TestAcquireLeaseLostRace(t *testing.T) {
+	api, _ := setupTest(t)
+	id := api.addVolume("data", "us-east", 20, 0)
+	// db1 writes its lease while web1 lets the update settle
+	api.onPut = func(v *Volume) {
+		v.Tags = append(v.Tags, Lease{Host: "db1", Expiry: time.Now().Add(time.Hour)}.Tag())
+		api.onPut = nil
+	}
+
+	err := acquireLease(api.volume(id), "web1", time.Hour)
+	if err == nil || !strings.Contains(err.Error(), "lost lease race") {
+		t.Fatalf("acquireLease = %v, want lost lease race", err)
+	}
+	// the lower lease of db1 wins, web1 removed its own
+	if l := leases(api, id); len(l) != 1 || l[0].Host != "db1" {
+		t.Errorf("leases = %v, want only db1", l)
+	}
+}
+
+func TestAcquireLeaseWinsOverHigherLease(t *testing.T) {
+	api, _ := setupTest(t)
+	id := api.addVolume("data", "us-east", 20, 0)
+	api.onPut = func(v *Volume) {
+		v.Tags = append(v.Tags, Lease{Host: "zz1", Expiry: time.Now().Add(time.Hour)}.Tag())
+		api.onPut = nil
+	}
+
+	if err := acquireLease(api.volume(id), "web1", time.Hour); err != nil {
+		t.Fatalf("acquireLease: %s", err)
+	}
+	// zz1 removes its own lease when it reads the volume back
+	if l := leases(api, id); len(l) != 2 {
+		t.Errorf("leases = %v, want both leases left to zz1", l)
+	}
+}
+
+func TestAcquireLeaseConcurrentHosts(t *testing.T) {
+	api, _ := setupTest(t)
+	id := api.addVolume("data", "us-east", 20, 0)
+	vol := api.volume(id)
+	// both hosts read the volume before either writes its lease
+	api.putGate = make(chan struct{})
+	api.putArrived = make(chan struct{}, 2)
+
+	hosts := []string{"web1", "db1"}
+	errs := make([]error, len(hosts))
+	var wg sync.WaitGroup
+	for i, h := range hosts {
+		wg.Add(1)
+		go func(i int, h string) {
+			defer wg.Done()
+			errs[i] = acquireLease(vol, h, time.Hour)
+		}(i, h)
+	}
+	<-api.putArrived
+	<-api.putArrived
+	close(api.putGate)
+	wg.Wait()
+
+	winners := 0
+	winner := ""
+	for i, err := range errs {
+		if err == nil {
+			winners++
+			winner = hosts[i]
+		} else if !strings.Contains(err.Error(), "lost lease race") {
+			t.Errorf("%s: acquireLease = %s, want lost lease race", hosts[i], err)
+		}
+	}
+	if winners != 1 {
+		t.Fatalf("%d hosts took the lease, want 1: %v", winners, errs)
+	}
+	if l := leases(api, id); len(l) != 1 || l[0].Host != winner {
+		t.Errorf("leases = %v, want the lease of %s", l, winner)
+	}
+}
+
+func TestAcquireLeaseConcurrentTagsLand(t *testing.T) {
+	api, _ := setupTest(t)
+	id := api.addVolume("data", "us-east", 20, 0)
+	vol := api.volume(id)
+	api.putGate = make(chan struct{})
+	api.putArrived = make(chan struct{}, 2)
+	// the lease tags of both hosts land on the volume
+	var landed []string
+	api.onPut = func(v *Volume) {
+		l, others := splitLeaseTags(v.Tags)
+		landed = append(landed, l[0].Tag())
+		v.Tags = append(others, landed...)
+		if len(landed) == 2 {
+			api.onPut = nil
+		}
+	}
+
+	hosts := []string{"web1", "db1"}
+	errs := make([]error, len(hosts))
+	var wg sync.WaitGroup
+	for i, h := range hosts {
+		wg.Add(1)
+		go func(i int, h string) {
+			defer wg.Done()
+			errs[i] = acquireLease(vol, h, time.Hour)
+		}(i, h)
+	}
+	<-api.putArrived
+	<-api.putArrived
+	close(api.putGate)
+	wg.Wait()
+
+	if errs[1] != nil || errs[0] == nil || !strings.Contains(errs[0].Error(), "lost lease race") {
+		t.Fatalf("web1: %v, db1: %v, want the lower lease of db1 to win", errs[0], errs[1])
+	}
+	if l := leases(api, id); len(l) != 1 || l[0].Host != "db1" {
+		t.Errorf("leases = %v, want only db1", l)
+	}
+}
+
+func TestReleaseLeaseLeavesOtherHosts(t *testing.T) {
+	api, _ := setupTest(t)
+	other := Lease{Host: "db1", Expiry: time.Now().Add(time.Hour)}.Tag()
+	id := api.addVolume("data", "us-east", 20, 0, "env:prod", Lease{Host: "web1", Expiry: time.Now().Add(time.Hour)}.Tag(), other)
+
+	if err := releaseLease(api.volume(id), "web1"); err != nil {
+		t.Fatalf("releaseLease: %s", err)
+	}
+	tags := api.volume(id).Tags
+	if len(tags) != 2 || tags[0] != "env:prod" || tags[1] != other {
+		t.Errorf("tags = %v, want env:prod and the lease of db1", tags)
+	}
+
+	// nothing held, nothing written
+	puts := api.called("PUT /volumes/" + strconv.Itoa(id))
+	if err := releaseLease(api.volume(id), "web1"); err != nil {
+		t.Fatalf("releaseLease: %s", err)
+	}
+	if n := api.called("PUT /volumes/" + strconv.Itoa(id)); n != puts {
+		t.Errorf("releaseLease without a lease updated the tags")
+	}
+}
+
+func TestLeaseHandOver(t *testing.T) {
+	api, _ := setupTest(t)
+	id := api.addVolume("data", "us-east", 20, 0)
+	vol := api.volume(id)
+
+	if err := acquireLease(vol, "web1", time.Hour); err != nil {
+		t.Fatalf("web1: acquireLease: %s", err)
+	}
+	if err := acquireLease(vol, "db1", time.Hour); err == nil {
+		t.Fatal("db1 took the lease held by web1")
+	}
+	// renewing our own lease is allowed
+	if err := acquireLease(vol, "web1", time.Hour); err != nil {
+		t.Fatalf("web1: renewing the lease: %s", err)
+	}
+	if err := releaseLease(vol, "web1"); err != nil {
+		t.Fatalf("web1: releaseLease: %s", err)
+	}
+	if err := acquireLease(vol, "db1", time.Hour); err != nil {
+		t.Fatalf("db1: acquireLease after the release: %s", err)
+	}
+	if l := leases(api, id); len(l) != 1 || l[0].Host != "db1" {
+		t.Errorf("leases = %v, want only db1", l)
+	}
+}
+
+func TestAttachReleasesLeaseOnFailure(t *testing.T) {
+	api, _ := setupTest(t)
+	*leasePtr = true
+	id := api.addVolume("data", "us-east", 20, 0)
+	api.failOn("POST /volumes/"+strconv.Itoa(id)+"/attach", http.StatusInternalServerError)
+
+	if _, err := attachLinode("web1", "data", false); err == nil {
+		t.Fatal("attachLinode succeeded with a failing attach")
+	}
+	if l := leases(api, id); len(l) != 0 {
+		t.Errorf("leases = %v after a failed attach, want none", l)
+	}
+}
+
+func TestAttachKeepsLeaseOnSuccess(t *testing.T) {
+	api, _ := setupTest(t)
+	*leasePtr = true
+	id := api.addVolume("data", "us-east", 20, 0)
+
+	if _, err := attachLinode("web1", "data", false); err != nil {
+		t.Fatalf("attachLinode: %s", err)
+	}
+	if l := leases(api, id); len(l) != 1 || l[0].Host != "web1" {
+		t.Errorf("leases = %v, want the lease of web1", l)
+	}
+	if _, err := detachLinode("web1", "data"); err != nil {
+		t.Fatalf("detachLinode: %s", err)
+	}
+	if l := leases(api, id); len(l) != 0 {
+		t.Errorf("leases = %v after detach, want none", l)
+	}
+}
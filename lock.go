@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/libgolang/log"
+)
+
+const lockPollInterval = 500 * time.Millisecond
+
+// fileLock advisory flock held on a file under the lock directory
+type fileLock struct {
+	name string
+	file *os.File
+}
+
+// acquireLock takes an exclusive flock on <dir>/<name>.lock, waiting up to
+// wait for it to be released by other processes.  The pid of the holder is
+// written into the file so contention can be reported
+func acquireLock(dir, name string, wait time.Duration) (*fileLock, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, name+".lock")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(wait)
+	logged := false
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			_ = f.Close()
+			return nil, err
+		}
+		if !logged {
+			log.Warn("Lock %s is held by %s, waiting up to %s", path, lockHolder(path), wait)
+			logged = true
+		}
+		if time.Now().After(deadline) {
+			holder := lockHolder(path)
+			_ = f.Close()
+			return nil, fmt.Errorf("timed out after %s waiting for lock %s held by %s", wait, path, holder)
+		}
+		time.Sleep(lockPollInterval)
+	}
+
+	// record ourselves as the holder
+	if err := f.Truncate(0); err == nil {
+		_, _ = f.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0)
+	}
+	log.Debug("Acquired lock %s", path)
+	return &fileLock{name: path, file: f}, nil
+}
+
+// Release releases the lock
+func (l *fileLock) Release() {
+	_ = l.file.Truncate(0)
+	_ = syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	_ = l.file.Close()
+	log.Debug("Released lock %s", l.name)
+}
+
+// lockHolder describes the process recorded in the lock file, e.g: pid 123 (one-linode --hook pre)
+func lockHolder(path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "unknown process"
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return "unknown process"
+	}
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return fmt.Sprintf("pid %d", pid)
+	}
+	cmd := strings.TrimSpace(string(bytes.Replace(cmdline, []byte{0}, []byte{' '}, -1)))
+	return fmt.Sprintf("pid %d (%s)", pid, cmd)
+}
+
+// lockVolume takes the host-local lock for a volume label.  Labels that
+// could name a file outside the lock directory are rejected
+func lockVolume(volumeName string) (*fileLock, error) {
+	if volumeName == "" || strings.ContainsAny(volumeName, "/\x00") || strings.Contains(volumeName, "..") {
+		return nil, fmt.Errorf("invalid volume label %q", volumeName)
+	}
+	return acquireLock(*lockDirPtr, "volume-"+volumeName, time.Duration(*lockWaitPtr)*time.Second)
+}
+
+// lockState takes the host-local lock guarding the state file
+func lockState() (*fileLock, error) {
+	return acquireLock(*lockDirPtr, "state", time.Duration(*lockWaitPtr)*time.Second)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/libgolang/log"
+)
+
+// logRecorder log writer keeping the formatted messages
+type logRecorder struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+// WriteLog implementation of log.Writer
+func (r *logRecorder) WriteLog(name string, level log.Level, format string, args []interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, level.String()+" "+fmt.Sprintf(format, args...))
+}
+
+// SetLevel implementation of log.Writer
+func (r *logRecorder) SetLevel(level log.Level) {}
+
+// recordLog sends the log to a recorder until the test ends
+func recordLog(t *testing.T) *logRecorder {
+	r := &logRecorder{}
+	log.SetWriters([]log.Writer{r})
+	log.SetLoggerLevels(map[string]log.Level{"": log.DEBUG})
+	t.Cleanup(func() {
+		log.SetWriters([]log.Writer{&stderrWriter{level: log.OTHER}})
+		log.SetLoggerLevels(map[string]log.Level{"": log.OTHER})
+	})
+	return r
+}
+
+func TestLockVolumeRejectsPaths(t *testing.T) {
+	setupTest(t)
+	for _, label := range []string{"", "..", "../state", "a/b", "/etc/passwd", "x\x00y"} {
+		if l, err := lockVolume(label); err == nil {
+			l.Release()
+			t.Errorf("lockVolume(%q) succeeded", label)
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(filepath.Dir(*lockDirPtr), "*.lock"))
+	if len(files) != 0 {
+		t.Errorf("locks created outside the lock directory: %v", files)
+	}
+
+	l, err := lockVolume("data-1_a.b")
+	if err != nil {
+		t.Fatalf("lockVolume: %s", err)
+	}
+	l.Release()
+}
+
+func TestLockContention(t *testing.T) {
+	setupTest(t)
+	rec := recordLog(t)
+	held, err := acquireLock(*lockDirPtr, "volume-data", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Release()
+
+	_, err = acquireLock(*lockDirPtr, "volume-data", 0)
+	holder := fmt.Sprintf("held by pid %d (", os.Getpid())
+	if err == nil || !strings.Contains(err.Error(), holder) {
+		t.Fatalf("acquireLock = %v, want a timeout naming pid %d", err, os.Getpid())
+	}
+	warned := false
+	for _, m := range rec.messages {
+		warned = warned || strings.HasPrefix(m, "WARN Lock ") && strings.Contains(m, holder)
+	}
+	if !warned {
+		t.Errorf("no contention warning naming the holder in %q", rec.messages)
+	}
+
+	held.Release()
+	l, err := acquireLock(*lockDirPtr, "volume-data", 0)
+	if err != nil {
+		t.Fatalf("acquireLock after release: %s", err)
+	}
+	l.Release()
+}
+
+func TestLockHolder(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "x.lock")
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	self := lockHolder(write(fmt.Sprintf("%d\n", os.Getpid())))
+	if !strings.HasPrefix(self, fmt.Sprintf("pid %d (", os.Getpid())) || !strings.Contains(self, filepath.Base(os.Args[0])) {
+		t.Errorf("lockHolder(self) = %s", self)
+	}
+	tests := map[string]string{
+		"2147483646\n": "pid 2147483646",
+		"":             "unknown process",
+		"abc":          "unknown process",
+	}
+	for content, want := range tests {
+		if got := lockHolder(write(content)); got != want {
+			t.Errorf("lockHolder(%q) = %s, want %s", content, got, want)
+		}
+	}
+	if got := lockHolder(filepath.Join(dir, "missing.lock")); got != "unknown process" {
+		t.Errorf("lockHolder(missing) = %s", got)
+	}
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/libgolang/config"
@@ -22,157 +26,325 @@ func (i *volumesFlag) FromString(value string) error {
 }
 
 var (
-	tokenPtr    = config.String("token", "", "Linode Bearer Token")
-	namePtr     = config.String("name", "", "Container Name")
-	hostPtr     = config.String("host", getHostName(), "Hostname to attach volume to")
-	hookTypePtr = config.String("hook", "", "Hook Type: pre | post")
-	volumes     volumesFlag
+	configPtr         = config.String("config", config.DefaultConfigFile, "Path to the properties config file")
+	volumeMapPtr      = config.String("volume-map", "volumes.yaml", "Path to the YAML volume map of the containers")
+	tokenPtr          = config.String("token", "", "Linode Bearer Token")
+	namePtr           = config.String("name", "", "Container Name")
+	hostPtr           = config.String("host", getHostName(), "Hostname to attach volume to")
+	hookTypePtr       = config.String("hook", "", "Hook Type: pre | post | prestart | poststop. Same as running the command of that name")
+	statePtr          = config.String("state", "/var/lib/one-linode/state.json", "Path to the state file of managed attachments")
+	lockDirPtr        = config.String("lock-dir", "/run/one-linode", "Directory holding the host-local lock files")
+	lockWaitPtr       = config.Int("lock-wait", 300, "Seconds to wait for a volume lock held by another process")
+	apiURLPtr         = config.String("api-url", "https://api.linode.com/v4", "Linode API base URL")
+	leasePtr          = config.Bool("lease", false, "Take a cluster-wide lease on volumes through Linode tags")
+	leaseTTLPtr       = config.Int("lease-ttl", 86400, "Seconds a volume lease is valid for")
+	templatePtr       = config.String("template", "", "Base64 OpenNebula VM template ($TEMPLATE) to take the volumes, host and name from")
+	vmIDPtr           = config.Int("vm-id", -1, "OpenNebula VM ID to look up the volumes, host and name of through XML-RPC")
+	oneEndpointPtr    = config.String("one-endpoint", "http://localhost:2633/RPC2", "OpenNebula XML-RPC endpoint")
+	oneAuthPtr        = config.String("one-auth", "", "OpenNebula credentials user:password. Defaults to the contents of $ONE_AUTH or ~/.one/one_auth")
+	volumeTemplatePtr = config.String("volume-template", "", "Go template of the comma separated volume labels used when no volumes are given. E.g: {{.Name}}-data,{{.Name}}-logs. Has .Name, .Host, .Region and .Attr \"VM_ATTRIBUTE\"")
+	updateVMPtr       = config.Bool("update-vm", false, "Write the attached volume ids, devices and host into the user template of the OpenNebula VM")
+	configProfilePtr  = config.String("config-profile", "", "Label of the linode config profile volumes are attached with. Defaults to the profile the linode last booted, as the API does")
+	persistDevicesPtr = config.Bool("persist-devices", false, "Add attached volumes to the sdc..sdh devices of the config profile so they survive reboots")
+	volumeWaitPtr     = config.Int("volume-wait", 300, "Seconds to wait for a creating or resizing volume to become active")
+	backupPtr         = config.Bool("clone-before-attach", false, "Clone volumes to <label>-bak-<timestamp> before attaching them")
+	backupKeepPtr     = config.Int("backup-keep", 3, "Number of backups kept per volume")
+	backupMaxAgePtr   = config.Int("backup-max-age", 0, "Hours after which backups are deleted, the newest one excepted. 0 keeps them until --backup-keep drops them")
+	dryRunPtr         = config.Bool("dry-run", false, "Do the lookups but only print the changes instead of making them")
+	outputPtr         = config.String("output", "plain", "Output format of the command results: json | table | plain")
+	volumes           volumesFlag
 )
 
 func main() {
-	resty.SetDebug(true)
-	_ = os.Setenv("LOG_CONFIG", "config.properties")
-	log.LoadLogProperties()
+	log.SetWriters([]log.Writer{&stderrWriter{level: log.WARN}}) // stdout is for command output
+	loadLogProperties(resolveConfigFile(config.DefaultConfigFile))
 
-	//config.String("config", "one-linode.conf", "Path to config file")
 	config.Var(&volumes, "volume", "Volume to attach. Takes multiple volumes. E.g: --volume vol1 --volume vol2")
+	flag.Usage = printUsage
 	config.Parse()
 
-	if *tokenPtr == "" {
-		fmt.Printf("###################################\n")
-		fmt.Printf("--token or $TOKEN confg is required\n")
-		fmt.Printf("###################################\n")
-	} else if *hookTypePtr == "pre" {
-		preHook()
-	} else if *hookTypePtr == "post" {
-		postHook()
-	} else {
-		fmt.Printf("##################################################\n")
-		fmt.Printf("--hook flag is required. Possible values: pre|post\n")
-		fmt.Printf("##################################################\n")
-	}
+	os.Exit(run(flag.Args()))
 }
 
-func preHook() {
-	for _, volumeName := range volumes {
-		if err := attachLinode(*hostPtr, volumeName); err != nil {
-			os.Exit(1) // error exit
+// attachLinode attaches the volume to the linode, detaching it from its
+// current holder.  A volume already attached to the linode stays attached.
+// With backup the volume is cloned once the checks passed, before it is
+// detached
+func attachLinode(linodeName string, volumeName string, backup bool) (att *AttachmentState, err error) {
+	linodeID, err := getLinodeIDByName(linodeName)
+	if err != nil {
+		err = fmt.Errorf("Unable to get Linode ID by name(%s): %s", linodeName, err)
+		log.Error("%s", err)
+		return nil, err
+	}
+
+	volume, err := getVolumeByName(volumeName)
+	if err != nil {
+		err = fmt.Errorf("Unable to get Volume ID by name(%s)", volumeName)
+		log.Error("%s", err)
+		return nil, err
+	}
+	if volume, err = waitVolumeActive(volume); err != nil {
+		log.Error("%s", err)
+		return nil, err
+	}
+	volumeID := volume.ID
+
+	if volume.LinodeID != linodeID {
+		if err := checkSlots(linodeID, linodeName, []string{volume.Label}); err != nil {
+			log.Error("%s", err)
+			return nil, err
 		}
 	}
-}
 
-func postHook() {
+	if *leasePtr {
+		if err := acquireLease(volume, linodeName, time.Duration(*leaseTTLPtr)*time.Second); err != nil {
+			err = fmt.Errorf("Unable to lease volume %s: %s", volumeName, err)
+			log.Error("%s", err)
+			return nil, err
+		}
+		// a failed attach must not lock the other hosts out for the lease ttl
+		defer func() {
+			if err == nil {
+				return
+			}
+			if rerr := releaseLease(volume, linodeName); rerr != nil {
+				log.Warn("Unable to release lease on volume %s: %s", volumeName, rerr)
+			}
+		}()
+	}
+
+	cfg, err := resolveConfig(linodeID, *configProfilePtr)
+	if err != nil {
+		log.Error("%s", err)
+		return nil, err
+	}
+
+	if volume.LinodeID == linodeID {
+		// attaching again must not detach the volume from under its mounts
+		log.Info("Volume %s is already attached to %s", volumeName, linodeName)
+		if *persistDevicesPtr && cfg != nil {
+			if err := persistVolumeDevice(linodeID, cfg.ID, volumeID); err != nil {
+				err = fmt.Errorf("Unable to persist volume %s in config profile %s: %s", volumeName, cfg.Label, err)
+				log.Error("%s", err)
+				return nil, err
+			}
+		}
+		return &AttachmentState{
+			VolumeID:         volumeID,
+			Label:            volume.Label,
+			LinodeID:         linodeID,
+			FilesystemPath:   volume.FilesystemPath,
+			PreviousLinodeID: linodeID,
+		}, nil
+	}
+
+	if backup {
+		if _, err := backupVolume(volume); err != nil {
+			log.Error("%s", err)
+			return nil, err
+		}
+	}
+
+	// detach
+	if *persistDevicesPtr && volume.LinodeID != 0 {
+		if err := clearVolumeDevice(volume.LinodeID, volumeID); err != nil {
+			log.Warn("Unable to remove volume %s from the config profile of linode %d: %s", volumeName, volume.LinodeID, err)
+		}
+	}
+	if err := detachVolume(volumeID); err != nil {
+		err = fmt.Errorf("Unable to detach volume %s: %s", volumeName, err)
+		log.Error("%s", err)
+		return nil, err
+	}
+
+	// attach
+	log.Info("Calling attach on volume %d and node %d", volumeID, linodeID)
+	url := fmt.Sprintf("%s/volumes/%d/attach", *apiURLPtr, volumeID)
+	body := AttachRequest{LinodeID: &linodeID}
+	if cfg != nil {
+		body.ConfigID = &cfg.ID
+	}
+	if _, err := Post(url, body, nil); err != nil {
+		err = fmt.Errorf("unable to attach volume: %s", err)
+		log.Error("%s", err)
+		return nil, err
+	}
+	if *persistDevicesPtr && cfg != nil {
+		if err := persistVolumeDevice(linodeID, cfg.ID, volumeID); err != nil {
+			err = fmt.Errorf("Unable to persist volume %s in config profile %s: %s", volumeName, cfg.Label, err)
+			log.Error("%s", err)
+			return nil, err
+		}
+	}
+	return &AttachmentState{
+		VolumeID:         volumeID,
+		Label:            volume.Label,
+		LinodeID:         linodeID,
+		FilesystemPath:   volume.FilesystemPath,
+		PreviousLinodeID: volume.LinodeID,
+	}, nil
 }
 
-func attachLinode(linodeName string, volumeName string) error {
+// detachLinode detaches the volume from the linode.  Volumes attached to a
+// different linode are left alone.  Returns the volume as it was before the detach
+func detachLinode(linodeName string, volumeName string) (*Volume, error) {
 	linodeID, err := getLinodeIDByName(linodeName)
 	if err != nil {
 		err = fmt.Errorf("Unable to get Linode ID by name(%s): %s", linodeName, err)
 		log.Error("%s", err)
-		return err
+		return nil, err
 	}
 
-	volumeID, err := getVolumeIDByName(volumeName)
+	volume, err := getVolumeByName(volumeName)
 	if err != nil {
 		err = fmt.Errorf("Unable to get Volume ID by name(%s)", volumeName)
 		log.Error("%s", err)
-		return err
+		return nil, err
+	}
+	if volume, err = waitVolumeActive(volume); err != nil {
+		log.Error("%s", err)
+		return nil, err
 	}
 
-	// detach
+	if volume.LinodeID == linodeID {
+		if *persistDevicesPtr {
+			if err := clearVolumeDevice(linodeID, volume.ID); err != nil {
+				log.Warn("Unable to remove volume %s from the config profile of %s: %s", volumeName, linodeName, err)
+			}
+		}
+		if err := detachVolume(volume.ID); err != nil {
+			err = fmt.Errorf("Unable to detach volume %s: %s", volumeName, err)
+			log.Error("%s", err)
+			return nil, err
+		}
+	} else if volume.LinodeID != 0 {
+		log.Warn("Volume %s is attached to linode %d, not to %s. Skipping detach", volumeName, volume.LinodeID, linodeName)
+	} else {
+		log.Info("Volume %s is not attached", volumeName)
+	}
+
+	if *leasePtr {
+		if err := releaseLease(volume, linodeName); err != nil {
+			err = fmt.Errorf("Unable to release lease on volume %s: %s", volumeName, err)
+			log.Error("%s", err)
+			return nil, err
+		}
+	}
+	return volume, nil
+}
+
+// detachVolume calls detach on the volume and waits for the request to finish
+func detachVolume(volumeID int) error {
 	log.Info("Calling detach on volume %d", volumeID)
-	detachURL := fmt.Sprintf("https://api.linode.com/v4/volumes/%d/detach", volumeID)
+	detachURL := fmt.Sprintf("%s/volumes/%d/detach", *apiURLPtr, volumeID)
 	if _, err := Post(detachURL, nil, nil); err != nil {
-		log.Warn("Detaching request returned error")
+		log.Warn("Detaching request returned error: %s", err)
+	}
+	if *dryRunPtr {
+		return nil // the volume stays attached
 	}
 	// wait for deatch request to finish
 	i := 0
 	for {
-		duration := time.Second * 5
-		log.Info("Wait for deatch request %s", duration)
-		time.Sleep(duration) // sleep 5 seconds
+		log.Info("Wait for deatch request %s", volumePollInterval)
+		time.Sleep(volumePollInterval)
 
-		it, err := Get(fmt.Sprintf("https://api.linode.com/v4/volumes/%d", volumeID), &Volume{})
+		vol, err := getVolume(volumeID)
 		if err != nil {
-			log.Error("Detach Wait request failed")
+			return fmt.Errorf("Detach wait request on volume %d failed: %s", volumeID, err)
 		}
-		vol := it.(*Volume)
 		if vol.LinodeID == 0 {
 			log.Info("Node detached stop the wait")
-			break
+			return nil
 		}
 		if i >= 20 {
-			break
+			return fmt.Errorf("volume %d still attached to linode %d after %d checks", volumeID, vol.LinodeID, i+1)
 		}
 		i++
 	}
-
-	// attach
-	log.Info("Calling attach on volume %d and node %d", volumeID, linodeID)
-	url := fmt.Sprintf("https://api.linode.com/v4/volumes/%d/attach", volumeID)
-	body := AttachRequest{LinodeID: &linodeID}
-	if _, err := Post(url, body, nil); err != nil {
-		err = fmt.Errorf("unable to attach volume: %s", err)
-		log.Error("%s", err)
-		return err
-	}
-	return nil
 }
 
 // getLinodeIDByName resturns the id of the linode given the name or returns empty
 // string if not found
 func getLinodeIDByName(linodeName string) (int, error) {
+	node, err := getLinodeByName(linodeName)
+	if err != nil {
+		return 0, err
+	}
+	return node.ID, nil
+}
+
+// getLinodeByName returns the linode with the given label
+func getLinodeByName(linodeName string) (*Node, error) {
 	pages := 1
 	for page := 1; page <= pages; page++ {
-		url := fmt.Sprintf("https://api.linode.com/v4/linode/instances?page=%d", page)
+		url := fmt.Sprintf("%s/linode/instances?page=%d", *apiURLPtr, page)
 		//var err error
 		it, err := Get(url, &ListNodeResponse{})
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
 		resp, ok := it.(*ListNodeResponse)
 		if !ok {
-			return 0, fmt.Errorf("Error casting to ListNodeReponse")
+			return nil, fmt.Errorf("Error casting to ListNodeReponse")
 		}
 		pages = resp.Pages
 		for _, n := range resp.Data {
 			if n.Label == linodeName {
-				return n.ID, nil
+				node := n
+				return &node, nil
 			}
 		}
 	}
-	return 0, fmt.Errorf("Not Found")
+	return nil, fmt.Errorf("Not Found")
 }
 
-func getVolumeIDByName(volumeName string) (int, error) {
+// errVolumeNotFound no volume has the label
+var errVolumeNotFound = errors.New("Not Found")
+
+// getVolumeByName returns the volume with the given label
+func getVolumeByName(volumeName string) (*Volume, error) {
 	pages := 1
 	for page := 1; page <= pages; page++ {
-		url := fmt.Sprintf("https://api.linode.com/v4/volumes?page=%d", page)
+		url := fmt.Sprintf("%s/volumes?page=%d", *apiURLPtr, page)
 		it, err := Get(url, &ListVolumeResponse{})
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
 		resp, ok := it.(*ListVolumeResponse)
 		if !ok {
-			return 0, fmt.Errorf("Error casting to ListVolumeReponse")
+			return nil, fmt.Errorf("Error casting to ListVolumeReponse")
 		}
 		pages = resp.Pages
 		for _, n := range resp.Data {
 			if n.Label == volumeName {
-				return n.ID, nil
+				vol := n
+				return &vol, nil
 			}
 		}
 	}
-	return 0, fmt.Errorf("Not Found")
+	if vol, ok := dryRunVolumes[volumeName]; ok {
+		return vol, nil
+	}
+	return nil, errVolumeNotFound
 }
 
 // Get REST GET request
 func Get(url string, res interface{}) (interface{}, error) {
-	log.Debug("GET %s token: %s", url, *tokenPtr)
+	return GetFiltered(url, "", res)
+}
+
+// GetFiltered REST GET request of a list filtered by the X-Filter JSON filter
+func GetFiltered(url string, filter string, res interface{}) (interface{}, error) {
+	log.Debug("GET %s %s", url, filter)
 	r := resty.R()
 	if res != nil {
 		r.SetResult(res)
 	}
+	if filter != "" {
+		r.SetHeader("X-Filter", filter)
+	}
 	r.SetHeader("Authorization", fmt.Sprintf("Bearer %s", *tokenPtr))
 	resp, err := r.Get(url)
 	if err == nil && resp.StatusCode() != 200 {
@@ -181,9 +353,30 @@ func Get(url string, res interface{}) (interface{}, error) {
 	return resp.Result(), err
 }
 
+// dryRun prints a change --dry-run skips
+func dryRun(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "dry-run: would "+format+"\n", args...)
+}
+
+// dryRunBody the request body as printed by --dry-run
+func dryRunBody(req interface{}) string {
+	if req == nil {
+		return ""
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Sprintf("%v", req)
+	}
+	return string(b)
+}
+
 // Post REST POST request
 func Post(url string, req interface{}, res interface{}) (interface{}, error) {
 	log.Debug("POST %s", url)
+	if *dryRunPtr {
+		dryRun("POST %s %s", url, dryRunBody(req))
+		return res, nil
+	}
 
 	r := resty.R()
 	if req != nil {
@@ -197,11 +390,53 @@ func Post(url string, req interface{}, res interface{}) (interface{}, error) {
 	r.SetHeader("Authorization", fmt.Sprintf("Bearer %s", *tokenPtr))
 	resp, err := r.Post(url)
 	if err == nil && resp.StatusCode() != 200 {
-		return nil, fmt.Errorf("GET Request returned error %d: ", resp.StatusCode())
+		return nil, fmt.Errorf("POST Request returned error %d: ", resp.StatusCode())
 	}
 	return resp.Result(), err
 }
 
+// Put REST PUT request
+func Put(url string, req interface{}, res interface{}) (interface{}, error) {
+	log.Debug("PUT %s", url)
+	if *dryRunPtr {
+		dryRun("PUT %s %s", url, dryRunBody(req))
+		return res, nil
+	}
+
+	r := resty.R()
+	if req != nil {
+		r.SetBody(req)
+	}
+
+	if res != nil {
+		r.SetResult(res)
+	}
+
+	r.SetHeader("Authorization", fmt.Sprintf("Bearer %s", *tokenPtr))
+	resp, err := r.Put(url)
+	if err == nil && resp.StatusCode() != 200 {
+		return nil, fmt.Errorf("PUT Request returned error %d: ", resp.StatusCode())
+	}
+	return resp.Result(), err
+}
+
+// Delete REST DELETE request
+func Delete(url string) error {
+	log.Debug("DELETE %s", url)
+	if *dryRunPtr {
+		dryRun("DELETE %s", url)
+		return nil
+	}
+
+	r := resty.R()
+	r.SetHeader("Authorization", fmt.Sprintf("Bearer %s", *tokenPtr))
+	resp, err := r.Delete(url)
+	if err == nil && resp.StatusCode() != 200 {
+		return fmt.Errorf("DELETE Request returned error %d: ", resp.StatusCode())
+	}
+	return err
+}
+
 // ListNodeResponse list node response
 type ListNodeResponse struct {
 	Data    []Node `json:"data"`
@@ -237,24 +472,39 @@ type Node struct {
 
 // Volume volume
 type Volume struct {
-	ID             int    `json:"id"`              // "id": 12345,
-	Label          string `json:"label"`           // "label": "my-volume",
-	FilesystemPath string `json:"filesystem_path"` // "filesystem_path": "/dev/disk/by-id/scsi-0Linode_Volume_my-volume",
-	LinodeID       int    `json:"linode_id"`       // "linode_id": 12346,
-	Region         string `json:"region"`          // "region": "us-east",
-	// "status": "active",
-	// "size": 30,
+	ID             int          `json:"id"`              // "id": 12345,
+	Label          string       `json:"label"`           // "label": "my-volume",
+	FilesystemPath string       `json:"filesystem_path"` // "filesystem_path": "/dev/disk/by-id/scsi-0Linode_Volume_my-volume",
+	LinodeID       int          `json:"linode_id"`       // "linode_id": 12346,
+	Region         string       `json:"region"`          // "region": "us-east",
+	Tags           []string     `json:"tags"`            // "tags": ["example tag"],
+	Size           int          `json:"size"`            // "size": 30,
+	Status         VolumeStatus `json:"status"`          // "status": "active",
 	// "created": "2018-01-01T00:01:01",
 	// "updated": "2018-01-01T00:01:01"
 }
 
 // AttachRequest linode Attach Request
 type AttachRequest struct {
-	LinodeID *int    `json:"linode_id"`
-	ConfigID *string `json:"config_id"`
+	LinodeID *int `json:"linode_id"`
+	ConfigID *int `json:"config_id"`
 }
 
 func getHostName() string {
 	h, _ := os.Hostname()
 	return h
 }
+
+// resolveConfigFile finds a relative config file missing from the working
+// directory next to the binary, the way libgolang/config finds
+// config.properties
+func resolveConfigFile(file string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		dir, _ := filepath.Abs(filepath.Dir(os.Args[0]))
+		return filepath.Join(dir, file)
+	}
+	return file
+}
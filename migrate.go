@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/libgolang/log"
+)
+
+// migration moves volumes between two hosts
+type migration struct {
+	container   string
+	source      string
+	destination string
+	mountRoot   string // mount point of volumes not recorded in the state file is <mountRoot>/<label>
+	fsType      string
+	deviceWait  time.Duration
+}
+
+// runMigrate migrate command
+func runMigrate(c *command, args []string) (interface{}, error) {
+	fs := c.flagSet()
+	source := fs.String("source", "", "Host the volumes move from. Defaults to the previous host of the VM given with --template or --vm-id")
+	destination := fs.String("destination", "", "Host the volumes move to. Defaults to --host")
+	mountRoot := fs.String("mount-root", "", "Mount volumes not recorded in the state file under this directory")
+	fsType := fs.String("fs", "ext4", "Filesystem created on empty volumes before mounting")
+	wait := fs.Int("device-wait", 120, "Seconds to wait for the device to appear on the destination")
+	if err := c.parse(fs, args); err != nil {
+		return nil, err
+	}
+
+	m := &migration{
+		container:   *namePtr,
+		source:      *source,
+		destination: *destination,
+		mountRoot:   *mountRoot,
+		fsType:      *fsType,
+		deviceWait:  time.Duration(*wait) * time.Second,
+	}
+	if m.source == "" && currentVM != nil {
+		m.source = currentVM.PreviousHost
+	}
+	if m.destination == "" {
+		m.destination = *hostPtr
+	}
+	if m.source == "" {
+		return nil, usageError{"--source is required"}
+	}
+	if m.source == m.destination {
+		return nil, usageError{fmt.Sprintf("source and destination are both %s", m.source)}
+	}
+
+	vols, err := commandVolumes(fs.Args())
+	if err != nil {
+		return nil, err
+	}
+	if len(vols) == 0 {
+		vols = stateVolumes(m.container)
+	}
+	if len(vols) == 0 {
+		return nil, usageError{"no volumes given"}
+	}
+
+	results := []*VolumeResult{}
+	for _, volumeName := range vols {
+		res, err := m.migrate(volumeName)
+		results = append(results, res)
+		if err != nil {
+			updateVMAttachments(results)
+			return results, err
+		}
+	}
+	updateVMAttachments(results)
+	return results, nil
+}
+
+// mountPoint where the volume is mounted, empty when it is not mounted by one-linode
+func (m *migration) mountPoint(label string) string {
+	if st, err := loadState(*statePtr); err == nil {
+		if a := st.attachment(m.container, label); a != nil && a.MountPoint != "" {
+			return a.MountPoint
+		}
+	}
+	if m.mountRoot != "" {
+		return filepath.Join(m.mountRoot, label)
+	}
+	return ""
+}
+
+// migrate unmounts and detaches the volume on the source, then attaches and
+// mounts it on the destination.  On failure the volume goes back to the source
+func (m *migration) migrate(volumeName string) (*VolumeResult, error) {
+	start := time.Now()
+	res := &VolumeResult{Volume: volumeName, Linode: m.destination}
+	fail := func(err error) (*VolumeResult, error) {
+		res.Error = err.Error()
+		res.DurationMs = msSince(start)
+		return res, err
+	}
+
+	lock, err := lockVolume(volumeName)
+	if err != nil {
+		return fail(fmt.Errorf("Unable to lock volume %s: %s", volumeName, err))
+	}
+	defer lock.Release()
+
+	vol, err := getVolumeByName(volumeName)
+	if err != nil {
+		return fail(fmt.Errorf("Unable to get Volume ID by name(%s): %s", volumeName, err))
+	}
+	target := m.mountPoint(volumeName)
+	src := mounterFor(m.source)
+	dst := mounterFor(m.destination)
+
+	log.Info("Migrating volume %s from %s to %s", volumeName, m.source, m.destination)
+	if target != "" {
+		if mounted, err := src.IsMounted(target); err != nil {
+			return fail(err)
+		} else if mounted {
+			if err := src.Unmount(target); err != nil {
+				return fail(err) // nothing changed yet
+			}
+		}
+	}
+	if *leasePtr {
+		if err := releaseLease(vol, m.source); err != nil {
+			return fail(m.rollback(vol, target, err))
+		}
+	}
+
+	// attachLinode detaches the volume from the source first
+	att, err := attachLinode(m.destination, volumeName, false)
+	if err != nil {
+		return fail(m.rollback(vol, target, err))
+	}
+	if err := dst.WaitForDevice(att.FilesystemPath, m.deviceWait); err != nil {
+		return fail(m.rollback(vol, target, err))
+	}
+	if target != "" {
+		if err := dst.FormatAndMount(att.FilesystemPath, target, m.fsType, ""); err != nil {
+			return fail(m.rollback(vol, target, err))
+		}
+		att.MountPoint = target
+	}
+
+	res.VolumeID = att.VolumeID
+	res.LinodeID = att.LinodeID
+	res.PreviousLinodeID = att.PreviousLinodeID
+	res.FilesystemPath = att.FilesystemPath
+	res.MountPoint = att.MountPoint
+	if err := recordAttachment(*statePtr, m.container, m.destination, att); err != nil {
+		return fail(fmt.Errorf("Unable to record attachment of %s in state file %s: %s", volumeName, *statePtr, err))
+	}
+	res.DurationMs = msSince(start)
+	return res, nil
+}
+
+// rollback puts the volume back on the source after a failed migration and
+// returns the error describing both
+func (m *migration) rollback(vol *Volume, target string, cause error) error {
+	log.Warn("Migration of volume %s to %s failed: %s. Rolling back to %s", vol.Label, m.destination, cause, m.source)
+	if *leasePtr {
+		if err := releaseLease(vol, m.destination); err != nil {
+			log.Warn("Unable to release lease of %s on volume %s: %s", m.destination, vol.Label, err)
+		}
+	}
+
+	src := mounterFor(m.source)
+	detached, err := m.leftSource(vol)
+	if err == nil && detached {
+		var att *AttachmentState
+		if att, err = attachLinode(m.source, vol.Label, false); err == nil {
+			err = src.WaitForDevice(att.FilesystemPath, m.deviceWait)
+		}
+	} else if err == nil && *leasePtr {
+		// the lease of the source was released before the attach
+		err = acquireLease(vol, m.source, time.Duration(*leaseTTLPtr)*time.Second)
+	}
+	if err == nil && target != "" {
+		err = src.FormatAndMount(vol.FilesystemPath, target, m.fsType, "")
+	}
+	if err != nil {
+		return fmt.Errorf("migration of %s to %s failed: %s; rollback to %s failed: %s", vol.Label, m.destination, cause, m.source, err)
+	}
+	return fmt.Errorf("migration of %s to %s failed, rolled back to %s: %s", vol.Label, m.destination, m.source, cause)
+}
+
+// leftSource whether the volume was detached from the source.  Failures
+// before the detach leave it attached there
+func (m *migration) leftSource(vol *Volume) (bool, error) {
+	sourceID, err := getLinodeIDByName(m.source)
+	if err != nil {
+		return false, fmt.Errorf("Unable to get Linode ID by name(%s): %s", m.source, err)
+	}
+	current, err := getVolumeByName(vol.Label)
+	if err != nil {
+		return false, fmt.Errorf("Unable to get Volume ID by name(%s): %s", vol.Label, err)
+	}
+	return current.LinodeID != sourceID, nil
+}
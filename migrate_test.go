@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupMigration puts volume data on web1 mounted at /srv/data for container
+// vm, with a mounter per host
+func setupMigration(t *testing.T) (*fakeAPI, map[string]*fakeMounter, int) {
+	api, _ := setupTest(t)
+	mounters := map[string]*fakeMounter{"web1": newFakeMounter(), "db1": newFakeMounter()}
+	mounterFor = func(host string) Mounter { return mounters[host] }
+	name := *namePtr
+	t.Cleanup(func() { *namePtr = name })
+	*namePtr = "vm"
+
+	id := api.addVolume("data", "us-east", 20, 1)
+	device := api.volume(id).FilesystemPath
+	if err := mounters["web1"].Mount(device, "/srv/data", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordAttachment(*statePtr, "vm", "web1", &AttachmentState{VolumeID: id, Label: "data", LinodeID: 1, FilesystemPath: device, MountPoint: "/srv/data"}); err != nil {
+		t.Fatal(err)
+	}
+	return api, mounters, id
+}
+
+func TestMigrate(t *testing.T) {
+	api, mounters, id := setupMigration(t)
+
+	code, out := runCommand(t, "migrate", "--source", "web1", "--destination", "db1", "data")
+	if code != 0 {
+		t.Fatalf("migrate = %d", code)
+	}
+	if v := api.volume(id); v.LinodeID != 2 {
+		t.Errorf("volume on %d, want db1", v.LinodeID)
+	}
+	if mounters["web1"].mounted("/srv/data") != "" || mounters["db1"].mounted("/srv/data") != api.volume(id).FilesystemPath {
+		t.Errorf("web1 calls %q, db1 calls %q, want the mount moved to db1", mounters["web1"].called(), mounters["db1"].called())
+	}
+	if a := readState(t).attachment("vm", "data"); a == nil || a.LinodeID != 2 || a.MountPoint != "/srv/data" {
+		t.Errorf("state attachment = %+v", a)
+	}
+	if !strings.Contains(out, " linode=db1 linode_id=2 previous_linode_id=1 ") {
+		t.Errorf("migrate printed %q", out)
+	}
+}
+
+func TestMigrateFailsBeforeDetach(t *testing.T) {
+	api, mounters, id := setupMigration(t)
+	*leasePtr = true
+	if err := acquireLease(api.volume(id), "web1", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// db1 has no free device slot
+	for i := 0; i < 6; i++ {
+		api.addVolume(fmt.Sprintf("db-%d", i), "us-east", 20, 2)
+	}
+
+	code, out := runCommand(t, "migrate", "--source", "web1", "--destination", "db1", "data")
+	if code != 1 || !strings.Contains(out, "rolled back to web1") || !strings.Contains(out, "device slots") {
+		t.Fatalf("migrate = %d %q, want the slot check failure rolled back", code, out)
+	}
+	path := "/volumes/" + strconv.Itoa(id)
+	if n := api.called("POST "+path+"/detach") + api.called("POST "+path+"/attach"); n != 0 {
+		t.Errorf("volume never left web1 but was detached or attached %d times", n)
+	}
+	if v := api.volume(id); v.LinodeID != 1 {
+		t.Errorf("volume on %d, want web1", v.LinodeID)
+	}
+	if mounters["web1"].mounted("/srv/data") == "" {
+		t.Errorf("not mounted again on web1: %q", mounters["web1"].called())
+	}
+	if l := leases(api, id); len(l) != 1 || l[0].Host != "web1" {
+		t.Errorf("leases = %v, want the lease of web1 back", l)
+	}
+}
+
+func TestMigrateMountFailure(t *testing.T) {
+	api, mounters, id := setupMigration(t)
+	mounters["db1"].failOn("mount", fmt.Errorf("mount failed"))
+
+	code, out := runCommand(t, "migrate", "--source", "web1", "--destination", "db1", "data")
+	if code != 1 || !strings.Contains(out, "rolled back to web1") {
+		t.Fatalf("migrate = %d %q, want the mount failure rolled back", code, out)
+	}
+	if v := api.volume(id); v.LinodeID != 1 {
+		t.Errorf("volume on %d, want it back on web1", v.LinodeID)
+	}
+	if n := api.called("POST /volumes/" + strconv.Itoa(id) + "/attach"); n != 2 {
+		t.Errorf("attached %d times, want to db1 and back to web1", n)
+	}
+	if mounters["web1"].mounted("/srv/data") == "" || mounters["db1"].mounted("/srv/data") != "" {
+		t.Errorf("web1 calls %q, db1 calls %q, want the mount back on web1", mounters["web1"].called(), mounters["db1"].called())
+	}
+	if a := readState(t).attachment("vm", "data"); a == nil || a.LinodeID != 1 {
+		t.Errorf("state attachment = %+v, want web1 kept", a)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/libgolang/log"
+)
+
+// monitor grows the volumes mounted on --host whose filesystem fills up
+type monitor struct {
+	threshold float64 // percent of the filesystem used that triggers a growth
+	step      int     // GB added per growth
+	max       int     // GB the volumes never grow past
+	notify    string  // shell command run after each growth
+	atMax     map[string]bool
+}
+
+// GrowthResult a growth made by the monitor
+type GrowthResult struct {
+	Volume     string  `json:"volume"`
+	MountPoint string  `json:"mount_point"`
+	UsedPct    float64 `json:"used_pct"`
+	OldSize    int     `json:"old_size"`
+	NewSize    int     `json:"new_size"`
+	DurationMs int64   `json:"duration_ms"`
+	Error      string  `json:"error"`
+}
+
+// runMonitor monitor command.  Checks the mount points recorded in the state
+// file for --host every interval until interrupted, or once with --once
+func runMonitor(c *command, args []string) (interface{}, error) {
+	fs := c.flagSet()
+	interval := fs.Int("interval", 60, "Seconds between two checks")
+	threshold := fs.Float64("threshold", 90, "Percent of the filesystem used that triggers a growth")
+	step := fs.Int("step", 10, "GB added to the volume per growth")
+	max := fs.Int("max", 1024, "GB the volumes do not grow past")
+	notify := fs.String("notify", "", "Shell command run after each growth. Gets ONE_LINODE_VOLUME, ONE_LINODE_MOUNT, ONE_LINODE_USED_PCT, ONE_LINODE_OLD_SIZE, ONE_LINODE_NEW_SIZE and ONE_LINODE_ERROR")
+	once := fs.Bool("once", false, "Check once and exit")
+	if err := c.parse(fs, args); err != nil {
+		return nil, err
+	}
+	if *threshold <= 0 || *threshold >= 100 {
+		return nil, usageError{"--threshold must be between 0 and 100"}
+	}
+	if *step <= 0 {
+		return nil, usageError{"--step must be positive"}
+	}
+	if *max <= 0 {
+		return nil, usageError{"--max must be positive"}
+	}
+	if *interval <= 0 {
+		return nil, usageError{"--interval must be positive"}
+	}
+
+	m := &monitor{threshold: *threshold, step: *step, max: *max, notify: *notify, atMax: make(map[string]bool)}
+	if *once {
+		return m.check(), nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	results := []*GrowthResult{}
+	ticker := time.NewTicker(time.Duration(*interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		results = append(results, m.check()...)
+		select {
+		case <-ctx.Done():
+			return results, nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// check checks the mount points once and grows the volumes past the threshold
+func (m *monitor) check() []*GrowthResult {
+	results := []*GrowthResult{}
+	st, err := loadState(*statePtr)
+	if err != nil {
+		log.Error("Unable to read state file %s: %s", *statePtr, err)
+		return results
+	}
+	mounter := mounterFor(*hostPtr)
+	seen := make(map[string]bool)
+	for _, cs := range st.Containers {
+		if cs.Host != *hostPtr {
+			continue
+		}
+		for _, a := range cs.Attachments {
+			if a.MountPoint == "" || seen[a.Label] {
+				continue
+			}
+			seen[a.Label] = true
+			if mounted, err := mounter.IsMounted(a.MountPoint); err != nil || !mounted {
+				continue // tm disk links and stale entries
+			}
+			used, size, err := mounter.Usage(a.MountPoint)
+			if err != nil || size == 0 {
+				log.Warn("Unable to get usage of %s: %v", a.MountPoint, err)
+				continue
+			}
+			pct := float64(used) * 100 / float64(size)
+			log.Debug("Volume %s on %s is %.1f%% used", a.Label, a.MountPoint, pct)
+			if pct < m.threshold {
+				delete(m.atMax, a.Label)
+				continue
+			}
+			if res := m.grow(a, pct); res != nil {
+				results = append(results, res)
+			}
+		}
+	}
+	return results
+}
+
+// grow adds a step to the volume, up to the maximum size
+func (m *monitor) grow(a *AttachmentState, pct float64) *GrowthResult {
+	start := time.Now()
+	res := &GrowthResult{Volume: a.Label, MountPoint: a.MountPoint, UsedPct: math.Round(pct*10) / 10}
+	fail := func(err error) *GrowthResult {
+		log.Error("Unable to grow volume %s: %s", a.Label, err)
+		res.Error = err.Error()
+		res.DurationMs = msSince(start)
+		m.notifyGrowth(res)
+		return res
+	}
+
+	lock, err := lockVolume(a.Label)
+	if err != nil {
+		return fail(err)
+	}
+	defer lock.Release()
+
+	vol, err := getVolumeByName(a.Label)
+	if err != nil {
+		return fail(fmt.Errorf("Unable to get Volume ID by name(%s): %s", a.Label, err))
+	}
+	res.OldSize = vol.Size
+	if vol.Size >= m.max {
+		if !m.atMax[a.Label] {
+			log.Warn("Volume %s is %.1f%% used and at the maximum size of %dGB", a.Label, pct, m.max)
+			m.atMax[a.Label] = true
+		}
+		return nil
+	}
+	res.NewSize = vol.Size + m.step
+	if res.NewSize > m.max {
+		res.NewSize = m.max
+	}
+
+	log.Warn("Volume %s is %.1f%% used, growing it from %dGB to %dGB", a.Label, pct, vol.Size, res.NewSize)
+	if err := growVolume(vol, res.NewSize, *hostPtr, a.MountPoint); err != nil {
+		return fail(err)
+	}
+	res.DurationMs = msSince(start)
+	m.notifyGrowth(res)
+	return res
+}
+
+// notifyGrowth runs the --notify command
+func (m *monitor) notifyGrowth(res *GrowthResult) {
+	if m.notify == "" {
+		return
+	}
+	if *dryRunPtr {
+		dryRun("run %s", m.notify)
+		return
+	}
+	cmd := exec.Command("sh", "-c", m.notify)
+	cmd.Env = append(os.Environ(),
+		"ONE_LINODE_VOLUME="+res.Volume,
+		"ONE_LINODE_MOUNT="+res.MountPoint,
+		fmt.Sprintf("ONE_LINODE_USED_PCT=%.1f", res.UsedPct),
+		fmt.Sprintf("ONE_LINODE_OLD_SIZE=%d", res.OldSize),
+		fmt.Sprintf("ONE_LINODE_NEW_SIZE=%d", res.NewSize),
+		"ONE_LINODE_ERROR="+res.Error,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Warn("Notify command %q failed: %s: %s", m.notify, err, out)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// setupMonitor mounts volume data of size GB on /srv/data of web1 with used
+// GB of it used
+func setupMonitor(t *testing.T, size int, used uint64) (*fakeAPI, *fakeMounter, int) {
+	t.Helper()
+	api, m := setupTest(t)
+	id := api.addVolume("data", "us-east", size, 1)
+	device := api.volume(id).FilesystemPath
+	if err := m.Mount(device, "/srv/data", ""); err != nil {
+		t.Fatal(err)
+	}
+	m.usage["/srv/data"] = [2]uint64{used, uint64(size)}
+	if err := recordAttachment(*statePtr, "vm", "web1", &AttachmentState{VolumeID: id, Label: "data", LinodeID: 1, FilesystemPath: device, MountPoint: "/srv/data"}); err != nil {
+		t.Fatal(err)
+	}
+	return api, m, id
+}
+
+func newTestMonitor(max int, notify string) *monitor {
+	return &monitor{threshold: 90, step: 10, max: max, notify: notify, atMax: make(map[string]bool)}
+}
+
+func TestMonitorBelowThreshold(t *testing.T) {
+	api, m, id := setupMonitor(t, 20, 17)
+
+	if res := newTestMonitor(100, "").check(); len(res) != 0 {
+		t.Errorf("check of a volume 85%% used = %+v, want no growth", res)
+	}
+	if v := api.volume(id); v.Size != 20 || api.called("POST /volumes/"+strconv.Itoa(id)+"/resize") != 0 {
+		t.Errorf("volume resized to %dGB below the threshold", v.Size)
+	}
+	for _, c := range m.called() {
+		if strings.HasPrefix(c, "grow ") {
+			t.Errorf("filesystem grown below the threshold: %q", m.called())
+		}
+	}
+}
+
+func TestMonitorGrow(t *testing.T) {
+	api, m, id := setupMonitor(t, 20, 19)
+	out := filepath.Join(t.TempDir(), "notify")
+
+	res := newTestMonitor(100, "echo $ONE_LINODE_VOLUME $ONE_LINODE_OLD_SIZE $ONE_LINODE_NEW_SIZE > "+out).check()
+	if len(res) != 1 || res[0].OldSize != 20 || res[0].NewSize != 30 || res[0].Error != "" || res[0].UsedPct != 95 {
+		t.Fatalf("check = %+v, want a growth from 20GB to 30GB", res)
+	}
+	if v := api.volume(id); v.Size != 30 {
+		t.Errorf("volume is %dGB, want 30GB", v.Size)
+	}
+	grown := false
+	for _, c := range m.called() {
+		grown = grown || c == "grow "+api.volume(id).FilesystemPath+" /srv/data"
+	}
+	if !grown {
+		t.Errorf("filesystem not grown: %q", m.called())
+	}
+	if b, err := ioutil.ReadFile(out); err != nil || string(b) != "data 20 30\n" {
+		t.Errorf("notify command got %q, %v", b, err)
+	}
+}
+
+func TestMonitorMax(t *testing.T) {
+	api, _, id := setupMonitor(t, 20, 19)
+	mon := newTestMonitor(25, "")
+
+	// the step is cut down to the maximum size
+	if res := mon.check(); len(res) != 1 || res[0].NewSize != 25 {
+		t.Fatalf("check = %+v, want a growth to 25GB", res)
+	}
+	rec := recordLog(t)
+	for i := 0; i < 2; i++ {
+		if res := mon.check(); len(res) != 0 {
+			t.Errorf("check at the maximum size = %+v, want no growth", res)
+		}
+	}
+	if v := api.volume(id); v.Size != 25 || api.called("POST /volumes/"+strconv.Itoa(id)+"/resize") != 1 {
+		t.Errorf("volume is %dGB, want it kept at 25GB", v.Size)
+	}
+	warnings := 0
+	for _, msg := range rec.messages {
+		if strings.Contains(msg, "at the maximum size of 25GB") {
+			warnings++
+		}
+	}
+	if warnings != 1 {
+		t.Errorf("warned %d times about the maximum size, want once: %q", warnings, rec.messages)
+	}
+}
+
+func TestMonitorNotifyFailure(t *testing.T) {
+	api, _, id := setupMonitor(t, 20, 19)
+	rec := recordLog(t)
+
+	res := newTestMonitor(100, "exit 3").check()
+	if len(res) != 1 || res[0].NewSize != 30 || res[0].Error != "" {
+		t.Fatalf("check = %+v, want the growth reported despite the notify failure", res)
+	}
+	if v := api.volume(id); v.Size != 30 {
+		t.Errorf("volume is %dGB, want 30GB", v.Size)
+	}
+	warned := false
+	for _, msg := range rec.messages {
+		warned = warned || strings.Contains(msg, `Notify command "exit 3" failed`)
+	}
+	if !warned {
+		t.Errorf("notify failure not logged: %q", rec.messages)
+	}
+}
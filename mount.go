@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/libgolang/log"
+)
+
+// Mounter block device and filesystem operations on the host.  Commands go
+// through this interface so they can run against a fake in tests
+type Mounter interface {
+	// WaitForDevice waits for the block device of an attached volume to show up
+	WaitForDevice(device string, timeout time.Duration) error
+	// Format creates a fstype filesystem on device when it has none
+	Format(device, fstype string) error
+	// FormatAndMount creates a fstype filesystem on device when it has none and mounts it on target
+	FormatAndMount(device, target, fstype, options string) error
+	// Mount mounts the filesystem on device on target, creating target
+	Mount(device, target, options string) error
+	// Unmount unmounts target
+	Unmount(target string) error
+	// IsMounted whether something is mounted on target
+	IsMounted(target string) (bool, error)
+	// MountedFrom whether the filesystem on device is mounted on target
+	MountedFrom(device, target string) (bool, error)
+	// Link creates the symlink path pointing to device
+	Link(device, path string) error
+	// Unlink removes the symlink path
+	Unlink(path string) error
+	// Chown changes the owner of path, owner is user[:group]
+	Chown(path, owner string) error
+	// Rescan makes the kernel read the size of the device again after a resize
+	Rescan(device string) error
+	// GrowFilesystem grows the filesystem of device mounted on target to the device size
+	GrowFilesystem(device, target string) error
+	// Usage returns the bytes used and the size of the filesystem mounted on target
+	Usage(target string) (used, size uint64, err error)
+}
+
+// execMounter Mounter running the system tools, on another host through ssh
+// when host is set
+type execMounter struct {
+	host string
+}
+
+// hostMounter is the Mounter used by the commands for the local host
+var hostMounter Mounter = &execMounter{}
+
+// mounterFor returns the Mounter operating on host
+var mounterFor = func(host string) Mounter {
+	if host == "" || host == getHostName() {
+		return hostMounter
+	}
+	return &execMounter{host: host}
+}
+
+// command returns the command running name on the host of the mounter
+func (m *execMounter) command(name string, args ...string) *exec.Cmd {
+	if m.host == "" {
+		return exec.Command(name, args...)
+	}
+	remote := []string{name}
+	for _, a := range args {
+		remote = append(remote, shellQuote(a))
+	}
+	return exec.Command("ssh", "-o", "BatchMode=yes", m.host, strings.Join(remote, " "))
+}
+
+// run runs a command, including its output in the error
+func (m *execMounter) run(name string, args ...string) error {
+	log.Debug("Running %s %s on %s", name, strings.Join(args, " "), m.hostName())
+	if *dryRunPtr {
+		dryRun("run %s %s on %s", name, strings.Join(args, " "), m.hostName())
+		return nil
+	}
+	out, err := m.command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s on %s: %s: %s", name, strings.Join(args, " "), m.hostName(), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// hostName name of the host of the mounter for messages
+func (m *execMounter) hostName() string {
+	if m.host == "" {
+		return "localhost"
+	}
+	return m.host
+}
+
+// WaitForDevice implementation of Mounter
+func (m *execMounter) WaitForDevice(device string, timeout time.Duration) error {
+	if *dryRunPtr {
+		return nil // the volume was not attached
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		if m.host == "" {
+			if _, err := os.Stat(device); err == nil {
+				return nil
+			}
+		} else if err := m.run("test", "-b", device); err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("device %s did not appear on %s after %s", device, m.hostName(), timeout)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// Format implementation of Mounter
+func (m *execMounter) Format(device, fstype string) error {
+	existing, err := m.fsType(device)
+	if err != nil || existing != "" {
+		return err
+	}
+	log.Info("Creating %s filesystem on %s:%s", fstype, m.hostName(), device)
+	if fstype == "swap" {
+		return m.run("mkswap", device)
+	}
+	return m.run("mkfs", "-t", fstype, device)
+}
+
+// FormatAndMount implementation of Mounter
+func (m *execMounter) FormatAndMount(device, target, fstype, options string) error {
+	if err := m.Format(device, fstype); err != nil {
+		return err
+	}
+	return m.Mount(device, target, options)
+}
+
+// Mount implementation of Mounter
+func (m *execMounter) Mount(device, target, options string) error {
+	if err := m.run("mkdir", "-p", target); err != nil {
+		return err
+	}
+	args := []string{}
+	if options != "" {
+		args = append(args, "-o", options)
+	}
+	args = append(args, device, target)
+	log.Info("Mounting %s on %s:%s", device, m.hostName(), target)
+	return m.run("mount", args...)
+}
+
+// Link implementation of Mounter
+func (m *execMounter) Link(device, path string) error {
+	if err := m.run("mkdir", "-p", filepath.Dir(path)); err != nil {
+		return err
+	}
+	return m.run("ln", "-sfn", device, path)
+}
+
+// Unlink implementation of Mounter
+func (m *execMounter) Unlink(path string) error {
+	return m.run("rm", "-f", path)
+}
+
+// Chown implementation of Mounter
+func (m *execMounter) Chown(path, owner string) error {
+	return m.run("chown", owner, path)
+}
+
+// Rescan implementation of Mounter
+func (m *execMounter) Rescan(device string) error {
+	// device is a /dev/disk/by-id link to the sdX device
+	script := fmt.Sprintf("echo 1 > /sys/block/$(basename $(readlink -f %s))/device/rescan", shellQuote(device))
+	log.Info("Rescanning %s:%s", m.hostName(), device)
+	return m.run("sh", "-c", script)
+}
+
+// GrowFilesystem implementation of Mounter
+func (m *execMounter) GrowFilesystem(device, target string) error {
+	if *dryRunPtr {
+		dryRun("grow the filesystem on %s:%s", m.hostName(), target)
+		return nil // the device did not grow, its filesystem cannot be told apart
+	}
+	fstype, err := m.fsType(device)
+	if err != nil {
+		return err
+	}
+	log.Info("Growing %s filesystem on %s:%s", fstype, m.hostName(), target)
+	switch fstype {
+	case "ext2", "ext3", "ext4":
+		return m.run("resize2fs", device)
+	case "xfs":
+		return m.run("xfs_growfs", target)
+	default:
+		return fmt.Errorf("unable to grow %s filesystem on %s:%s", fstype, m.hostName(), device)
+	}
+}
+
+// Usage implementation of Mounter.  Counts like df: the blocks reserved for
+// root are not part of the size
+func (m *execMounter) Usage(target string) (uint64, uint64, error) {
+	if m.host == "" {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(target, &st); err != nil {
+			return 0, 0, fmt.Errorf("statfs %s: %s", target, err)
+		}
+		used := (st.Blocks - st.Bfree) * uint64(st.Bsize)
+		return used, used + st.Bavail*uint64(st.Bsize), nil
+	}
+
+	out, err := m.command("df", "-P", "-B1", target).Output()
+	if err != nil {
+		return 0, 0, fmt.Errorf("df %s on %s: %s", target, m.hostName(), err)
+	}
+	// Filesystem 1-blocks Used Available Capacity Mounted on
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) < 4 {
+		return 0, 0, fmt.Errorf("df %s on %s: unexpected output %q", target, m.hostName(), out)
+	}
+	used, err := strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("df %s on %s: unexpected output %q", target, m.hostName(), out)
+	}
+	avail, err := strconv.ParseUint(fields[3], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("df %s on %s: unexpected output %q", target, m.hostName(), out)
+	}
+	return used, used + avail, nil
+}
+
+// Unmount implementation of Mounter
+func (m *execMounter) Unmount(target string) error {
+	log.Info("Unmounting %s:%s", m.hostName(), target)
+	return m.run("umount", target)
+}
+
+// IsMounted implementation of Mounter
+func (m *execMounter) IsMounted(target string) (bool, error) {
+	source, err := m.mountSource(target)
+	return source != "", err
+}
+
+// MountedFrom implementation of Mounter.  Volume devices are symlinks to
+// the sdX device listed in /proc/mounts, so both sides are resolved
+func (m *execMounter) MountedFrom(device, target string) (bool, error) {
+	source, err := m.mountSource(target)
+	if err != nil || source == "" {
+		return false, err
+	}
+	resolved := []string{}
+	for _, p := range []string{device, source} {
+		out, err := m.command("readlink", "-f", p).Output()
+		if err != nil {
+			return false, fmt.Errorf("readlink -f %s on %s: %s", p, m.hostName(), err)
+		}
+		resolved = append(resolved, strings.TrimSpace(string(out)))
+	}
+	return resolved[0] == resolved[1], nil
+}
+
+// mountSource returns the device mounted on target, empty when none
+func (m *execMounter) mountSource(target string) (string, error) {
+	out, err := m.command("cat", "/proc/mounts").Output()
+	if err != nil {
+		return "", fmt.Errorf("reading /proc/mounts on %s: %s", m.hostName(), err)
+	}
+
+	source := ""
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) > 1 && fields[1] == target {
+			source = fields[0] // the last mount on target is the visible one
+		}
+	}
+	return source, s.Err()
+}
+
+// fsType returns the filesystem type on device or empty if it has none
+func (m *execMounter) fsType(device string) (string, error) {
+	out, err := m.command("blkid", "-o", "value", "-s", "TYPE", device).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 2 {
+		return "", nil // blkid exits 2 when no filesystem is found
+	} else if err != nil {
+		return "", fmt.Errorf("blkid %s: %s", device, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// shellQuote quotes s for the remote shell of ssh
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
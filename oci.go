@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ociVolumesAnnotation container annotation listing the volumes of the
+// container, e.g: one-linode.volumes=data,logs
+const ociVolumesAnnotation = "one-linode.volumes"
+
+// OCIState container state passed by the runtime to hooks on stdin
+type OCIState struct {
+	OCIVersion  string            `json:"ociVersion"`
+	ID          string            `json:"id"`
+	Status      string            `json:"status"`
+	Pid         int               `json:"pid"`
+	Bundle      string            `json:"bundle"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// ociBundleConfig the part of the bundle config.json we care about
+type ociBundleConfig struct {
+	Annotations map[string]string `json:"annotations"`
+}
+
+// readOCIState decodes the OCI state json
+func readOCIState(r io.Reader) (*OCIState, error) {
+	st := &OCIState{}
+	if err := json.NewDecoder(r).Decode(st); err != nil {
+		return nil, fmt.Errorf("unable to decode OCI state from stdin: %s", err)
+	}
+	if st.ID == "" {
+		return nil, fmt.Errorf("OCI state has no container id")
+	}
+	return st, nil
+}
+
+// ociAnnotations returns the annotations of the container.  Runtimes older
+// than OCI 1.0.2 do not include them in the state, so they are read from the
+// config.json of the bundle instead
+func ociAnnotations(st *OCIState) (map[string]string, error) {
+	if len(st.Annotations) > 0 || st.Bundle == "" {
+		return st.Annotations, nil
+	}
+	b, err := ioutil.ReadFile(filepath.Join(st.Bundle, "config.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	cfg := &ociBundleConfig{}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("unable to decode %s/config.json: %s", st.Bundle, err)
+	}
+	return cfg.Annotations, nil
+}
+
+// splitVolumes splits a comma separated list of volume labels
+func splitVolumes(list string) []string {
+	var vols []string
+	for _, v := range strings.Split(list, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			vols = append(vols, v)
+		}
+	}
+	return vols
+}
+
+// ociHookVolumes reads the state from stdin and returns the container id and
+// the volumes annotated on the container
+func ociHookVolumes(r io.Reader) (string, []string, error) {
+	st, err := readOCIState(r)
+	if err != nil {
+		return "", nil, err
+	}
+	annotations, err := ociAnnotations(st)
+	if err != nil {
+		return "", nil, err
+	}
+	return st.ID, splitVolumes(annotations[ociVolumesAnnotation]), nil
+}
+
+// runPrestart OCI prestart hook.  Attaches the annotated volumes
+func runPrestart(c *command, args []string) (interface{}, error) {
+	fs := c.flagSet()
+	if err := c.parse(fs, args); err != nil {
+		return nil, err
+	}
+	id, vols, err := ociHookVolumes(os.Stdin)
+	if err != nil {
+		return nil, err
+	}
+	return attachAll(id, vols)
+}
+
+// runPoststop OCI poststop hook.  Detaches the annotated volumes, or the
+// volumes recorded for the container when it has no annotation
+func runPoststop(c *command, args []string) (interface{}, error) {
+	fs := c.flagSet()
+	if err := c.parse(fs, args); err != nil {
+		return nil, err
+	}
+	id, vols, err := ociHookVolumes(os.Stdin)
+	if err != nil {
+		return nil, err
+	}
+	if len(vols) == 0 {
+		vols = stateVolumes(id)
+	}
+	return detachAll(id, vols)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeBundle writes config.json into a new bundle directory
+func writeBundle(t *testing.T, config string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestOCIHookVolumes(t *testing.T) {
+	bundle := writeBundle(t, `{"ociVersion": "1.0.0", "annotations": {"one-linode.volumes": "data, logs"}}`)
+	plain := writeBundle(t, `{"ociVersion": "1.0.0"}`)
+	broken := writeBundle(t, `{"annotations": `)
+	missing := filepath.Join(t.TempDir(), "gone")
+
+	tests := []struct {
+		name  string
+		state string
+		id    string
+		vols  []string
+		err   string
+	}{
+		{"state annotations", `{"ociVersion": "1.0.2", "id": "web", "status": "created", "pid": 42, "bundle": "` + bundle + `", "annotations": {"one-linode.volumes": "db-data,,db-logs "}}`, "web", []string{"db-data", "db-logs"}, ""},
+		{"bundle fallback", `{"ociVersion": "1.0.0", "id": "web", "bundle": "` + bundle + `"}`, "web", []string{"data", "logs"}, ""},
+		{"other annotations", `{"id": "web", "annotations": {"other": "x"}}`, "web", nil, ""},
+		{"no annotation in bundle", `{"id": "web", "bundle": "` + plain + `"}`, "web", nil, ""},
+		{"missing bundle", `{"id": "web", "bundle": "` + missing + `"}`, "web", nil, ""},
+		{"no bundle", `{"id": "web"}`, "web", nil, ""},
+		{"invalid bundle config", `{"id": "web", "bundle": "` + broken + `"}`, "", nil, "unable to decode " + broken + "/config.json"},
+		{"no id", `{"ociVersion": "1.0.2", "bundle": "` + bundle + `"}`, "", nil, "OCI state has no container id"},
+		{"invalid state", `{"id": `, "", nil, "unable to decode OCI state from stdin"},
+		{"empty stdin", ``, "", nil, "unable to decode OCI state from stdin"},
+	}
+	for _, tt := range tests {
+		id, vols, err := ociHookVolumes(strings.NewReader(tt.state))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: err = %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || id != tt.id || !reflect.DeepEqual(vols, tt.vols) {
+			t.Errorf("%s: ociHookVolumes = %q %q %v, want %q %q", tt.name, id, vols, err, tt.id, tt.vols)
+		}
+	}
+}
+
+func TestOCIAnnotationsUnreadableBundle(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("root reads any file")
+	}
+	bundle := writeBundle(t, `{}`)
+	if err := os.Chmod(filepath.Join(bundle, "config.json"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ociAnnotations(&OCIState{ID: "web", Bundle: bundle}); err == nil {
+		t.Error("ociAnnotations of an unreadable config.json succeeded")
+	}
+}
+
+func TestRunPrestartPoststop(t *testing.T) {
+	api, _ := setupTest(t)
+	data := api.addVolume("data", "us-east", 20, 0)
+	logs := api.addVolume("logs", "us-east", 20, 2)
+	state := `{"ociVersion": "1.0.2", "id": "web", "annotations": {"one-linode.volumes": "data,logs"}}`
+
+	stdin := os.Stdin
+	defer func() { os.Stdin = stdin }()
+	setStdin := func(s string) {
+		f, err := ioutil.TempFile(t.TempDir(), "state")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteString(s); err != nil {
+			t.Fatal(err)
+		}
+		_, _ = f.Seek(0, 0)
+		os.Stdin = f
+	}
+
+	setStdin(state)
+	if code, _ := runCommand(t, "prestart"); code != 0 {
+		t.Fatalf("prestart = %d", code)
+	}
+	if api.volume(data).LinodeID != 1 || api.volume(logs).LinodeID != 1 {
+		t.Fatalf("volumes on %d and %d, want both on web1", api.volume(data).LinodeID, api.volume(logs).LinodeID)
+	}
+	if vols := stateVolumes("web"); !reflect.DeepEqual(vols, []string{"data", "logs"}) {
+		t.Errorf("state volumes = %v", vols)
+	}
+
+	// without the annotation poststop detaches what the state file records
+	setStdin(`{"ociVersion": "1.0.2", "id": "web"}`)
+	if code, _ := runCommand(t, "poststop"); code != 0 {
+		t.Fatalf("poststop = %d", code)
+	}
+	if api.volume(data).LinodeID != 0 || api.volume(logs).LinodeID != 0 {
+		t.Errorf("volumes still attached after poststop")
+	}
+
+	setStdin(`not json`)
+	if code, _ := runCommand(t, "prestart"); code != 1 {
+		t.Errorf("prestart with invalid state = %d, want 1", code)
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/libgolang/log"
+)
+
+// VM attribute naming the linode volumes of the VM, in USER_TEMPLATE or
+// CONTEXT as a comma separated list or in a DISK as a single label
+const (
+	oneVolumesAttribute = "LINODE_VOLUMES"
+	oneDiskAttribute    = "LINODE_VOLUME"
+	// host attribute naming the linode of an OpenNebula host whose name differs from the linode label
+	oneHostLinodeAttribute = "LINODE_LABEL"
+	// oneUpdateMerge one.vm.update type merging into the user template instead of replacing it
+	oneUpdateMerge = 1
+)
+
+// xmlNode generic xml element.  OpenNebula templates are free form so they
+// are walked instead of decoded into fixed structs
+type xmlNode struct {
+	XMLName xml.Name
+	Content string    `xml:",chardata"`
+	Nodes   []xmlNode `xml:",any"`
+}
+
+// children returns the child elements with the given name
+func (n *xmlNode) children(name string) []*xmlNode {
+	var nodes []*xmlNode
+	for i := range n.Nodes {
+		if n.Nodes[i].XMLName.Local == name {
+			nodes = append(nodes, &n.Nodes[i])
+		}
+	}
+	return nodes
+}
+
+// child returns the first element at path or nil
+func (n *xmlNode) child(path ...string) *xmlNode {
+	cur := n
+	for _, name := range path {
+		nodes := cur.children(name)
+		if len(nodes) == 0 {
+			return nil
+		}
+		cur = nodes[0]
+	}
+	return cur
+}
+
+// text returns the trimmed text of the element at path or empty
+func (n *xmlNode) text(path ...string) string {
+	if c := n.child(path...); c != nil {
+		return strings.TrimSpace(c.Content)
+	}
+	return ""
+}
+
+// OneVM the parts of an OpenNebula VM one-linode uses
+type OneVM struct {
+	ID     string
+	Name   string
+	Host   string // host of the last history record
+	HostID string // host id of the last history record
+	// PreviousHost host of the history record before the last one, the
+	// source host while the VM migrates
+	PreviousHost   string
+	PreviousHostID string
+	Volumes        []string // linode volume labels
+	// Attributes the USER_TEMPLATE attributes, then the CONTEXT ones
+	Attributes map[string]string
+}
+
+// parseVM parses the VM xml as returned by one.vm.info or given to hooks in $TEMPLATE
+func parseVM(data []byte) (*OneVM, error) {
+	root := &xmlNode{}
+	if err := xml.Unmarshal(data, root); err != nil {
+		return nil, fmt.Errorf("unable to parse VM template: %s", err)
+	}
+	if root.XMLName.Local != "VM" {
+		return nil, fmt.Errorf("unable to parse VM template: root element is %s, not VM", root.XMLName.Local)
+	}
+
+	vm := &OneVM{
+		ID:         root.text("ID"),
+		Name:       root.text("NAME"),
+		Attributes: make(map[string]string),
+	}
+	if hr := root.child("HISTORY_RECORDS"); hr != nil {
+		if h := hr.children("HISTORY"); len(h) > 0 {
+			vm.Host = h[len(h)-1].text("HOSTNAME")
+			vm.HostID = h[len(h)-1].text("HID")
+			if len(h) > 1 {
+				vm.PreviousHost = h[len(h)-2].text("HOSTNAME")
+				vm.PreviousHostID = h[len(h)-2].text("HID")
+			}
+		}
+	}
+
+	context := root.child("TEMPLATE", "CONTEXT")
+	for _, attrs := range []*xmlNode{root.child("USER_TEMPLATE"), context} {
+		if attrs == nil {
+			continue
+		}
+		for _, a := range attrs.Nodes {
+			if _, ok := vm.Attributes[a.XMLName.Local]; !ok {
+				vm.Attributes[a.XMLName.Local] = strings.TrimSpace(a.Content)
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	add := func(labels ...string) {
+		for _, l := range labels {
+			if !seen[l] {
+				seen[l] = true
+				vm.Volumes = append(vm.Volumes, l)
+			}
+		}
+	}
+	add(splitVolumes(root.text("USER_TEMPLATE", oneVolumesAttribute))...)
+	if context != nil {
+		add(splitVolumes(context.text(oneVolumesAttribute))...)
+	}
+	if tmpl := root.child("TEMPLATE"); tmpl != nil {
+		for _, disk := range tmpl.children("DISK") {
+			if l := disk.text(oneDiskAttribute); l != "" {
+				add(l)
+			}
+		}
+	}
+	return vm, nil
+}
+
+// decodeVMTemplate decodes the base64 $TEMPLATE argument of OpenNebula hooks
+func decodeVMTemplate(encoded string) (*OneVM, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode base64 VM template: %s", err)
+	}
+	return parseVM(data)
+}
+
+// currentVM the VM given with --template or --vm-id, nil otherwise
+var currentVM *OneVM
+
+// applyVM uses the VM for the host, container name and volumes not given on
+// the command line
+func applyVM(vm *OneVM) {
+	currentVM = vm
+	if !isFlagSet("host") && vm.Host != "" {
+		*hostPtr = vm.Host
+	}
+	if !isFlagSet("name") && vm.Name != "" {
+		*namePtr = vm.Name
+	}
+	if len(volumes) == 0 {
+		volumes = append(volumes, vm.Volumes...)
+	}
+	log.Debug("VM %s(%s) on host %s with volumes %v", vm.Name, vm.ID, vm.Host, vm.Volumes)
+}
+
+// isFlagSet whether the global flag was given on the command line
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// OneHost the parts of an OpenNebula host one-linode uses
+type OneHost struct {
+	ID         string
+	Name       string
+	Attributes map[string]string // TEMPLATE attributes
+}
+
+// LinodeLabel label of the linode backing the host
+func (h *OneHost) LinodeLabel() string {
+	if l := h.Attributes[oneHostLinodeAttribute]; l != "" {
+		return l
+	}
+	return h.Name
+}
+
+// parseHost parses the host xml as returned by one.host.info
+func parseHost(data []byte) (*OneHost, error) {
+	root := &xmlNode{}
+	if err := xml.Unmarshal(data, root); err != nil {
+		return nil, fmt.Errorf("unable to parse host: %s", err)
+	}
+	h := &OneHost{ID: root.text("ID"), Name: root.text("NAME"), Attributes: make(map[string]string)}
+	if tmpl := root.child("TEMPLATE"); tmpl != nil {
+		for _, a := range tmpl.Nodes {
+			h.Attributes[a.XMLName.Local] = strings.TrimSpace(a.Content)
+		}
+	}
+	return h, nil
+}
+
+// oneClient OpenNebula XML-RPC API client
+type oneClient struct {
+	endpoint string
+	session  string // user:password
+}
+
+// newOneClient returns a client for --one-endpoint.  Credentials come from
+// --one-auth, or from the file in $ONE_AUTH or ~/.one/one_auth like the
+// OpenNebula CLI does
+func newOneClient() (*oneClient, error) {
+	session := *oneAuthPtr
+	if session == "" {
+		path := os.Getenv("ONE_AUTH")
+		if path == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, err
+			}
+			path = filepath.Join(home, ".one", "one_auth")
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("no OpenNebula credentials: --one-auth not set and %s", err)
+		}
+		session = strings.TrimSpace(string(b))
+	}
+	return &oneClient{endpoint: *oneEndpointPtr, session: session}, nil
+}
+
+// call calls an OpenNebula API method.  OpenNebula answers with an array of
+// success, result or error message, error code
+func (c *oneClient) call(method string, args ...interface{}) (interface{}, error) {
+	if *dryRunPtr && !strings.HasSuffix(method, ".info") {
+		dryRun("call %s %v", method, args)
+		return nil, nil
+	}
+	res, err := xmlrpcCall(c.endpoint, method, append([]interface{}{c.session}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	values, ok := res.([]interface{})
+	if !ok || len(values) < 2 {
+		return nil, fmt.Errorf("%s: unexpected response %v", method, res)
+	}
+	if success, _ := values[0].(bool); !success {
+		return nil, fmt.Errorf("%s: %v", method, values[1])
+	}
+	return values[1], nil
+}
+
+// callXML calls a method returning an xml document
+func (c *oneClient) callXML(method string, args ...interface{}) ([]byte, error) {
+	res, err := c.call(method, args...)
+	if err != nil {
+		return nil, err
+	}
+	body, ok := res.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s: expected an xml document, got %v", method, res)
+	}
+	return []byte(body), nil
+}
+
+// vmInfo one.vm.info
+func (c *oneClient) vmInfo(id int) (*OneVM, error) {
+	data, err := c.callXML("one.vm.info", id)
+	if err != nil {
+		return nil, err
+	}
+	return parseVM(data)
+}
+
+// hostInfo one.host.info
+func (c *oneClient) hostInfo(id int) (*OneHost, error) {
+	data, err := c.callXML("one.host.info", id)
+	if err != nil {
+		return nil, err
+	}
+	return parseHost(data)
+}
+
+// lookupVM returns the VM with its host resolved to the linode label of the
+// host it is deployed on
+func (c *oneClient) lookupVM(id int) (*OneVM, error) {
+	vm, err := c.vmInfo(id)
+	if err != nil {
+		return nil, err
+	}
+	if vm.Host, err = c.linodeLabel(vm.HostID, vm.Host); err != nil {
+		return nil, err
+	}
+	if vm.PreviousHost, err = c.linodeLabel(vm.PreviousHostID, vm.PreviousHost); err != nil {
+		return nil, err
+	}
+	return vm, nil
+}
+
+// linodeLabel returns the linode label of the host with the given id, or
+// name when the id is empty
+func (c *oneClient) linodeLabel(hostID, name string) (string, error) {
+	if hostID == "" {
+		return name, nil
+	}
+	hid, err := strconv.Atoi(hostID)
+	if err != nil {
+		return "", fmt.Errorf("invalid host id %q", hostID)
+	}
+	host, err := c.hostInfo(hid)
+	if err != nil {
+		return "", err
+	}
+	return host.LinodeLabel(), nil
+}
+
+// updateVM merges the attributes into the user template of the VM with one.vm.update
+func (c *oneClient) updateVM(id int, attrs map[string]string) error {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	lines := make([]string, 0, len(keys))
+	for _, k := range keys {
+		lines = append(lines, fmt.Sprintf("%s = %q", k, attrs[k]))
+	}
+	_, err := c.call("one.vm.update", id, strings.Join(lines, "\n")+"\n", oneUpdateMerge)
+	return err
+}
+
+// lookupVM looks up a VM through the OpenNebula API
+func lookupVM(id int) (*OneVM, error) {
+	c, err := newOneClient()
+	if err != nil {
+		return nil, err
+	}
+	return c.lookupVM(id)
+}
+
+// volumeAttribute name of the VM attribute describing the volume, e.g:
+// LINODE_VOLUME_DB_DATA_ID for volume db-data and suffix ID
+func volumeAttribute(label, suffix string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, label)
+	return oneDiskAttribute + "_" + name + "_" + suffix
+}
+
+// updateVMAttachments writes the attached volumes into the user template of
+// the current VM when --update-vm is set.  The volumes are attached at this
+// point so failures are only logged
+func updateVMAttachments(results []*VolumeResult) {
+	if !*updateVMPtr || currentVM == nil {
+		return
+	}
+	attrs := make(map[string]string)
+	for _, r := range results {
+		if r == nil || r.Error != "" {
+			continue
+		}
+		attrs[volumeAttribute(r.Volume, "ID")] = strconv.Itoa(r.VolumeID)
+		attrs[volumeAttribute(r.Volume, "DEVICE")] = r.FilesystemPath
+		attrs[volumeAttribute(r.Volume, "HOST")] = r.Linode
+	}
+	if len(attrs) == 0 {
+		return
+	}
+	id, err := strconv.Atoi(currentVM.ID)
+	if err != nil {
+		log.Warn("Unable to update VM template: invalid VM id %q", currentVM.ID)
+		return
+	}
+	c, err := newOneClient()
+	if err == nil {
+		err = c.updateVM(id, attrs)
+	}
+	if err != nil {
+		log.Warn("Unable to update template of VM %d: %s", id, err)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testVM = `<VM>
+  <ID>42</ID>
+  <NAME>web</NAME>
+  <USER_TEMPLATE>
+    <LINODE_VOLUMES><![CDATA[web-data, web-logs]]></LINODE_VOLUMES>
+    <ROLE>frontend</ROLE>
+  </USER_TEMPLATE>
+  <TEMPLATE>
+    <CONTEXT>
+      <LINODE_VOLUMES>web-logs,web-cache</LINODE_VOLUMES>
+      <ROLE>ignored</ROLE>
+      <NETWORK>YES</NETWORK>
+    </CONTEXT>
+    <DISK><DISK_ID>0</DISK_ID></DISK>
+    <DISK><LINODE_VOLUME>web-db</LINODE_VOLUME></DISK>
+  </TEMPLATE>
+  <HISTORY_RECORDS>
+    <HISTORY><HOSTNAME>one-a</HOSTNAME><HID>3</HID></HISTORY>
+    <HISTORY><HOSTNAME>one-b</HOSTNAME><HID>4</HID></HISTORY>
+  </HISTORY_RECORDS>
+</VM>`
+
+func TestParseVM(t *testing.T) {
+	vm, err := parseVM([]byte(testVM))
+	if err != nil {
+		t.Fatalf("parseVM: %s", err)
+	}
+	if vm.ID != "42" || vm.Name != "web" {
+		t.Errorf("ID, Name = %s, %s", vm.ID, vm.Name)
+	}
+	if vm.Host != "one-b" || vm.HostID != "4" || vm.PreviousHost != "one-a" || vm.PreviousHostID != "3" {
+		t.Errorf("hosts = %s(%s) after %s(%s), want one-b(4) after one-a(3)", vm.Host, vm.HostID, vm.PreviousHost, vm.PreviousHostID)
+	}
+	want := []string{"web-data", "web-logs", "web-cache", "web-db"}
+	if !reflect.DeepEqual(vm.Volumes, want) {
+		t.Errorf("Volumes = %v, want %v", vm.Volumes, want)
+	}
+	// USER_TEMPLATE wins over CONTEXT
+	if vm.Attributes["ROLE"] != "frontend" || vm.Attributes["NETWORK"] != "YES" {
+		t.Errorf("Attributes = %v", vm.Attributes)
+	}
+}
+
+func TestParseVMErrors(t *testing.T) {
+	for _, data := range []string{"", "<VM>", "<HOST><ID>1</ID></HOST>"} {
+		if _, err := parseVM([]byte(data)); err == nil {
+			t.Errorf("parseVM(%q) succeeded", data)
+		}
+	}
+	vm, err := parseVM([]byte("<VM><ID>1</ID></VM>"))
+	if err != nil || vm.Host != "" || len(vm.Volumes) != 0 {
+		t.Errorf("parseVM of a bare VM = %+v, %v", vm, err)
+	}
+}
+
+// xmlrpcCallRecord a call received by the XML-RPC stand-in
+type xmlrpcCallRecord struct {
+	method string
+	params []interface{}
+}
+
+// oneStub OpenNebula XML-RPC stand-in answering one.vm.info, one.host.info,
+// one.vm.update, one.hooklist.info and one.hook.allocate
+type oneStub struct {
+	mu    sync.Mutex
+	calls []xmlrpcCallRecord
+	hosts map[int]string // host id to host xml
+	hooks []string       // names of the registered hooks, the index is the id
+}
+
+func (s *oneStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	root := &xmlNode{}
+	if err := xml.Unmarshal(body, root); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	call := xmlrpcCallRecord{method: root.text("methodName")}
+	if params := root.child("params"); params != nil {
+		for _, p := range params.children("param") {
+			v, err := decodeXMLRPCValue(p.child("value"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			call.params = append(call.params, v)
+		}
+	}
+	s.mu.Lock()
+	s.calls = append(s.calls, call)
+	s.mu.Unlock()
+
+	if len(call.params) == 0 || call.params[0] != "oneadmin:secret" {
+		writeOneResult(w, false, "[one] User couldn't be authenticated")
+		return
+	}
+	switch call.method {
+	case "one.vm.info":
+		writeOneResult(w, true, testVM)
+	case "one.host.info":
+		id, _ := call.params[1].(int)
+		if h, ok := s.hosts[id]; ok {
+			writeOneResult(w, true, h)
+		} else {
+			writeOneResult(w, false, "[one.host.info] Error getting host")
+		}
+	case "one.vm.update":
+		writeOneResult(w, true, "42")
+	case "one.hooklist.info":
+		pool := "<HOOK_POOL>"
+		s.mu.Lock()
+		for id, name := range s.hooks {
+			pool += fmt.Sprintf("<HOOK><ID>%d</ID><NAME>%s</NAME><TYPE>state</TYPE></HOOK>", id, name)
+		}
+		s.mu.Unlock()
+		writeOneResult(w, true, pool+"</HOOK_POOL>")
+	case "one.hook.allocate":
+		tmpl, _ := call.params[1].(string)
+		name := strings.Trim(strings.TrimPrefix(strings.SplitN(tmpl, "\n", 2)[0], "NAME = "), `"`)
+		s.mu.Lock()
+		s.hooks = append(s.hooks, name)
+		id := len(s.hooks) - 1
+		s.mu.Unlock()
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprintf(w, `<?xml version="1.0"?><methodResponse><params><param><value><array><data><value><boolean>1</boolean></value><value><i4>%d</i4></value><value><i4>0</i4></value></data></array></value></param></params></methodResponse>`, id)
+	default:
+		w.Header().Set("Content-Type", "text/xml")
+		_, _ = w.Write([]byte(`<?xml version="1.0"?><methodResponse><fault><value><struct>
+<member><name>faultCode</name><value><int>-32601</int></value></member>
+<member><name>faultString</name><value><string>unknown method</string></value></member>
+</struct></value></fault></methodResponse>`))
+	}
+}
+
+// writeOneResult writes the success, result, error code array OpenNebula answers with
+func writeOneResult(w http.ResponseWriter, success bool, result string) {
+	buf := &bytes.Buffer{}
+	ok := "0"
+	if success {
+		ok = "1"
+	}
+	buf.WriteString(`<?xml version="1.0"?><methodResponse><params><param><value><array><data>`)
+	buf.WriteString(`<value><boolean>` + ok + `</boolean></value><value><string>`)
+	_ = xml.EscapeText(buf, []byte(result))
+	buf.WriteString(`</string></value><value><i4>0</i4></value></data></array></value></param></params></methodResponse>`)
+	w.Header().Set("Content-Type", "text/xml")
+	_, _ = w.Write(buf.Bytes())
+}
+
+// startOneStub serves the stand-in and points --one-endpoint and --one-auth at it
+func startOneStub(t *testing.T) *oneStub {
+	t.Helper()
+	s := &oneStub{hosts: map[int]string{
+		3: `<HOST><ID>3</ID><NAME>one-a</NAME><TEMPLATE><LINODE_LABEL>web1</LINODE_LABEL></TEMPLATE></HOST>`,
+		4: `<HOST><ID>4</ID><NAME>db1</NAME><TEMPLATE></TEMPLATE></HOST>`,
+	}}
+	srv := httptest.NewServer(s)
+	endpoint, auth := *oneEndpointPtr, *oneAuthPtr
+	t.Cleanup(func() {
+		srv.Close()
+		*oneEndpointPtr, *oneAuthPtr = endpoint, auth
+	})
+	*oneEndpointPtr = srv.URL + "/RPC2"
+	*oneAuthPtr = "oneadmin:secret"
+	return s
+}
+
+func TestXMLRPCCall(t *testing.T) {
+	s := startOneStub(t)
+	res, err := xmlrpcCall(*oneEndpointPtr, "one.vm.info", "oneadmin:secret", 42, true)
+	if err != nil {
+		t.Fatalf("xmlrpcCall: %s", err)
+	}
+	want := []interface{}{true, testVM, 0}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("result = %#v", res)
+	}
+	call := s.calls[0]
+	if call.method != "one.vm.info" || !reflect.DeepEqual(call.params, []interface{}{"oneadmin:secret", 42, true}) {
+		t.Errorf("call = %s %#v", call.method, call.params)
+	}
+}
+
+func TestXMLRPCCallFault(t *testing.T) {
+	startOneStub(t)
+	_, err := xmlrpcCall(*oneEndpointPtr, "one.nothing", "oneadmin:secret")
+	if err == nil || !strings.Contains(err.Error(), "unknown method") || !strings.Contains(err.Error(), "-32601") {
+		t.Errorf("xmlrpcCall = %v, want the fault", err)
+	}
+}
+
+func TestXMLRPCCallHTTPError(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	if _, err := xmlrpcCall(srv.URL, "one.vm.info"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("xmlrpcCall = %v, want error 404", err)
+	}
+}
+
+func TestDecodeXMLRPCResponse(t *testing.T) {
+	data := `<methodResponse><params><param><value><struct>
+<member><name>s</name><value>untyped</value></member>
+<member><name>d</name><value><double>1.5</double></value></member>
+<member><name>a</name><value><array><data><value><i8>7</i8></value><value><boolean>0</boolean></value></data></array></value></member>
+<member><name>e</name><value><array><data></data></array></value></member>
+</struct></value></param></params></methodResponse>`
+	res, err := decodeXMLRPCResponse([]byte(data))
+	if err != nil {
+		t.Fatalf("decodeXMLRPCResponse: %s", err)
+	}
+	want := map[string]interface{}{"s": "untyped", "d": 1.5, "a": []interface{}{7, false}, "e": []interface{}(nil)}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("result = %#v, want %#v", res, want)
+	}
+
+	for _, bad := range []string{"<methodResponse/>", "<methodResponse><params><param><value><nil/></value></param></params></methodResponse>", "not xml"} {
+		if _, err := decodeXMLRPCResponse([]byte(bad)); err == nil {
+			t.Errorf("decodeXMLRPCResponse(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestEncodeXMLRPCCallEscapes(t *testing.T) {
+	b, err := encodeXMLRPCCall("one.vm.update", []interface{}{"a<b&c", 1, false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "<string>a&lt;b&amp;c</string>") || !strings.Contains(string(b), "<boolean>0</boolean>") {
+		t.Errorf("encoded = %s", b)
+	}
+	if _, err := encodeXMLRPCCall("x", []interface{}{1.5}); err == nil {
+		t.Error("float param encoded")
+	}
+}
+
+func TestLookupVM(t *testing.T) {
+	startOneStub(t)
+	vm, err := lookupVM(42)
+	if err != nil {
+		t.Fatalf("lookupVM: %s", err)
+	}
+	// host 4 has no LINODE_LABEL and goes by its name
+	if vm.Host != "db1" || vm.PreviousHost != "web1" {
+		t.Errorf("Host, PreviousHost = %s, %s, want db1, web1", vm.Host, vm.PreviousHost)
+	}
+
+	*oneAuthPtr = "oneadmin:wrong"
+	if _, err := lookupVM(42); err == nil || !strings.Contains(err.Error(), "authenticated") {
+		t.Errorf("lookupVM with bad credentials = %v", err)
+	}
+}
+
+func TestUpdateVM(t *testing.T) {
+	s := startOneStub(t)
+	c, err := newOneClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.updateVM(42, map[string]string{"LINODE_VOLUME_DATA_ID": "7", "LINODE_VOLUME_DATA_HOST": "web1"}); err != nil {
+		t.Fatalf("updateVM: %s", err)
+	}
+	call := s.calls[len(s.calls)-1]
+	want := []interface{}{"oneadmin:secret", 42, "LINODE_VOLUME_DATA_HOST = \"web1\"\nLINODE_VOLUME_DATA_ID = \"7\"\n", oneUpdateMerge}
+	if call.method != "one.vm.update" || !reflect.DeepEqual(call.params, want) {
+		t.Errorf("call = %s %#v", call.method, call.params)
+	}
+}
+
+func TestVolumeAttribute(t *testing.T) {
+	if a := volumeAttribute("db-data.1", "ID"); a != "LINODE_VOLUME_DB_DATA_1_ID" {
+		t.Errorf("volumeAttribute = %s", a)
+	}
+}
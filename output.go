@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/libgolang/log"
+	"github.com/magiconair/properties"
+)
+
+// Output envelope of the results of a command.  This is the schema of
+// --output json and is kept stable for consumers
+type Output struct {
+	Command    string      `json:"command"`
+	OK         bool        `json:"ok"`
+	Error      string      `json:"error,omitempty"`
+	DurationMs int64       `json:"duration_ms"`
+	Results    interface{} `json:"results"`
+}
+
+// VolumeResult outcome of an operation on a single volume
+type VolumeResult struct {
+	Volume           string `json:"volume"`
+	VolumeID         int    `json:"volume_id"`
+	Linode           string `json:"linode"`
+	LinodeID         int    `json:"linode_id"`
+	PreviousLinodeID int    `json:"previous_linode_id"`
+	FilesystemPath   string `json:"filesystem_path"`
+	MountPoint       string `json:"mount_point"`
+	Size             int    `json:"size"`
+	DurationMs       int64  `json:"duration_ms"`
+	Error            string `json:"error"`
+}
+
+// VolumeInfo a volume as listed by the list command
+type VolumeInfo struct {
+	Volume         string `json:"volume"`
+	VolumeID       int    `json:"volume_id"`
+	Size           int    `json:"size"`
+	Region         string `json:"region"`
+	Status         string `json:"status"`
+	Linode         string `json:"linode"`
+	LinodeID       int    `json:"linode_id"`
+	FilesystemPath string `json:"filesystem_path"`
+}
+
+// StatusInfo an attachment recorded in the state file and where its volume is now
+type StatusInfo struct {
+	Container      string `json:"container"`
+	Host           string `json:"host"`
+	Volume         string `json:"volume"`
+	VolumeID       int    `json:"volume_id"`
+	FilesystemPath string `json:"filesystem_path"`
+	MountPoint     string `json:"mount_point"`
+	AttachedTo     string `json:"attached_to"`
+}
+
+// printOutput writes the output of a command to w in the given format: json | table | plain
+func printOutput(w io.Writer, format string, out *Output) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+	case "table":
+		return printTable(w, out.Results)
+	case "plain":
+		return printPlain(w, out.Results)
+	default:
+		return fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+// printTable prints a slice of structs as a table with a column per json field
+func printTable(w io.Writer, results interface{}) error {
+	rows := reflect.ValueOf(results)
+	if rows.Kind() != reflect.Slice {
+		return nil
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	names := fieldNames(reflect.TypeOf(results).Elem())
+	for i, n := range names {
+		names[i] = strings.ToUpper(n)
+	}
+	fmt.Fprintln(tw, strings.Join(names, "\t"))
+	for i := 0; i < rows.Len(); i++ {
+		fmt.Fprintln(tw, strings.Join(fieldValues(rows.Index(i)), "\t"))
+	}
+	return tw.Flush()
+}
+
+// printPlain prints a line of key=value pairs per result, skipping empty values
+func printPlain(w io.Writer, results interface{}) error {
+	rows := reflect.ValueOf(results)
+	if rows.Kind() != reflect.Slice {
+		return nil
+	}
+	names := fieldNames(reflect.TypeOf(results).Elem())
+	for i := 0; i < rows.Len(); i++ {
+		var pairs []string
+		for j, v := range fieldValues(rows.Index(i)) {
+			if v != "" && v != "0" {
+				pairs = append(pairs, fmt.Sprintf("%s=%s", names[j], v))
+			}
+		}
+		if _, err := fmt.Fprintln(w, strings.Join(pairs, " ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fieldNames json names of the fields of a struct type or pointer to struct type
+func fieldNames(t reflect.Type) []string {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		names = append(names, strings.Split(t.Field(i).Tag.Get("json"), ",")[0])
+	}
+	return names
+}
+
+// fieldValues string values of the fields of a struct or pointer to struct
+func fieldValues(v reflect.Value) []string {
+	if v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	var values []string
+	for i := 0; i < v.NumField(); i++ {
+		values = append(values, fmt.Sprint(v.Field(i).Interface()))
+	}
+	return values
+}
+
+// msSince milliseconds elapsed since start
+func msSince(start time.Time) int64 {
+	return int64(time.Since(start) / time.Millisecond)
+}
+
+// stderrWriter log writer printing to stderr, keeping stdout for command output
+type stderrWriter struct {
+	level log.Level
+}
+
+// WriteLog implementation of log.Writer
+func (w *stderrWriter) WriteLog(name string, mLevel log.Level, format string, args []interface{}) {
+	if w.level < mLevel {
+		return
+	}
+
+	var preFormat string
+	if log.IsTraceEnabled() {
+		_, file, line, _ := runtime.Caller(4)
+		preFormat = fmt.Sprintf("%s %s [%s] %s:%d %s\n", time.Now().Format(time.RFC3339), mLevel, name, file, line, format)
+	} else {
+		preFormat = fmt.Sprintf("%s %s [%s] %s\n", time.Now().Format(time.RFC3339), mLevel, name, format)
+	}
+	fmt.Fprintf(os.Stderr, preFormat, args...)
+}
+
+// SetLevel implementation of log.Writer
+func (w *stderrWriter) SetLevel(level log.Level) {
+	w.level = level
+}
+
+// loadLogProperties loads the log.* properties of file the way
+// log.LoadLogProperties does, except that stdout writers write to stderr
+// since stdout carries the command output
+func loadLogProperties(file string) {
+	props, err := properties.LoadFile(file, properties.UTF8)
+	if err != nil {
+		return
+	}
+	if props.GetString("log.trace", "false") == "true" {
+		log.SetTrace(true)
+	}
+
+	levels := map[string]log.Level{"": logLevel(props.GetString("log.level", ""))}
+	var writers []log.Writer
+	seen := make(map[string]bool)
+	for _, k := range props.Keys() {
+		parts := strings.Split(k, ".")
+		if len(parts) == 3 && parts[0] == "log" && parts[1] == "level" {
+			levels[parts[2]] = logLevel(props.GetString(k, ""))
+		}
+		if len(parts) != 4 || parts[0] != "log" || parts[1] != "writer" || seen[parts[2]] {
+			continue
+		}
+		name := parts[2]
+		seen[name] = true
+		prefix := "log.writer." + name + "."
+		level := logLevel(props.GetString(prefix+"level", "DEBUG"))
+		switch props.GetString(prefix+"type", "stdout") {
+		case "stdout":
+			writers = append(writers, &stderrWriter{level: level})
+		case "file":
+			size := log.FileSize(props.GetInt64(prefix+"maxSize", int64(log.Gigabyte)))
+			writers = append(writers, log.NewFileWriter(props.GetString(prefix+"dir", "./log"), props.GetString(prefix+"name", name), size, props.GetInt(prefix+"maxFiles", 10), level))
+		}
+	}
+
+	log.SetLoggerLevels(levels)
+	if len(writers) > 0 {
+		log.SetWriters(writers)
+	}
+}
+
+// logLevel parses a level name, OTHER when unknown
+func logLevel(name string) log.Level {
+	var level log.Level
+	_ = level.UnmarshalJSON([]byte(strconv.Quote(name)))
+	return level
+}
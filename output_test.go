@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/libgolang/log"
+)
+
+var testResults = []VolumeResult{
+	{Volume: "data", VolumeID: 10, Linode: "web1", LinodeID: 1, FilesystemPath: "/dev/disk/by-id/scsi-0Linode_Volume_data", Size: 20, DurationMs: 5},
+	{Volume: "logs", VolumeID: 11, Error: "Not Found"},
+}
+
+func TestPrintOutputJSON(t *testing.T) {
+	var b bytes.Buffer
+	out := &Output{Command: "attach", OK: false, Error: "1 of 2 volumes failed", DurationMs: 7, Results: testResults[1:]}
+	if err := printOutput(&b, "json", out); err != nil {
+		t.Fatal(err)
+	}
+	want := `{
+  "command": "attach",
+  "ok": false,
+  "error": "1 of 2 volumes failed",
+  "duration_ms": 7,
+  "results": [
+    {
+      "volume": "logs",
+      "volume_id": 11,
+      "linode": "",
+      "linode_id": 0,
+      "previous_linode_id": 0,
+      "filesystem_path": "",
+      "mount_point": "",
+      "size": 0,
+      "duration_ms": 0,
+      "error": "Not Found"
+    }
+  ]
+}
+`
+	if b.String() != want {
+		t.Errorf("json output =\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestPrintTable(t *testing.T) {
+	var b bytes.Buffer
+	if err := printOutput(&b, "table", &Output{Results: testResults}); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"VOLUME  VOLUME_ID  LINODE  LINODE_ID  PREVIOUS_LINODE_ID  FILESYSTEM_PATH                           MOUNT_POINT  SIZE  DURATION_MS  ERROR",
+		"data    10         web1    1          0                   /dev/disk/by-id/scsi-0Linode_Volume_data               20    5            ",
+		"logs    11                 0          0                                                                          0     0            Not Found",
+		"",
+	}, "\n")
+	if b.String() != want {
+		t.Errorf("table output =\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestPrintPlain(t *testing.T) {
+	var b bytes.Buffer
+	if err := printOutput(&b, "plain", &Output{Results: testResults}); err != nil {
+		t.Fatal(err)
+	}
+	want := "volume=data volume_id=10 linode=web1 linode_id=1 filesystem_path=/dev/disk/by-id/scsi-0Linode_Volume_data size=20 duration_ms=5\n" +
+		"volume=logs volume_id=11 error=Not Found\n"
+	if b.String() != want {
+		t.Errorf("plain output =\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestPrintOutputNoResults(t *testing.T) {
+	for _, format := range []string{"table", "plain"} {
+		var b bytes.Buffer
+		if err := printOutput(&b, format, &Output{Command: "status"}); err != nil || b.Len() != 0 {
+			t.Errorf("%s printed %q, %v, want nothing", format, b.String(), err)
+		}
+	}
+	if err := printOutput(&bytes.Buffer{}, "yaml", &Output{}); err == nil {
+		t.Error("printOutput accepted format yaml")
+	}
+}
+
+func TestLoadLogPropertiesKeepsStdout(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.properties")
+	data := "log.level = DEBUG\nlog.writer.console.type = stdout\nlog.writer.console.level = INFO\nlog.writer.other.level = WARN\n"
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		log.SetWriters([]log.Writer{&stderrWriter{level: log.OTHER}})
+		log.SetLoggerLevels(map[string]log.Level{"": log.OTHER})
+	}()
+	loadLogProperties(file)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := os.Stderr
+	os.Stderr = w
+	out := captureStdout(t, func() {
+		log.Debug("Reading the volumes")
+		log.Info("Attaching volume data")
+	})
+	os.Stderr = stderr
+	_ = w.Close()
+	logged, _ := ioutil.ReadAll(r)
+	if out != "" {
+		t.Errorf("log written to stdout: %q", out)
+	}
+	// console logs at INFO and other at WARN
+	if s := string(logged); strings.Count(s, "Attaching volume data") != 1 || strings.Contains(s, "Reading the volumes") {
+		t.Errorf("stderr = %q, want the info message once", s)
+	}
+}
+
+func TestLoadLogPropertiesMissingFile(t *testing.T) {
+	rec := recordLog(t)
+	loadLogProperties(filepath.Join(t.TempDir(), "missing.properties"))
+	log.Warn("still recorded")
+	if len(rec.messages) != 1 {
+		t.Errorf("writers were replaced, recorded %q", rec.messages)
+	}
+}
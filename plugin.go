@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/libgolang/log"
+)
+
+const pluginContentType = "application/vnd.docker.plugins.v1.2+json"
+
+// volumePlugin Docker volume plugin backed by Linode volumes.  Every mount
+// of a volume is recorded in the state file as container docker:<mount id>,
+// the volume is attached and mounted on the first mount and unmounted and
+// detached after the last unmount
+type volumePlugin struct {
+	mountRoot   string
+	fsType      string
+	defaultSize int
+	deviceWait  time.Duration
+	mounter     Mounter
+
+	mu    sync.Mutex             // guards locks
+	locks map[string]*sync.Mutex // serializes the operations changing a volume
+}
+
+// pluginFunc a VolumeDriver endpoint
+type pluginFunc func(*pluginRequest) (*pluginResponse, error)
+
+// pluginRequest request body of the VolumeDriver endpoints
+type pluginRequest struct {
+	Name string            `json:"Name"`
+	ID   string            `json:"ID"`
+	Opts map[string]string `json:"Opts"`
+}
+
+// pluginVolume volume in Get and List responses
+type pluginVolume struct {
+	Name       string                 `json:"Name"`
+	Mountpoint string                 `json:"Mountpoint,omitempty"`
+	Status     map[string]interface{} `json:"Status,omitempty"`
+}
+
+// pluginResponse response body of the VolumeDriver endpoints
+type pluginResponse struct {
+	Err          string                 `json:"Err"`
+	Mountpoint   string                 `json:"Mountpoint,omitempty"`
+	Volume       *pluginVolume          `json:"Volume,omitempty"`
+	Volumes      []*pluginVolume        `json:"Volumes,omitempty"`
+	Capabilities map[string]interface{} `json:"Capabilities,omitempty"`
+}
+
+// runPlugin plugin command.  Serves the plugin protocol until interrupted
+func runPlugin(c *command, args []string) (interface{}, error) {
+	fs := c.flagSet()
+	socket := fs.String("socket", "/run/docker/plugins/linode.sock", "Unix socket to listen on")
+	mountRoot := fs.String("mount-root", "/var/lib/one-linode/mounts", "Directory where volumes are mounted")
+	fsType := fs.String("fs", "ext4", "Filesystem created on empty volumes")
+	size := fs.Int("size", 20, "Size in GB of volumes created without a size option")
+	if err := c.parse(fs, args); err != nil {
+		return nil, err
+	}
+
+	p := &volumePlugin{
+		mountRoot:   *mountRoot,
+		fsType:      *fsType,
+		defaultSize: *size,
+		deviceWait:  2 * time.Minute,
+		mounter:     hostMounter,
+	}
+
+	if err := os.MkdirAll(filepath.Dir(*socket), 0755); err != nil {
+		return nil, err
+	}
+	_ = os.Remove(*socket) // stale socket of a previous run
+	l, err := net.Listen("unix", *socket)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = os.Remove(*socket) }()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		_ = l.Close()
+	}()
+
+	log.Info("Serving the linode volume plugin on %s", *socket)
+	if err := http.Serve(l, p.handler()); err != nil && !errors.Is(err, net.ErrClosed) {
+		return nil, err
+	}
+	return []*VolumeResult{}, nil
+}
+
+// handler returns the http handler of the plugin protocol
+func (p *volumePlugin) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Plugin.Activate", func(w http.ResponseWriter, r *http.Request) {
+		writePluginJSON(w, map[string][]string{"Implements": {"VolumeDriver"}})
+	})
+	// a mount can take minutes, the read-only endpoints do not wait for it
+	p.handle(mux, "/VolumeDriver.Create", p.locked(p.create))
+	p.handle(mux, "/VolumeDriver.Remove", p.locked(p.remove))
+	p.handle(mux, "/VolumeDriver.Mount", p.locked(p.mount))
+	p.handle(mux, "/VolumeDriver.Unmount", p.locked(p.unmount))
+	p.handle(mux, "/VolumeDriver.Path", p.path)
+	p.handle(mux, "/VolumeDriver.Get", p.get)
+	p.handle(mux, "/VolumeDriver.List", p.list)
+	p.handle(mux, "/VolumeDriver.Capabilities", func(*pluginRequest) (*pluginResponse, error) {
+		// linode volumes can be attached from any host of the region
+		return &pluginResponse{Capabilities: map[string]interface{}{"Scope": "global"}}, nil
+	})
+	return mux
+}
+
+// handle registers a VolumeDriver endpoint.  Errors are returned in the Err field
+func (p *volumePlugin) handle(mux *http.ServeMux, path string, fn pluginFunc) {
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		req := &pluginRequest{}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+				writePluginJSON(w, &pluginResponse{Err: fmt.Sprintf("invalid request: %s", err)})
+				return
+			}
+		}
+		log.Debug("%s %s", path, req.Name)
+
+		resp, err := fn(req)
+		if err != nil {
+			log.Error("%s %s: %s", path, req.Name, err)
+			resp = &pluginResponse{Err: err.Error()}
+		}
+		writePluginJSON(w, resp)
+	})
+}
+
+// locked runs fn under the lock of the volume of the request
+func (p *volumePlugin) locked(fn pluginFunc) pluginFunc {
+	return func(req *pluginRequest) (*pluginResponse, error) {
+		l := p.volumeLock(req.Name)
+		l.Lock()
+		defer l.Unlock()
+		return fn(req)
+	}
+}
+
+// volumeLock returns the lock of the volume
+func (p *volumePlugin) volumeLock(name string) *sync.Mutex {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.locks == nil {
+		p.locks = make(map[string]*sync.Mutex)
+	}
+	l, ok := p.locks[name]
+	if !ok {
+		l = &sync.Mutex{}
+		p.locks[name] = l
+	}
+	return l
+}
+
+// writePluginJSON writes a plugin protocol response
+func writePluginJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", pluginContentType)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error("Unable to write plugin response: %s", err)
+	}
+}
+
+// mountPoint where the volume is mounted on this host
+func (p *volumePlugin) mountPoint(name string) string {
+	return filepath.Join(p.mountRoot, name)
+}
+
+// create creates the volume unless it exists.  Takes the size option in GB
+func (p *volumePlugin) create(req *pluginRequest) (*pluginResponse, error) {
+	if _, err := getVolumeByName(req.Name); err == nil {
+		return &pluginResponse{}, nil
+	}
+
+	size := p.defaultSize
+	if s, ok := req.Opts["size"]; ok {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid size option %q", s)
+		}
+		size = n
+	}
+	node, err := getLinodeByName(*hostPtr)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get Linode by name(%s): %s", *hostPtr, err)
+	}
+	if _, err := createVolume(CreateVolumeRequest{Label: req.Name, Region: node.Region, Size: size}); err != nil {
+		return nil, err
+	}
+	return &pluginResponse{}, nil
+}
+
+// remove deletes the volume
+func (p *volumePlugin) remove(req *pluginRequest) (*pluginResponse, error) {
+	vol, err := getVolumeByName(req.Name)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get Volume ID by name(%s): %s", req.Name, err)
+	}
+	if vol.LinodeID != 0 {
+		return nil, fmt.Errorf("volume %s is attached to linode %d", req.Name, vol.LinodeID)
+	}
+	if err := deleteVolume(vol.ID); err != nil {
+		return nil, err
+	}
+	return &pluginResponse{}, nil
+}
+
+// mount attaches and mounts the volume on the first mount
+func (p *volumePlugin) mount(req *pluginRequest) (*pluginResponse, error) {
+	container := "docker:" + req.ID
+	target := p.mountPoint(req.Name)
+
+	mounted, err := p.mounter.IsMounted(target)
+	if err != nil {
+		return nil, err
+	}
+	if mounted {
+		// already in use by another container on this host
+		vol, err := getVolumeByName(req.Name)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get Volume ID by name(%s): %s", req.Name, err)
+		}
+		att := &AttachmentState{
+			VolumeID:       vol.ID,
+			Label:          vol.Label,
+			FilesystemPath: vol.FilesystemPath,
+			LinodeID:       vol.LinodeID,
+			MountPoint:     target,
+		}
+		if err := recordAttachment(*statePtr, container, *hostPtr, att); err != nil {
+			return nil, err
+		}
+		return &pluginResponse{Mountpoint: target}, nil
+	}
+
+	res, err := attachOne(container, *hostPtr, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	err = p.mounter.WaitForDevice(res.FilesystemPath, p.deviceWait)
+	if err == nil {
+		err = p.mounter.FormatAndMount(res.FilesystemPath, target, p.fsType, "")
+	}
+	if err != nil {
+		// docker retries the mount, do not leave the volume attached meanwhile
+		if _, derr := detachOne(container, *hostPtr, req.Name); derr != nil {
+			log.Error("Unable to detach volume %s after the failed mount: %s", req.Name, derr)
+		}
+		return nil, err
+	}
+	if err := setMountPoint(*statePtr, container, req.Name, target); err != nil {
+		return nil, err
+	}
+	return &pluginResponse{Mountpoint: target}, nil
+}
+
+// unmount unmounts and detaches the volume after the last unmount
+func (p *volumePlugin) unmount(req *pluginRequest) (*pluginResponse, error) {
+	container := "docker:" + req.ID
+	st, err := loadState(*statePtr)
+	if err != nil {
+		return nil, err
+	}
+	for _, holder := range st.holders(req.Name) {
+		if holder != container {
+			log.Info("Volume %s still used by %s", req.Name, holder)
+			return &pluginResponse{}, removeAttachment(*statePtr, container, req.Name)
+		}
+	}
+
+	target := p.mountPoint(req.Name)
+	if mounted, err := p.mounter.IsMounted(target); err != nil {
+		return nil, err
+	} else if mounted {
+		if err := p.mounter.Unmount(target); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := detachOne(container, *hostPtr, req.Name); err != nil {
+		return nil, err
+	}
+	return &pluginResponse{}, nil
+}
+
+// path returns the mount point of the volume when it is mounted
+func (p *volumePlugin) path(req *pluginRequest) (*pluginResponse, error) {
+	target := p.mountPoint(req.Name)
+	mounted, err := p.mounter.IsMounted(target)
+	if err != nil || !mounted {
+		return &pluginResponse{}, err
+	}
+	return &pluginResponse{Mountpoint: target}, nil
+}
+
+// get returns the volume
+func (p *volumePlugin) get(req *pluginRequest) (*pluginResponse, error) {
+	vol, err := getVolumeByName(req.Name)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get Volume ID by name(%s): %s", req.Name, err)
+	}
+	pv, err := p.pluginVolume(vol)
+	if err != nil {
+		return nil, err
+	}
+	return &pluginResponse{Volume: pv}, nil
+}
+
+// list returns the volumes of the account
+func (p *volumePlugin) list(req *pluginRequest) (*pluginResponse, error) {
+	vols, err := listVolumes()
+	if err != nil {
+		return nil, err
+	}
+	resp := &pluginResponse{Volumes: []*pluginVolume{}}
+	for i := range vols {
+		pv, err := p.pluginVolume(&vols[i])
+		if err != nil {
+			return nil, err
+		}
+		resp.Volumes = append(resp.Volumes, pv)
+	}
+	return resp, nil
+}
+
+// pluginVolume converts a linode volume to its plugin representation
+func (p *volumePlugin) pluginVolume(vol *Volume) (*pluginVolume, error) {
+	pv := &pluginVolume{
+		Name: vol.Label,
+		Status: map[string]interface{}{
+			"id":        vol.ID,
+			"size":      vol.Size,
+			"region":    vol.Region,
+			"linode_id": vol.LinodeID,
+		},
+	}
+	target := p.mountPoint(vol.Label)
+	if mounted, err := p.mounter.IsMounted(target); err != nil {
+		return nil, err
+	} else if mounted {
+		pv.Mountpoint = target
+	}
+	return pv, nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startPlugin serves the plugin on a unix socket and returns a client of it
+func startPlugin(t *testing.T, m *fakeMounter) (*volumePlugin, *http.Client) {
+	t.Helper()
+	dir := t.TempDir()
+	p := &volumePlugin{
+		mountRoot:   filepath.Join(dir, "mounts"),
+		fsType:      "ext4",
+		defaultSize: 20,
+		deviceWait:  time.Second,
+		mounter:     m,
+	}
+	socket := filepath.Join(dir, "linode.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: p.handler()}
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(func() { _ = srv.Close() })
+	return p, newDockerClient(socket)
+}
+
+// postPlugin posts the request to the endpoint and decodes the response
+func postPlugin(c *http.Client, endpoint string, req *pluginRequest) (*pluginResponse, error) {
+	b, _ := json.Marshal(req)
+	resp, err := c.Post("http://plugin/VolumeDriver."+endpoint, pluginContentType, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if ct := resp.Header.Get("Content-Type"); ct != pluginContentType {
+		return nil, fmt.Errorf("Content-Type = %q", ct)
+	}
+	res := &pluginResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// pluginCall is postPlugin failing the test on transport errors
+func pluginCall(t *testing.T, c *http.Client, endpoint string, req *pluginRequest) *pluginResponse {
+	t.Helper()
+	res, err := postPlugin(c, endpoint, req)
+	if err != nil {
+		t.Fatalf("%s: %s", endpoint, err)
+	}
+	return res
+}
+
+func TestPluginActivate(t *testing.T) {
+	_, m := setupTest(t)
+	_, c := startPlugin(t, m)
+	resp, err := c.Post("http://plugin/Plugin.Activate", pluginContentType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	var res map[string][]string
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if impl := res["Implements"]; len(impl) != 1 || impl[0] != "VolumeDriver" {
+		t.Errorf("Implements = %v", impl)
+	}
+
+	caps := pluginCall(t, c, "Capabilities", &pluginRequest{})
+	if caps.Capabilities["Scope"] != "global" {
+		t.Errorf("Capabilities = %v, want global scope", caps.Capabilities)
+	}
+}
+
+func TestPluginCreateRemove(t *testing.T) {
+	api, m := setupTest(t)
+	_, c := startPlugin(t, m)
+
+	if res := pluginCall(t, c, "Create", &pluginRequest{Name: "data", Opts: map[string]string{"size": "30"}}); res.Err != "" {
+		t.Fatalf("Create: %s", res.Err)
+	}
+	v := api.volumeByLabel("data")
+	if v == nil || v.Size != 30 || v.Region != "us-east" {
+		t.Fatalf("created volume = %+v, want 30GB in us-east", v)
+	}
+	// existing volumes are kept
+	if res := pluginCall(t, c, "Create", &pluginRequest{Name: "data"}); res.Err != "" {
+		t.Fatalf("Create existing: %s", res.Err)
+	}
+	if n := api.called("POST /volumes"); n != 1 {
+		t.Errorf("%d volumes created, want 1", n)
+	}
+	if res := pluginCall(t, c, "Create", &pluginRequest{Name: "other", Opts: map[string]string{"size": "big"}}); res.Err == "" {
+		t.Error("Create with an invalid size succeeded")
+	}
+
+	get := pluginCall(t, c, "Get", &pluginRequest{Name: "data"})
+	if get.Err != "" || get.Volume == nil || get.Volume.Name != "data" || get.Volume.Mountpoint != "" {
+		t.Errorf("Get = %+v %+v", get, get.Volume)
+	}
+	if list := pluginCall(t, c, "List", &pluginRequest{}); len(list.Volumes) != 1 || list.Volumes[0].Name != "data" {
+		t.Errorf("List = %+v", list.Volumes)
+	}
+
+	if res := pluginCall(t, c, "Remove", &pluginRequest{Name: "data"}); res.Err != "" {
+		t.Fatalf("Remove: %s", res.Err)
+	}
+	if api.volumeByLabel("data") != nil {
+		t.Error("Remove left the volume")
+	}
+	if res := pluginCall(t, c, "Get", &pluginRequest{Name: "data"}); res.Err == "" {
+		t.Error("Get of a removed volume succeeded")
+	}
+}
+
+func TestPluginMountUnmount(t *testing.T) {
+	api, m := setupTest(t)
+	p, c := startPlugin(t, m)
+	id := api.addVolume("data", "us-east", 20, 0)
+	target := p.mountPoint("data")
+
+	res := pluginCall(t, c, "Mount", &pluginRequest{Name: "data", ID: "a"})
+	if res.Err != "" || res.Mountpoint != target {
+		t.Fatalf("Mount = %+v, want %s", res, target)
+	}
+	if v := api.volume(id); v.LinodeID != 1 {
+		t.Errorf("volume attached to %d, want web1", v.LinodeID)
+	}
+	if m.mounted(target) != api.volume(id).FilesystemPath {
+		t.Errorf("%s not mounted: %v", target, m.called())
+	}
+	if a := readState(t).attachment("docker:a", "data"); a == nil || a.MountPoint != target {
+		t.Errorf("state attachment = %+v, want mount point %s", a, target)
+	}
+
+	// a second container shares the mount
+	if res := pluginCall(t, c, "Mount", &pluginRequest{Name: "data", ID: "b"}); res.Err != "" || res.Mountpoint != target {
+		t.Fatalf("second Mount = %+v", res)
+	}
+	if n := api.called("POST /volumes/" + strconv.Itoa(id) + "/attach"); n != 1 {
+		t.Errorf("attached %d times, want 1", n)
+	}
+	if path := pluginCall(t, c, "Path", &pluginRequest{Name: "data"}); path.Mountpoint != target {
+		t.Errorf("Path = %q, want %s", path.Mountpoint, target)
+	}
+
+	if res := pluginCall(t, c, "Unmount", &pluginRequest{Name: "data", ID: "a"}); res.Err != "" {
+		t.Fatalf("Unmount a: %s", res.Err)
+	}
+	if m.mounted(target) == "" || api.volume(id).LinodeID != 1 {
+		t.Fatal("volume released while b still uses it")
+	}
+	if res := pluginCall(t, c, "Unmount", &pluginRequest{Name: "data", ID: "b"}); res.Err != "" {
+		t.Fatalf("Unmount b: %s", res.Err)
+	}
+	if m.mounted(target) != "" {
+		t.Error("still mounted after the last Unmount")
+	}
+	if v := api.volume(id); v.LinodeID != 0 {
+		t.Errorf("still attached to %d after the last Unmount", v.LinodeID)
+	}
+	if len(readState(t).Containers) != 0 {
+		t.Errorf("state = %+v, want empty", readState(t).Containers)
+	}
+	if res := pluginCall(t, c, "Remove", &pluginRequest{Name: "data"}); res.Err != "" {
+		t.Errorf("Remove after unmount: %s", res.Err)
+	}
+}
+
+func TestPluginMountFailureDetaches(t *testing.T) {
+	for _, op := range []string{"wait", "mount"} {
+		api, m := setupTest(t)
+		p, c := startPlugin(t, m)
+		id := api.addVolume("data", "us-east", 20, 0)
+		m.failOn(op, fmt.Errorf("%s failed", op))
+
+		res := pluginCall(t, c, "Mount", &pluginRequest{Name: "data", ID: "a"})
+		if res.Err != op+" failed" {
+			t.Errorf("%s: Mount error = %q, want the %s error", op, res.Err, op)
+		}
+		if v := api.volume(id); v.LinodeID != 0 {
+			t.Errorf("%s: volume left attached to %d", op, v.LinodeID)
+		}
+		if m.mounted(p.mountPoint("data")) != "" || len(readState(t).Containers) != 0 {
+			t.Errorf("%s: mount or state left behind: %v %+v", op, m.called(), readState(t).Containers)
+		}
+	}
+}
+
+func TestPluginRemoveAttached(t *testing.T) {
+	api, m := setupTest(t)
+	_, c := startPlugin(t, m)
+	api.addVolume("data", "us-east", 20, 2)
+	if res := pluginCall(t, c, "Remove", &pluginRequest{Name: "data"}); res.Err == "" {
+		t.Error("Remove of an attached volume succeeded")
+	}
+	if api.volumeByLabel("data") == nil {
+		t.Error("attached volume was deleted")
+	}
+}
+
+func TestPluginReadsDoNotWaitForMount(t *testing.T) {
+	api, m := setupTest(t)
+	_, c := startPlugin(t, m)
+	api.addVolume("data", "us-east", 20, 0)
+	api.addVolume("logs", "us-east", 20, 0)
+	m.mountGate = make(chan struct{})
+	m.mounting = make(chan string, 2)
+
+	done := make(chan *pluginResponse, 2)
+	for _, name := range []string{"data", "logs"} {
+		go func(name string) {
+			res, err := postPlugin(c, "Mount", &pluginRequest{Name: name, ID: name})
+			if err != nil {
+				res = &pluginResponse{Err: err.Error()}
+			}
+			done <- res
+		}(name)
+	}
+	// both mounts reach the mounter, volumes are locked separately
+	for i := 0; i < 2; i++ {
+		select {
+		case <-m.mounting:
+		case <-time.After(5 * time.Second):
+			t.Fatal("mounts of different volumes ran one after the other")
+		}
+	}
+
+	reads := make(chan error, 3)
+	go func() {
+		for _, e := range []string{"Get", "Path", "List"} {
+			res, err := postPlugin(c, e, &pluginRequest{Name: "data"})
+			if err == nil && res.Err != "" {
+				err = fmt.Errorf("%s", res.Err)
+			}
+			reads <- err
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-reads:
+			if err != nil {
+				t.Errorf("read during Mount: %s", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("read endpoints wait for the Mount in progress")
+		}
+	}
+
+	close(m.mountGate)
+	for i := 0; i < 2; i++ {
+		if res := <-done; res.Err != "" {
+			t.Errorf("Mount: %s", res.Err)
+		}
+	}
+}
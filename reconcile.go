@@ -0,0 +1,339 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/libgolang/log"
+	"github.com/magiconair/properties"
+)
+
+// The manifest is a properties file giving the desired state of volumes:
+//
+//	volumes.data.linode = web1
+//	volumes.data.size = 40
+//	volumes.data.mount = /srv/data
+//	volumes.data.filesystem = ext4
+//	volumes.data.options = noatime
+//	volumes.archive.size = 100
+//	volumes.archive.region = us-east
+//
+// A volume without linode is kept detached.  Volumes missing from the
+// manifest are left alone
+const (
+	manifestPrefix = "volumes."
+	// manifestContainer state file container of the attachments made by apply
+	manifestContainer = "manifest"
+)
+
+// Plan actions in the order apply runs them
+const (
+	actionCreate = "create"
+	actionResize = "resize"
+	actionDetach = "detach"
+	actionAttach = "attach"
+)
+
+var actionOrder = []string{actionCreate, actionResize, actionDetach, actionAttach}
+
+// manifestVolume desired state of a volume
+type manifestVolume struct {
+	Label      string
+	Linode     string // empty for detached
+	Region     string // for create, defaults to the region of the linode
+	Size       int    // GB, 0 keeps the current size
+	Mount      string
+	Filesystem string
+	Options    string
+}
+
+// PlanAction a step to bring the volumes to the manifest
+type PlanAction struct {
+	Action      string `json:"action"`
+	Volume      string `json:"volume"`
+	VolumeID    int    `json:"volume_id"`
+	Linode      string `json:"linode"`
+	Size        int    `json:"size"`
+	Destructive bool   `json:"destructive"`
+	Reason      string `json:"reason"`
+	Status      string `json:"status"` // done, failed or skipped after apply
+	Error       string `json:"error"`
+	DurationMs  int64  `json:"duration_ms"`
+}
+
+// loadManifest reads and checks the manifest
+func loadManifest(file string) ([]*manifestVolume, error) {
+	p, err := properties.LoadFile(file, properties.UTF8)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read manifest %s: %s", file, err)
+	}
+
+	var problems []string
+	byLabel := make(map[string]*manifestVolume)
+	for _, key := range p.Keys() {
+		if !strings.HasPrefix(key, manifestPrefix) {
+			problems = append(problems, fmt.Sprintf("%s: unknown key", key))
+			continue
+		}
+		parts := strings.Split(strings.TrimPrefix(key, manifestPrefix), ".")
+		if len(parts) != 2 {
+			problems = append(problems, fmt.Sprintf("%s: expected volumes.<label>.<field>", key))
+			continue
+		}
+		v, ok := byLabel[parts[0]]
+		if !ok {
+			v = &manifestVolume{Label: parts[0], Filesystem: "ext4"}
+			byLabel[parts[0]] = v
+		}
+		value := p.GetString(key, "")
+		switch parts[1] {
+		case "linode":
+			v.Linode = value
+		case "region":
+			v.Region = value
+		case "size":
+			if v.Size, err = strconv.Atoi(value); err != nil || v.Size < 0 {
+				problems = append(problems, fmt.Sprintf("%s: invalid size %q", key, value))
+			}
+		case "mount":
+			v.Mount = value
+		case "filesystem":
+			v.Filesystem = value
+		case "options":
+			v.Options = value
+		default:
+			problems = append(problems, fmt.Sprintf("%s: unknown field %s", key, parts[1]))
+		}
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid manifest %s: %s", file, strings.Join(problems, "; "))
+	}
+
+	manifest := make([]*manifestVolume, 0, len(byLabel))
+	for _, v := range byLabel {
+		manifest = append(manifest, v)
+	}
+	sort.Slice(manifest, func(i, j int) bool { return manifest[i].Label < manifest[j].Label })
+	return manifest, nil
+}
+
+// planManifest diffs the manifest against the volumes and linodes of the
+// account.  The actions are in the order apply runs them: create, resize,
+// detach, attach
+func planManifest(manifest []*manifestVolume, vols []Volume, nodes []Node) ([]*PlanAction, error) {
+	volumeByLabel := make(map[string]Volume, len(vols))
+	for _, v := range vols {
+		volumeByLabel[v.Label] = v
+	}
+	nodeByLabel := make(map[string]Node, len(nodes))
+	nodeLabels := make(map[int]string, len(nodes))
+	for _, n := range nodes {
+		nodeByLabel[n.Label] = n
+		nodeLabels[n.ID] = n.Label
+	}
+
+	var problems []string
+	var actions []*PlanAction
+	for _, mv := range manifest {
+		node, hasNode := nodeByLabel[mv.Linode]
+		if mv.Linode != "" && !hasNode {
+			problems = append(problems, fmt.Sprintf("%s: linode %s not found", mv.Label, mv.Linode))
+			continue
+		}
+
+		v, exists := volumeByLabel[mv.Label]
+		if !exists {
+			region := mv.Region
+			if region == "" {
+				region = node.Region
+			}
+			if region == "" {
+				problems = append(problems, fmt.Sprintf("%s: region or linode is required to create it", mv.Label))
+				continue
+			}
+			size := mv.Size
+			if size == 0 {
+				size = 20
+			}
+			actions = append(actions, &PlanAction{Action: actionCreate, Volume: mv.Label, Size: size, Reason: "missing in " + region})
+			if mv.Linode != "" {
+				actions = append(actions, &PlanAction{Action: actionAttach, Volume: mv.Label, Linode: mv.Linode, Reason: "new volume"})
+			}
+			continue
+		}
+
+		if hasNode && node.Region != v.Region {
+			problems = append(problems, fmt.Sprintf("%s: volume is in %s, linode %s in %s", mv.Label, v.Region, mv.Linode, node.Region))
+			continue
+		}
+		if mv.Size > v.Size {
+			actions = append(actions, &PlanAction{Action: actionResize, Volume: mv.Label, VolumeID: v.ID, Size: mv.Size, Reason: fmt.Sprintf("size is %dGB", v.Size)})
+		} else if mv.Size != 0 && mv.Size < v.Size {
+			problems = append(problems, fmt.Sprintf("%s: volumes cannot shrink from %dGB to %dGB", mv.Label, v.Size, mv.Size))
+			continue
+		}
+
+		current := nodeLabels[v.LinodeID]
+		if v.LinodeID != 0 && current == "" {
+			current = strconv.Itoa(v.LinodeID)
+		}
+		if current == mv.Linode {
+			continue
+		}
+		if current != "" {
+			actions = append(actions, &PlanAction{Action: actionDetach, Volume: mv.Label, VolumeID: v.ID, Linode: current, Destructive: true, Reason: "attached to " + current})
+		}
+		if mv.Linode != "" {
+			reason := "detached"
+			if current != "" {
+				reason = "attached to " + current
+			}
+			actions = append(actions, &PlanAction{Action: actionAttach, Volume: mv.Label, VolumeID: v.ID, Linode: mv.Linode, Reason: reason})
+		}
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("manifest cannot be applied: %s", strings.Join(problems, "; "))
+	}
+
+	ordered := make([]*PlanAction, 0, len(actions))
+	for _, kind := range actionOrder {
+		for _, a := range actions {
+			if a.Action == kind {
+				ordered = append(ordered, a)
+			}
+		}
+	}
+	return ordered, nil
+}
+
+// manifestPlan loads the manifest and plans it against the account
+func manifestPlan(file string) ([]*manifestVolume, []*PlanAction, error) {
+	manifest, err := loadManifest(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	vols, err := listVolumes()
+	if err != nil {
+		return nil, nil, err
+	}
+	nodes, err := listLinodes()
+	if err != nil {
+		return nil, nil, err
+	}
+	actions, err := planManifest(manifest, vols, nodes)
+	return manifest, actions, err
+}
+
+// manifestFlag adds the --manifest flag of plan and apply
+func manifestFlag(fs *flag.FlagSet) *string {
+	return fs.String("manifest", "", "Path to the manifest properties file")
+}
+
+// runPlan plan command
+func runPlan(c *command, args []string) (interface{}, error) {
+	fs := c.flagSet()
+	file := manifestFlag(fs)
+	if err := c.parse(fs, args); err != nil {
+		return nil, err
+	}
+	if *file == "" {
+		return nil, usageError{"--manifest is required"}
+	}
+	_, actions, err := manifestPlan(*file)
+	if err != nil {
+		return nil, err
+	}
+	if len(actions) == 0 {
+		fmt.Fprintln(os.Stderr, "Volumes match the manifest")
+	}
+	return actions, nil
+}
+
+// runApply apply command
+func runApply(c *command, args []string) (interface{}, error) {
+	fs := c.flagSet()
+	file := manifestFlag(fs)
+	yes := fs.Bool("yes", false, "Run destructive steps, detaching volumes from linodes")
+	if err := c.parse(fs, args); err != nil {
+		return nil, err
+	}
+	if *file == "" {
+		return nil, usageError{"--manifest is required"}
+	}
+	manifest, actions, err := manifestPlan(*file)
+	if err != nil {
+		return nil, err
+	}
+
+	destructive := 0
+	for _, a := range actions {
+		if a.Destructive {
+			destructive++
+		}
+	}
+	if destructive > 0 && !*yes {
+		return actions, fmt.Errorf("plan has %d destructive steps, nothing done. Rerun with --yes to apply it", destructive)
+	}
+
+	byLabel := make(map[string]*manifestVolume, len(manifest))
+	for _, mv := range manifest {
+		byLabel[mv.Label] = mv
+	}
+	for i, a := range actions {
+		start := time.Now()
+		err := applyAction(a, byLabel[a.Volume])
+		a.DurationMs = msSince(start)
+		if err != nil {
+			a.Status = "failed"
+			a.Error = err.Error()
+			for _, rest := range actions[i+1:] {
+				rest.Status = "skipped"
+			}
+			return actions, fmt.Errorf("%s of %s failed: %s", a.Action, a.Volume, err)
+		}
+		a.Status = "done"
+	}
+	return actions, nil
+}
+
+// applyAction runs a step of the plan.  Attach and detach go through
+// attachOne and detachOne to mount and unmount
+func applyAction(a *PlanAction, mv *manifestVolume) error {
+	log.Info("Applying %s of %s %s", a.Action, a.Volume, a.Reason)
+	switch a.Action {
+	case actionCreate:
+		region := mv.Region
+		if region == "" {
+			node, err := getLinodeByName(mv.Linode)
+			if err != nil {
+				return fmt.Errorf("Unable to get Linode by name(%s): %s", mv.Linode, err)
+			}
+			region = node.Region
+		}
+		vol, err := createVolume(CreateVolumeRequest{Label: a.Volume, Region: region, Size: a.Size})
+		if err == nil {
+			a.VolumeID = vol.ID
+		}
+		return err
+	case actionResize:
+		return resizeVolume(a.VolumeID, a.Size)
+	case actionDetach:
+		// detachOne prefers the mount point recorded in the state file
+		mappedVolumes[a.Volume] = &volumeSpec{Label: a.Volume, Mount: mv.Mount}
+		_, err := detachOne(manifestContainer, a.Linode, a.Volume)
+		return err
+	case actionAttach:
+		mappedVolumes[a.Volume] = &volumeSpec{Label: a.Volume, Mount: mv.Mount, Filesystem: mv.Filesystem, Options: mv.Options, Format: true}
+		res, err := attachOne(manifestContainer, a.Linode, a.Volume)
+		if res != nil {
+			a.VolumeID = res.VolumeID
+		}
+		return err
+	}
+	return fmt.Errorf("unknown action %s", a.Action)
+}
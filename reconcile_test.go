@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testNodes = []Node{{ID: 1, Label: "web1", Region: "us-east"}, {ID: 2, Label: "db1", Region: "us-east"}, {ID: 3, Label: "web2", Region: "eu-west"}}
+
+// planString returns the plan as "action volume linode size" lines
+func planString(plan []*PlanAction) string {
+	var lines []string
+	for _, a := range plan {
+		line := a.Action + " " + a.Volume
+		if a.Linode != "" {
+			line += " " + a.Linode
+		}
+		if a.Action == actionCreate || a.Action == actionResize {
+			line += fmt.Sprintf(" %dGB", a.Size)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestPlanManifest(t *testing.T) {
+	vols := []Volume{
+		{ID: 10, Label: "data", Region: "us-east", Size: 20, LinodeID: 1},
+		{ID: 11, Label: "logs", Region: "us-east", Size: 20, LinodeID: 2},
+		{ID: 12, Label: "cache", Region: "us-east", Size: 20},
+		{ID: 13, Label: "old", Region: "us-east", Size: 20, LinodeID: 1},
+		{ID: 14, Label: "unlisted", Region: "us-east", Size: 20, LinodeID: 1},
+	}
+	manifest := []*manifestVolume{
+		{Label: "data", Linode: "web1", Size: 40}, // resize in place
+		{Label: "logs", Linode: "web1"},           // move from db1
+		{Label: "cache", Linode: "db1"},           // attach
+		{Label: "old"},                            // detach
+		{Label: "new", Linode: "web2", Size: 50},  // create in the region of web2
+		{Label: "archive", Region: "us-east"},     // create detached
+	}
+
+	plan, err := planManifest(manifest, vols, testNodes)
+	if err != nil {
+		t.Fatalf("planManifest: %s", err)
+	}
+	want := strings.Join([]string{
+		"create new 50GB",
+		"create archive 20GB",
+		"resize data 40GB",
+		"detach logs db1",
+		"detach old web1",
+		"attach logs web1",
+		"attach cache db1",
+		"attach new web2",
+	}, "\n")
+	if got := planString(plan); got != want {
+		t.Errorf("plan =\n%s\nwant\n%s", got, want)
+	}
+	for _, a := range plan {
+		if a.Destructive != (a.Action == actionDetach) {
+			t.Errorf("%s %s destructive = %v", a.Action, a.Volume, a.Destructive)
+		}
+	}
+}
+
+func TestPlanManifestInSync(t *testing.T) {
+	vols := []Volume{{ID: 10, Label: "data", Region: "us-east", Size: 40, LinodeID: 1}, {ID: 11, Label: "spare", Region: "us-east", Size: 20}}
+	manifest := []*manifestVolume{{Label: "data", Linode: "web1", Size: 40}, {Label: "spare"}}
+	plan, err := planManifest(manifest, vols, testNodes)
+	if err != nil || len(plan) != 0 {
+		t.Errorf("plan = %s, %v, want nothing to do", planString(plan), err)
+	}
+}
+
+func TestPlanManifestUnknownLinode(t *testing.T) {
+	vols := []Volume{{ID: 10, Label: "data", Region: "us-east", Size: 20, LinodeID: 99}}
+	plan, err := planManifest([]*manifestVolume{{Label: "data"}}, vols, testNodes)
+	if err != nil {
+		t.Fatalf("planManifest: %s", err)
+	}
+	// attached to a linode outside the account, named by its id
+	if got := planString(plan); got != "detach data 99" {
+		t.Errorf("plan = %s", got)
+	}
+}
+
+func TestPlanManifestProblems(t *testing.T) {
+	vols := []Volume{
+		{ID: 10, Label: "data", Region: "us-east", Size: 40},
+		{ID: 11, Label: "logs", Region: "us-east", Size: 20},
+	}
+	manifest := []*manifestVolume{
+		{Label: "data", Size: 20},       // shrink
+		{Label: "logs", Linode: "web2"}, // other region
+		{Label: "new", Linode: "gone"},  // missing linode
+		{Label: "orphan"},               // no region to create it in
+	}
+	_, err := planManifest(manifest, vols, testNodes)
+	if err == nil {
+		t.Fatal("planManifest succeeded")
+	}
+	for _, problem := range []string{
+		"data: volumes cannot shrink from 40GB to 20GB",
+		"logs: volume is in us-east, linode web2 in eu-west",
+		"new: linode gone not found",
+		"orphan: region or linode is required",
+	} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("error %q does not report %q", err, problem)
+		}
+	}
+}
+
+func TestLoadManifest(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "manifest.properties")
+	data := "volumes.data.linode = web1\nvolumes.data.size = 40\nvolumes.data.mount = /srv/data\nvolumes.archive.region = us-east\n"
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := loadManifest(file)
+	if err != nil {
+		t.Fatalf("loadManifest: %s", err)
+	}
+	if len(manifest) != 2 || manifest[0].Label != "archive" || manifest[1].Label != "data" {
+		t.Fatalf("manifest = %+v, want archive and data", manifest)
+	}
+	if d := manifest[1]; d.Linode != "web1" || d.Size != 40 || d.Mount != "/srv/data" || d.Filesystem != "ext4" {
+		t.Errorf("data = %+v", d)
+	}
+
+	bad := "volumes.data.size = -1\nvolumes.data.colour = red\nvolumes.data = x\nother = 1\n"
+	if err := ioutil.WriteFile(file, []byte(bad), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadManifest(file)
+	if err == nil {
+		t.Fatal("loadManifest of an invalid manifest succeeded")
+	}
+	for _, problem := range []string{"invalid size", "unknown field colour", "expected volumes.<label>.<field>", "other: unknown key"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("error %q does not report %q", err, problem)
+		}
+	}
+}
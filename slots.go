@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Disk linode disk
+type Disk struct {
+	ID    int    `json:"id"`
+	Label string `json:"label"`
+}
+
+// ListDiskResponse list disk response
+type ListDiskResponse struct {
+	Data    []Disk `json:"data"`
+	Page    int    `json:"page"`
+	Pages   int    `json:"pages"`
+	Results int    `json:"results"`
+}
+
+// listDisks returns the disks of the linode
+func listDisks(linodeID int) ([]Disk, error) {
+	var disks []Disk
+	pages := 1
+	for page := 1; page <= pages; page++ {
+		url := fmt.Sprintf("%s/linode/instances/%d/disks?page=%d", *apiURLPtr, linodeID, page)
+		it, err := Get(url, &ListDiskResponse{})
+		if err != nil {
+			return nil, err
+		}
+		resp, ok := it.(*ListDiskResponse)
+		if !ok {
+			return nil, fmt.Errorf("Error casting to ListDiskResponse")
+		}
+		pages = resp.Pages
+		disks = append(disks, resp.Data...)
+	}
+	return disks, nil
+}
+
+// listLinodeVolumes returns the volumes attached to the linode
+func listLinodeVolumes(linodeID int) ([]Volume, error) {
+	var vols []Volume
+	pages := 1
+	for page := 1; page <= pages; page++ {
+		url := fmt.Sprintf("%s/linode/instances/%d/volumes?page=%d", *apiURLPtr, linodeID, page)
+		it, err := Get(url, &ListVolumeResponse{})
+		if err != nil {
+			return nil, err
+		}
+		resp, ok := it.(*ListVolumeResponse)
+		if !ok {
+			return nil, fmt.Errorf("Error casting to ListVolumeReponse")
+		}
+		pages = resp.Pages
+		vols = append(vols, resp.Data...)
+	}
+	return vols, nil
+}
+
+// checkSlots fails when the sdc..sdh slots of the config profile volumes
+// are attached with have no room for the volumes not attached to the linode
+// yet.  The limit is the one the CSI driver reports as MaxVolumesPerNode.
+// Runs before anything is detached so an impossible attach leaves the
+// volumes where they are
+func checkSlots(linodeID int, linodeName string, labels []string) error {
+	cfg, err := resolveConfig(linodeID, *configProfilePtr)
+	if err != nil {
+		return err
+	}
+	attached, err := listLinodeVolumes(linodeID)
+	if err != nil {
+		return fmt.Errorf("Unable to list volumes of linode %s: %s", linodeName, err)
+	}
+
+	var occupants []string
+	var diskNames map[int]string
+	isAttached := make(map[string]bool, len(attached))
+	var slotVolumes []int
+	if cfg != nil {
+		for _, slot := range configDeviceSlots {
+			d := cfg.Devices[slot]
+			switch {
+			case d == nil:
+			case d.DiskID != nil:
+				if diskNames == nil {
+					if diskNames, err = linodeDiskNames(linodeID); err != nil {
+						return fmt.Errorf("Unable to list disks of linode %s: %s", linodeName, err)
+					}
+				}
+				occupants = append(occupants, "disk "+diskNames[*d.DiskID])
+			case d.VolumeID != nil:
+				slotVolumes = append(slotVolumes, *d.VolumeID)
+			}
+		}
+	}
+	// attached volumes hold a device whether or not the profile lists them
+	attachedIDs := make(map[int]bool, len(attached))
+	for _, v := range attached {
+		occupants = append(occupants, "volume "+v.Label)
+		isAttached[v.Label] = true
+		attachedIDs[v.ID] = true
+	}
+	for _, id := range slotVolumes {
+		if !attachedIDs[id] {
+			occupants = append(occupants, fmt.Sprintf("volume %d", id))
+		}
+	}
+	var wanted []string
+	for _, l := range labels {
+		if !isAttached[l] {
+			isAttached[l] = true
+			wanted = append(wanted, l)
+		}
+	}
+
+	limit := len(configDeviceSlots)
+	if len(occupants)+len(wanted) > limit {
+		return fmt.Errorf("linode %s has %d of %d volume device slots taken by %s: no room for %s",
+			linodeName, len(occupants), limit, strings.Join(occupants, ", "), strings.Join(wanted, ", "))
+	}
+	return nil
+}
+
+// linodeDiskNames returns the labels of the disks of the linode by id
+func linodeDiskNames(linodeID int) (map[int]string, error) {
+	disks, err := listDisks(linodeID)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[int]string, len(disks))
+	for _, d := range disks {
+		names[d.ID] = d.Label
+		if d.Label == "" {
+			names[d.ID] = fmt.Sprintf("%d", d.ID)
+		}
+	}
+	return names, nil
+}
+
+// preflightAttach checks the linode has room for all the volumes before
+// attaching the first one
+func preflightAttach(linodeName string, labels []string) error {
+	linodeID, err := getLinodeIDByName(linodeName)
+	if err != nil {
+		return fmt.Errorf("Unable to get Linode ID by name(%s): %s", linodeName, err)
+	}
+	return checkSlots(linodeID, linodeName, labels)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCheckSlots(t *testing.T) {
+	api, _ := setupTest(t)
+	for i := 0; i < len(configDeviceSlots)-1; i++ {
+		api.addVolume(fmt.Sprintf("web-%d", i), "us-east", 20, 1)
+	}
+
+	// the boot and swap disks sit in sda and sdb, outside the volume slots
+	if err := checkSlots(1, "web1", []string{"data", "web-0"}); err != nil {
+		t.Errorf("checkSlots with one free slot = %v", err)
+	}
+	err := checkSlots(1, "web1", []string{"data", "logs"})
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("5 of %d", len(configDeviceSlots))) || !strings.HasSuffix(err.Error(), "no room for data, logs") {
+		t.Errorf("checkSlots of two volumes = %v", err)
+	}
+
+	// a disk in a volume slot of the profile takes the last one
+	boot := 10
+	api.mu.Lock()
+	api.configs[1][0].Devices["sdh"] = &ConfigDevice{DiskID: &boot}
+	api.mu.Unlock()
+	if err := checkSlots(1, "web1", []string{"data"}); err == nil || !strings.Contains(err.Error(), "disk boot") {
+		t.Errorf("checkSlots with a disk in sdh = %v, want it counted", err)
+	}
+}
+
+func TestCheckSlotsConfigProfile(t *testing.T) {
+	api, _ := setupTest(t)
+	rescue := api.addConfig(1, "rescue")
+	api.boot(1, rescue)
+	disk := 10
+	api.mu.Lock()
+	for _, slot := range configDeviceSlots {
+		api.configs[1][0].Devices[slot] = &ConfigDevice{DiskID: &disk}
+	}
+	api.mu.Unlock()
+
+	// only the slots of the profile the volume is attached with count
+	if err := checkSlots(1, "web1", []string{"data"}); err != nil {
+		t.Errorf("checkSlots against the booted profile = %v", err)
+	}
+	*configProfilePtr = "default"
+	defer func() { *configProfilePtr = "" }()
+	if err := checkSlots(1, "web1", []string{"data"}); err == nil {
+		t.Error("checkSlots against the full default profile succeeded")
+	}
+}
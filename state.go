@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// State contents of the per-host state file.  Containers are keyed by the
+// container name given in --name
+type State struct {
+	Containers map[string]*ContainerState `json:"containers"`
+}
+
+// ContainerState attachments managed for a single container
+type ContainerState struct {
+	Host        string             `json:"host"`
+	Attachments []*AttachmentState `json:"attachments"`
+	Updated     time.Time          `json:"updated"`
+}
+
+// AttachmentState a volume attached by one-linode
+type AttachmentState struct {
+	VolumeID         int    `json:"volume_id"`
+	Label            string `json:"label"`
+	FilesystemPath   string `json:"filesystem_path"`
+	LinodeID         int    `json:"linode_id"`
+	MountPoint       string `json:"mount_point,omitempty"`
+	PreviousLinodeID int    `json:"previous_linode_id,omitempty"` // linode holding the volume before the attach, 0 if none
+}
+
+// loadState reads the state file.  A missing file is an empty state
+func loadState(path string) (*State, error) {
+	st := &State{Containers: make(map[string]*ContainerState)}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return st, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, st); err != nil {
+		return nil, err
+	}
+	if st.Containers == nil {
+		st.Containers = make(map[string]*ContainerState)
+	}
+	return st, nil
+}
+
+// saveState writes the state file atomically: the content goes to a
+// temporary file in the same directory which is then renamed over path
+func saveState(path string, st *State) error {
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }() // no-op after a successful rename
+
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// updateState applies fn to the state file under the state lock
+func updateState(path string, fn func(st *State) error) error {
+	lock, err := lockState()
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	st, err := loadState(path)
+	if err != nil {
+		return err
+	}
+	if err := fn(st); err != nil {
+		return err
+	}
+	if *dryRunPtr {
+		dryRun("update state file %s", path)
+		return nil
+	}
+	return saveState(path, st)
+}
+
+// recordAttachment adds or replaces the attachment of the container in the state file
+func recordAttachment(path, containerName, host string, att *AttachmentState) error {
+	return updateState(path, func(st *State) error {
+		cs, ok := st.Containers[containerName]
+		if !ok {
+			cs = &ContainerState{}
+			st.Containers[containerName] = cs
+		}
+		cs.Host = host
+		cs.Updated = time.Now().UTC()
+
+		replaced := false
+		for i, a := range cs.Attachments {
+			if a.VolumeID == att.VolumeID {
+				cs.Attachments[i] = att
+				replaced = true
+			}
+		}
+		if !replaced {
+			cs.Attachments = append(cs.Attachments, att)
+		}
+		return nil
+	})
+}
+
+// removeAttachment drops the attachment of the volume from the container in
+// the state file.  Containers left without attachments are removed
+func removeAttachment(path, containerName, label string) error {
+	return updateState(path, func(st *State) error {
+		cs, ok := st.Containers[containerName]
+		if !ok {
+			return nil
+		}
+
+		kept := cs.Attachments[:0]
+		for _, a := range cs.Attachments {
+			if a.Label != label {
+				kept = append(kept, a)
+			}
+		}
+		cs.Attachments = kept
+		cs.Updated = time.Now().UTC()
+		if len(cs.Attachments) == 0 {
+			delete(st.Containers, containerName)
+		}
+		return nil
+	})
+}
+
+// setMountPoint records where the volume of the container is mounted
+func setMountPoint(path, containerName, label, mountPoint string) error {
+	return updateState(path, func(st *State) error {
+		if a := st.attachment(containerName, label); a != nil {
+			a.MountPoint = mountPoint
+		}
+		return nil
+	})
+}
+
+// attachment returns the attachment of the volume to the container or nil
+func (st *State) attachment(containerName, label string) *AttachmentState {
+	cs, ok := st.Containers[containerName]
+	if !ok {
+		return nil
+	}
+	for _, a := range cs.Attachments {
+		if a.Label == label {
+			return a
+		}
+	}
+	return nil
+}
+
+// holders returns the containers the volume is recorded for
+func (st *State) holders(label string) []string {
+	var names []string
+	for name := range st.Containers {
+		if st.attachment(name, label) != nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// mountPoint returns where one-linode mounted the volume on host, or empty
+func (st *State) mountPoint(label, host string) string {
+	for _, cs := range st.Containers {
+		if cs.Host != host {
+			continue
+		}
+		for _, a := range cs.Attachments {
+			if a.Label == label && a.MountPoint != "" {
+				return a.MountPoint
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSaveStateRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sub", "state.json")
+	st := &State{Containers: map[string]*ContainerState{
+		"web": {
+			Host:    "web1",
+			Updated: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+			Attachments: []*AttachmentState{
+				{VolumeID: 1, Label: "data", FilesystemPath: "/dev/sdc", LinodeID: 7, MountPoint: "/srv", PreviousLinodeID: 3},
+			},
+		},
+	}}
+	if err := saveState(path, st); err != nil {
+		t.Fatalf("saveState: %s", err)
+	}
+
+	got, err := loadState(path)
+	if err != nil {
+		t.Fatalf("loadState: %s", err)
+	}
+	if !reflect.DeepEqual(got, st) {
+		t.Errorf("loadState = %+v, want %+v", got.Containers["web"], st.Containers["web"])
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0644 {
+		t.Errorf("mode = %s, want 0644", fi.Mode().Perm())
+	}
+}
+
+func TestSaveStateLeavesNoTemporaryFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	for i := 0; i < 3; i++ {
+		if err := saveState(path, &State{Containers: map[string]*ContainerState{}}); err != nil {
+			t.Fatalf("saveState: %s", err)
+		}
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "state.json" {
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		t.Errorf("files = %v, want only state.json", names)
+	}
+}
+
+func TestSaveStateKeepsOldFileOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	if err := ioutil.WriteFile(path, []byte(`{"containers":{"web":{"host":"web1"}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if os.Geteuid() == 0 {
+		t.Skip("root writes to read-only directories")
+	}
+	if err := os.Chmod(dir, 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Chmod(dir, 0755) }()
+
+	if err := saveState(path, &State{Containers: map[string]*ContainerState{}}); err == nil {
+		t.Fatal("saveState in a read-only directory succeeded")
+	}
+	st, err := loadState(path)
+	if err != nil {
+		t.Fatalf("loadState: %s", err)
+	}
+	if _, ok := st.Containers["web"]; !ok {
+		t.Errorf("state file was changed: %+v", st.Containers)
+	}
+}
+
+func TestLoadStateMissingFile(t *testing.T) {
+	st, err := loadState(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil {
+		t.Fatalf("loadState: %s", err)
+	}
+	if st.Containers == nil || len(st.Containers) != 0 {
+		t.Errorf("Containers = %v, want empty map", st.Containers)
+	}
+}
+
+func TestRecordAndRemoveAttachment(t *testing.T) {
+	setupTest(t)
+	att := &AttachmentState{VolumeID: 1, Label: "data", LinodeID: 1}
+	if err := recordAttachment(*statePtr, "web", "web1", att); err != nil {
+		t.Fatal(err)
+	}
+	// recording again replaces instead of duplicating
+	if err := recordAttachment(*statePtr, "web", "web1", &AttachmentState{VolumeID: 1, Label: "data", LinodeID: 1, MountPoint: "/srv"}); err != nil {
+		t.Fatal(err)
+	}
+	st := readState(t)
+	if n := len(st.Containers["web"].Attachments); n != 1 {
+		t.Fatalf("%d attachments, want 1", n)
+	}
+	if mp := st.attachment("web", "data").MountPoint; mp != "/srv" {
+		t.Errorf("MountPoint = %q, want /srv", mp)
+	}
+
+	if err := removeAttachment(*statePtr, "web", "data"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := readState(t).Containers["web"]; ok {
+		t.Error("container without attachments was kept")
+	}
+}
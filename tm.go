@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/libgolang/log"
+)
+
+// The OpenNebula transfer manager driver.  Each action script of the driver
+// in /var/lib/one/remotes/tm/linode is a wrapper running
+//
+//	one-linode tm <action> "$@"
+//
+// Images are linode volumes whose SOURCE is the volume label.  Disks of a VM
+// are attached to its host and exposed as a symlink to the volume device at
+// the disk path of the system datastore.  The disks of VM N are recorded in
+// the state file as container one-N, with the disk path as the mount point
+const (
+	// tmDeviceWait time to wait for the device of an attached volume
+	tmDeviceWait = 2 * time.Minute
+)
+
+// tmAction a transfer manager action, args are the arguments OpenNebula passes to the script
+type tmAction func(args []string) error
+
+var tmActions = map[string]tmAction{
+	"clone":       tmClone,
+	"ln":          tmLn,
+	"mv":          tmMv,
+	"mvds":        tmMvds,
+	"delete":      tmDelete,
+	"mkimage":     tmMkimage,
+	"premigrate":  tmPremigrate,
+	"postmigrate": tmPostmigrate,
+	"monitor":     tmMonitor,
+}
+
+// runTM tm command
+func runTM(c *command, args []string) (interface{}, error) {
+	fs := c.flagSet()
+	if err := c.parse(fs, args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() == 0 {
+		return nil, usageError{"no action given"}
+	}
+	action, ok := tmActions[fs.Arg(0)]
+	if !ok {
+		return nil, usageError{fmt.Sprintf("unknown action %q", fs.Arg(0))}
+	}
+	log.Info("tm %s %s", fs.Arg(0), strings.Join(fs.Args()[1:], " "))
+	// the driver reports through the exit code and stderr only
+	return nil, action(fs.Args()[1:])
+}
+
+// tmArgs checks the number of arguments of an action
+func tmArgs(args []string, n int, synopsis string) error {
+	if len(args) < n {
+		return usageError{fmt.Sprintf("expected arguments %s", synopsis)}
+	}
+	return nil
+}
+
+// splitHostPath splits the host:path arguments of OpenNebula
+func splitHostPath(arg string) (host, p string) {
+	i := strings.Index(arg, ":")
+	if i < 0 {
+		return "", arg
+	}
+	return arg[:i], arg[i+1:]
+}
+
+// tmContainer state file container of the disks of a VM
+func tmContainer(vmID string) string {
+	return "one-" + vmID
+}
+
+// tmDiskLabel label of the volume holding a non persistent disk, e.g: one-42-0
+func tmDiskLabel(vmID, diskPath string) (string, error) {
+	base := path.Base(diskPath)
+	if !strings.HasPrefix(base, "disk.") {
+		return "", fmt.Errorf("%s is not a disk path", diskPath)
+	}
+	return fmt.Sprintf("one-%s-%s", vmID, strings.TrimPrefix(base, "disk.")), nil
+}
+
+// tmDSTag tag of the volumes belonging to a datastore
+func tmDSTag(dsID string) string {
+	return "one-ds-" + dsID
+}
+
+// tmAttach attaches the volume to host, waits for its device and links it
+// at diskPath.  The disk is recorded in the state file
+func tmAttach(vmID, host, label, diskPath string) error {
+	lock, err := lockVolume(label)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	att, err := attachLinode(host, label, false)
+	if err != nil {
+		return err
+	}
+	m := mounterFor(host)
+	if err := m.WaitForDevice(att.FilesystemPath, tmDeviceWait); err != nil {
+		return err
+	}
+	if err := m.Link(att.FilesystemPath, diskPath); err != nil {
+		return err
+	}
+	att.MountPoint = diskPath
+	return recordAttachment(*statePtr, tmContainer(vmID), host, att)
+}
+
+// tmDetach removes the link of the disk and detaches its volume from host
+func tmDetach(vmID, host, label, diskPath string) error {
+	lock, err := lockVolume(label)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	if err := mounterFor(host).Unlink(diskPath); err != nil {
+		return err
+	}
+	if _, err := detachLinode(host, label); err != nil {
+		return err
+	}
+	return removeAttachment(*statePtr, tmContainer(vmID), label)
+}
+
+// tmDisks returns the disks of the VM recorded in the state file whose path
+// is diskPath, or all of them when diskPath is the VM directory
+func tmDisks(vmID, diskPath string) ([]*AttachmentState, error) {
+	st, err := loadState(*statePtr)
+	if err != nil {
+		return nil, err
+	}
+	cs, ok := st.Containers[tmContainer(vmID)]
+	if !ok {
+		return nil, nil
+	}
+	var disks []*AttachmentState
+	for _, a := range cs.Attachments {
+		if a.MountPoint == diskPath || path.Dir(a.MountPoint) == path.Clean(diskPath) {
+			disks = append(disks, a)
+		}
+	}
+	return disks, nil
+}
+
+// tmClone clone fe:SOURCE host:remote_system_ds/disk.i vm_id ds_id
+// Clones the image volume into a volume for the disk
+func tmClone(args []string) error {
+	if err := tmArgs(args, 4, "SRC DST VM_ID DS_ID"); err != nil {
+		return err
+	}
+	_, src := splitHostPath(args[0])
+	host, diskPath := splitHostPath(args[1])
+	vmID, dsID := args[2], args[3]
+
+	image, err := getVolumeByName(path.Base(src))
+	if err != nil {
+		return fmt.Errorf("Unable to get Volume ID by name(%s): %s", path.Base(src), err)
+	}
+	label, err := tmDiskLabel(vmID, diskPath)
+	if err != nil {
+		return err
+	}
+	vol, err := cloneVolume(image.ID, label)
+	if err != nil {
+		return err
+	}
+	if err := updateVolumeTags(vol.ID, []string{tmDSTag(dsID)}); err != nil {
+		return err
+	}
+	return tmAttach(vmID, host, label, diskPath)
+}
+
+// tmLn ln fe:SOURCE host:remote_system_ds/disk.i vm_id ds_id
+// Attaches the persistent image volume itself
+func tmLn(args []string) error {
+	if err := tmArgs(args, 4, "SRC DST VM_ID DS_ID"); err != nil {
+		return err
+	}
+	_, src := splitHostPath(args[0])
+	host, diskPath := splitHostPath(args[1])
+	return tmAttach(args[2], host, path.Base(src), diskPath)
+}
+
+// tmMv mv host:remote_system_ds/disk.i|host:remote_system_ds host:remote_system_ds/disk.i|host:remote_system_ds vm_id ds_id
+// Moves the disks between hosts
+func tmMv(args []string) error {
+	if err := tmArgs(args, 4, "SRC DST VM_ID DS_ID"); err != nil {
+		return err
+	}
+	srcHost, srcPath := splitHostPath(args[0])
+	dstHost, dstPath := splitHostPath(args[1])
+	vmID := args[2]
+	if srcHost == dstHost && srcPath == dstPath {
+		return nil
+	}
+	return tmMove(vmID, srcHost, srcPath, dstHost, dstPath)
+}
+
+// tmMove moves the disks of the VM at srcPath on srcHost to dstPath on
+// dstHost.  The source links are only removed once the disk is linked on the
+// destination, so a failed move leaves them in place
+func tmMove(vmID, srcHost, srcPath, dstHost, dstPath string) error {
+	disks, err := tmDisks(vmID, srcPath)
+	if err != nil {
+		return err
+	}
+	for _, d := range disks {
+		target := dstPath
+		if d.MountPoint != srcPath {
+			target = path.Join(dstPath, path.Base(d.MountPoint))
+		}
+		if err := tmAttach(vmID, dstHost, d.Label, target); err != nil {
+			return err
+		}
+		if srcHost == dstHost && d.MountPoint == target {
+			continue
+		}
+		if err := mounterFor(srcHost).Unlink(d.MountPoint); err != nil {
+			log.Warn("Unable to remove link %s:%s of moved volume %s: %s", srcHost, d.MountPoint, d.Label, err)
+		}
+	}
+	return nil
+}
+
+// tmMvds mvds host:remote_system_ds/disk.i fe:SOURCE vm_id ds_id
+// The persistent image is the volume, it only needs to be detached
+func tmMvds(args []string) error {
+	if err := tmArgs(args, 4, "SRC DST VM_ID DS_ID"); err != nil {
+		return err
+	}
+	host, diskPath := splitHostPath(args[0])
+	_, src := splitHostPath(args[1])
+	return tmDetach(args[2], host, path.Base(src), diskPath)
+}
+
+// tmDelete delete host:remote_system_ds/disk.i|host:remote_system_ds vm_id ds_id
+// Detaches the disks, deleting the volumes cloned for the VM
+func tmDelete(args []string) error {
+	if err := tmArgs(args, 3, "DST VM_ID DS_ID"); err != nil {
+		return err
+	}
+	host, diskPath := splitHostPath(args[0])
+	vmID := args[1]
+
+	disks, err := tmDisks(vmID, diskPath)
+	if err != nil {
+		return err
+	}
+	for _, d := range disks {
+		if err := tmDetach(vmID, host, d.Label, d.MountPoint); err != nil {
+			return err
+		}
+		if !strings.HasPrefix(d.Label, fmt.Sprintf("one-%s-", vmID)) {
+			continue // persistent image
+		}
+		// detachLinode waited for the detach to finish
+		if err := deleteVolume(d.VolumeID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tmMkimage mkimage size format host:remote_system_ds/disk.i vm_id ds_id
+// Creates a volume for a volatile disk of size MB
+func tmMkimage(args []string) error {
+	if err := tmArgs(args, 5, "SIZE FORMAT DST VM_ID DS_ID"); err != nil {
+		return err
+	}
+	sizeMB, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid size %q", args[0])
+	}
+	format := args[1]
+	host, diskPath := splitHostPath(args[2])
+	vmID, dsID := args[3], args[4]
+
+	label, err := tmDiskLabel(vmID, diskPath)
+	if err != nil {
+		return err
+	}
+	node, err := getLinodeByName(host)
+	if err != nil {
+		return fmt.Errorf("Unable to get Linode by name(%s): %s", host, err)
+	}
+	size := (sizeMB + 1023) / 1024
+	if size < volumeMinSizeGB {
+		size = volumeMinSizeGB
+	}
+	if _, err := createVolume(CreateVolumeRequest{Label: label, Region: node.Region, Size: size, Tags: []string{tmDSTag(dsID)}}); err != nil {
+		return err
+	}
+	if err := tmAttach(vmID, host, label, diskPath); err != nil {
+		return err
+	}
+	switch format {
+	case "", "raw", "qcow2":
+		return nil
+	default:
+		return mounterFor(host).Format(diskPath, format)
+	}
+}
+
+// tmPremigrate premigrate src_host dst_host remote_system_dir vm_id ds_id template
+// A volume is attached to a single linode so the disks move before the VM does
+func tmPremigrate(args []string) error {
+	if err := tmArgs(args, 5, "SRC_HOST DST_HOST DIR VM_ID DS_ID [TEMPLATE]"); err != nil {
+		return err
+	}
+	return tmMove(args[3], args[0], args[2], args[1], args[2])
+}
+
+// tmPostmigrate postmigrate src_host dst_host remote_system_dir vm_id ds_id template
+// Nothing left to do, premigrate moved the disks
+func tmPostmigrate(args []string) error {
+	return tmArgs(args, 5, "SRC_HOST DST_HOST DIR VM_ID DS_ID [TEMPLATE]")
+}
+
+// decodeDSTemplate decodes the base64 datastore xml given to the monitor action
+func decodeDSTemplate(encoded string) (*xmlNode, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode base64 datastore template: %s", err)
+	}
+	root := &xmlNode{}
+	if err := xml.Unmarshal(data, root); err != nil {
+		return nil, fmt.Errorf("unable to parse datastore template: %s", err)
+	}
+	return root, nil
+}
+
+// tmMonitor monitor ds_template ds_id
+// Prints the space used by the volumes of the datastore against the
+// LINODE_CAPACITY_GB datastore attribute, 10TB by default
+func tmMonitor(args []string) error {
+	if err := tmArgs(args, 2, "DS_TEMPLATE DS_ID"); err != nil {
+		return err
+	}
+	capacityGB := 10240
+	if ds, err := decodeDSTemplate(args[0]); err == nil {
+		if c, err := strconv.Atoi(ds.text("TEMPLATE", "LINODE_CAPACITY_GB")); err == nil {
+			capacityGB = c
+		}
+	}
+
+	vols, err := listVolumes()
+	if err != nil {
+		return err
+	}
+	usedGB := 0
+	tag := tmDSTag(args[1])
+	for _, v := range vols {
+		for _, t := range v.Tags {
+			if t == tag {
+				usedGB += v.Size
+			}
+		}
+	}
+	freeGB := capacityGB - usedGB
+	if freeGB < 0 {
+		freeGB = 0
+	}
+	fmt.Fprintf(os.Stdout, "USED_MB=%d\nTOTAL_MB=%d\nFREE_MB=%d\n", usedGB*1024, capacityGB*1024, freeGB*1024)
+	return nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const (
+	testImageDS  = "fe:/var/lib/one/datastores/1/"
+	testSystemDS = "/var/lib/one/datastores/0/42"
+)
+
+// tmRun runs the tm action with the arguments
+func tmRun(t *testing.T, action string, args ...string) error {
+	t.Helper()
+	fn, ok := tmActions[action]
+	if !ok {
+		t.Fatalf("no tm action %s", action)
+	}
+	return fn(args)
+}
+
+// disk returns the attachment of the disk of VM 42 recorded in the state file
+func disk(t *testing.T, label string) *AttachmentState {
+	t.Helper()
+	return readState(t).attachment(tmContainer("42"), label)
+}
+
+func TestTMClone(t *testing.T) {
+	api, m := setupTest(t)
+	image := api.addVolume("centos", "us-east", 20, 0)
+
+	if err := tmRun(t, "clone", testImageDS+"centos", "web1:"+testSystemDS+"/disk.0", "42", "0"); err != nil {
+		t.Fatalf("clone: %s", err)
+	}
+	v := api.volumeByLabel("one-42-0")
+	if v == nil || v.LinodeID != 1 {
+		t.Fatalf("clone = %+v, want one-42-0 attached to web1", v)
+	}
+	if len(v.Tags) != 1 || v.Tags[0] != "one-ds-0" {
+		t.Errorf("clone tags = %v, want one-ds-0", v.Tags)
+	}
+	if api.volume(image).LinodeID != 0 {
+		t.Error("the image was attached")
+	}
+	if m.links[testSystemDS+"/disk.0"] != v.FilesystemPath {
+		t.Errorf("links = %v", m.links)
+	}
+	if d := disk(t, "one-42-0"); d == nil || d.MountPoint != testSystemDS+"/disk.0" {
+		t.Errorf("state disk = %+v", d)
+	}
+}
+
+func TestTMLnAndMvds(t *testing.T) {
+	api, m := setupTest(t)
+	id := api.addVolume("persistent", "us-east", 20, 0)
+	path := testSystemDS + "/disk.1"
+
+	if err := tmRun(t, "ln", testImageDS+"persistent", "web1:"+path, "42", "0"); err != nil {
+		t.Fatalf("ln: %s", err)
+	}
+	if api.volume(id).LinodeID != 1 || m.links[path] == "" || disk(t, "persistent") == nil {
+		t.Fatalf("ln did not attach and link the image: %v", m.called())
+	}
+	if api.called("POST /volumes/"+strconv.Itoa(id)+"/clone") != 0 {
+		t.Error("ln cloned the image")
+	}
+
+	if err := tmRun(t, "mvds", "web1:"+path, testImageDS+"persistent", "42", "0"); err != nil {
+		t.Fatalf("mvds: %s", err)
+	}
+	if api.volume(id) == nil || api.volume(id).LinodeID != 0 {
+		t.Errorf("image after mvds = %+v, want kept and detached", api.volume(id))
+	}
+	if _, ok := m.links[path]; ok || disk(t, "persistent") != nil {
+		t.Error("mvds left the link or the state entry")
+	}
+}
+
+func TestTMMvAndPremigrate(t *testing.T) {
+	for _, action := range []string{"mv", "premigrate"} {
+		t.Run(action, func(t *testing.T) {
+			api, mounters := setupTMMove(t)
+
+			var err error
+			if action == "mv" {
+				err = tmRun(t, "mv", "web1:"+testSystemDS, "db1:"+testSystemDS, "42", "0")
+			} else {
+				err = tmRun(t, "premigrate", "web1", "db1", testSystemDS, "42", "0", "")
+			}
+			if err != nil {
+				t.Fatalf("%s: %s", action, err)
+			}
+			for _, label := range []string{"one-42-0", "persistent"} {
+				if v := api.volumeByLabel(label); v.LinodeID != 2 {
+					t.Errorf("%s attached to %d, want db1", label, v.LinodeID)
+				}
+			}
+			if cs := readState(t).Containers[tmContainer("42")]; cs == nil || cs.Host != "db1" || len(cs.Attachments) != 2 {
+				t.Errorf("state = %+v", cs)
+			}
+			if mounters["db1"].links[testSystemDS+"/disk.1"] == "" {
+				t.Errorf("db1 links = %v", mounters["db1"].links)
+			}
+			if n := len(mounters["web1"].links); n != 0 {
+				t.Errorf("web1 links = %v, want none", mounters["web1"].links)
+			}
+		})
+	}
+}
+
+// setupTMMove gives web1 and db1 their own mounter and links disks 0 and 1
+// of VM 42 on web1
+func setupTMMove(t *testing.T) (*fakeAPI, map[string]*fakeMounter) {
+	t.Helper()
+	api, _ := setupTest(t)
+	mounters := map[string]*fakeMounter{"web1": newFakeMounter(), "db1": newFakeMounter()}
+	mounterFor = func(host string) Mounter { return mounters[host] }
+	api.addVolume("centos", "us-east", 20, 0)
+	api.addVolume("persistent", "us-east", 20, 0)
+	if err := tmRun(t, "clone", testImageDS+"centos", "web1:"+testSystemDS+"/disk.0", "42", "0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmRun(t, "ln", testImageDS+"persistent", "web1:"+testSystemDS+"/disk.1", "42", "0"); err != nil {
+		t.Fatal(err)
+	}
+	return api, mounters
+}
+
+func TestTMMvKeepsSourceLinksOnFailure(t *testing.T) {
+	_, mounters := setupTMMove(t)
+	mounters["db1"].failOn("wait", errors.New("device did not appear"))
+
+	if err := tmRun(t, "mv", "web1:"+testSystemDS, "db1:"+testSystemDS, "42", "0"); err == nil {
+		t.Fatal("mv succeeded, want the device wait error")
+	}
+	for _, disk := range []string{"/disk.0", "/disk.1"} {
+		if mounters["web1"].links[testSystemDS+disk] == "" {
+			t.Errorf("web1 link of %s was removed by the failed mv, links = %v", disk, mounters["web1"].links)
+		}
+	}
+}
+
+func TestTMMvSamePath(t *testing.T) {
+	api, _ := setupTest(t)
+	if err := tmRun(t, "mv", "web1:"+testSystemDS, "web1:"+testSystemDS, "42", "0"); err != nil {
+		t.Fatalf("mv: %s", err)
+	}
+	if n := len(api.calls); n != 0 {
+		t.Errorf("mv to the same path made %d API calls", n)
+	}
+}
+
+func TestTMDelete(t *testing.T) {
+	api, _ := setupTest(t)
+	api.addVolume("centos", "us-east", 20, 0)
+	persistent := api.addVolume("persistent", "us-east", 20, 0)
+	if err := tmRun(t, "clone", testImageDS+"centos", "web1:"+testSystemDS+"/disk.0", "42", "0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmRun(t, "ln", testImageDS+"persistent", "web1:"+testSystemDS+"/disk.1", "42", "0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tmRun(t, "delete", "web1:"+testSystemDS, "42", "0"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if api.volumeByLabel("one-42-0") != nil {
+		t.Error("the clone of the VM was kept")
+	}
+	if v := api.volume(persistent); v == nil || v.LinodeID != 0 {
+		t.Errorf("persistent image = %+v, want kept and detached", v)
+	}
+	if _, ok := readState(t).Containers[tmContainer("42")]; ok {
+		t.Error("state still holds the VM")
+	}
+}
+
+func TestTMMkimage(t *testing.T) {
+	api, m := setupTest(t)
+	path := testSystemDS + "/disk.2"
+	if err := tmRun(t, "mkimage", "2048", "ext4", "web1:"+path, "42", "0"); err != nil {
+		t.Fatalf("mkimage: %s", err)
+	}
+	v := api.volumeByLabel("one-42-2")
+	if v == nil || v.Size != volumeMinSizeGB || v.Region != "us-east" || v.LinodeID != 1 {
+		t.Fatalf("volume = %+v, want %dGB in us-east attached to web1", v, volumeMinSizeGB)
+	}
+	if m.formatted[path] != "ext4" {
+		t.Errorf("calls = %v, want %s formatted ext4", m.called(), path)
+	}
+
+	if err := tmRun(t, "mkimage", "20480", "raw", "web1:"+testSystemDS+"/disk.3", "42", "0"); err != nil {
+		t.Fatalf("mkimage raw: %s", err)
+	}
+	if v := api.volumeByLabel("one-42-3"); v == nil || v.Size != 20 {
+		t.Errorf("raw volume = %+v, want 20GB", v)
+	}
+	if _, ok := m.formatted[testSystemDS+"/disk.3"]; ok {
+		t.Error("raw disk was formatted")
+	}
+	if err := tmRun(t, "mkimage", "big", "raw", "web1:"+path, "42", "0"); err == nil {
+		t.Error("mkimage with an invalid size succeeded")
+	}
+}
+
+func TestTMPostmigrate(t *testing.T) {
+	api, _ := setupTest(t)
+	if err := tmRun(t, "postmigrate", "web1", "db1", testSystemDS, "42", "0"); err != nil {
+		t.Fatalf("postmigrate: %s", err)
+	}
+	if len(api.calls) != 0 {
+		t.Errorf("postmigrate made API calls: %v", api.calls)
+	}
+	if err := tmRun(t, "postmigrate", "web1"); err == nil {
+		t.Error("postmigrate without arguments succeeded")
+	}
+}
+
+func TestTMMonitor(t *testing.T) {
+	api, _ := setupTest(t)
+	api.addVolume("one-42-0", "us-east", 20, 0, "one-ds-0")
+	api.addVolume("one-43-0", "us-east", 30, 1, "one-ds-0")
+	api.addVolume("other", "us-east", 500, 0, "one-ds-1")
+	ds := base64.StdEncoding.EncodeToString([]byte("<DATASTORE><TEMPLATE><LINODE_CAPACITY_GB>100</LINODE_CAPACITY_GB></TEMPLATE></DATASTORE>"))
+
+	out := captureStdout(t, func() {
+		if err := tmRun(t, "monitor", ds, "0"); err != nil {
+			t.Errorf("monitor: %s", err)
+		}
+	})
+	if out != "USED_MB=51200\nTOTAL_MB=102400\nFREE_MB=51200\n" {
+		t.Errorf("monitor printed %q", out)
+	}
+}
+
+func TestRunTMUsage(t *testing.T) {
+	setupTest(t)
+	c := findCommand("tm")
+	for _, args := range [][]string{nil, {"bogus"}, {"clone", "only-one"}} {
+		_, err := c.run(c, args)
+		if _, ok := err.(usageError); !ok {
+			t.Errorf("tm %s = %v, want a usage error", strings.Join(args, " "), err)
+		}
+	}
+}
+
+// captureStdout returns what fn prints on stdout
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	fn()
+	_ = w.Close()
+	b, _ := ioutil.ReadAll(r)
+	return string(b)
+}
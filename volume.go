@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/libgolang/log"
+)
+
+const (
+	// volumeMinSizeGB smallest volume linode creates
+	volumeMinSizeGB = 10
+	// linodeLabelMax longest volume label linode accepts
+	linodeLabelMax = 32
+)
+
+// CreateVolumeRequest linode volume create request
+type CreateVolumeRequest struct {
+	Label    string   `json:"label"`
+	Region   string   `json:"region,omitempty"`
+	LinodeID int      `json:"linode_id,omitempty"`
+	Size     int      `json:"size"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+// ResizeVolumeRequest linode volume resize request
+type ResizeVolumeRequest struct {
+	Size int `json:"size"`
+}
+
+// listVolumes returns all the volumes of the account
+func listVolumes() ([]Volume, error) {
+	var all []Volume
+	pages := 1
+	for page := 1; page <= pages; page++ {
+		url := fmt.Sprintf("%s/volumes?page=%d", *apiURLPtr, page)
+		it, err := Get(url, &ListVolumeResponse{})
+		if err != nil {
+			return nil, err
+		}
+		resp, ok := it.(*ListVolumeResponse)
+		if !ok {
+			return nil, fmt.Errorf("Error casting to ListVolumeReponse")
+		}
+		pages = resp.Pages
+		all = append(all, resp.Data...)
+	}
+	return all, nil
+}
+
+// listLinodes returns all the linodes of the account
+func listLinodes() ([]Node, error) {
+	var all []Node
+	pages := 1
+	for page := 1; page <= pages; page++ {
+		url := fmt.Sprintf("%s/linode/instances?page=%d", *apiURLPtr, page)
+		it, err := Get(url, &ListNodeResponse{})
+		if err != nil {
+			return nil, err
+		}
+		resp, ok := it.(*ListNodeResponse)
+		if !ok {
+			return nil, fmt.Errorf("Error casting to ListNodeReponse")
+		}
+		pages = resp.Pages
+		all = append(all, resp.Data...)
+	}
+	return all, nil
+}
+
+// linodeLabels returns a map of linode id to label
+func linodeLabels() (map[int]string, error) {
+	nodes, err := listLinodes()
+	if err != nil {
+		return nil, err
+	}
+	labels := make(map[int]string, len(nodes))
+	for _, n := range nodes {
+		labels[n.ID] = n.Label
+	}
+	return labels, nil
+}
+
+// createVolume creates a new volume
+func createVolume(req CreateVolumeRequest) (*Volume, error) {
+	log.Info("Creating volume %s of %dGB in %s", req.Label, req.Size, req.Region)
+	it, err := Post(fmt.Sprintf("%s/volumes", *apiURLPtr), req, &Volume{})
+	if err != nil {
+		return nil, err
+	}
+	vol := it.(*Volume)
+	if *dryRunPtr {
+		vol.Label, vol.Region, vol.Size, vol.LinodeID = req.Label, req.Region, req.Size, req.LinodeID
+		dryRunVolumes[vol.Label] = vol
+	}
+	return vol, nil
+}
+
+// dryRunVolumes volumes --dry-run would have created, by label, so later
+// lookups find them
+var dryRunVolumes = make(map[string]*Volume)
+
+// dryRunPlaceholder whether the volume only exists in --dry-run.  It has no
+// ID, reading it back from the API fails
+func dryRunPlaceholder(volume *Volume) bool {
+	return *dryRunPtr && volume.ID == 0
+}
+
+// fitLabel cuts label to max characters.  Cut labels end with a hash of the
+// full label so labels sharing a prefix stay distinct
+func fitLabel(label string, max int) string {
+	if len(label) <= max {
+		return label
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(label))
+	return fmt.Sprintf("%s-%04x", label[:max-5], h.Sum32()&0xffff)
+}
+
+// deleteVolume deletes the volume
+func deleteVolume(volumeID int) error {
+	log.Info("Deleting volume %d", volumeID)
+	return Delete(fmt.Sprintf("%s/volumes/%d", *apiURLPtr, volumeID))
+}
+
+// resizeVolume grows the volume to size GB
+func resizeVolume(volumeID int, size int) error {
+	log.Info("Resizing volume %d to %dGB", volumeID, size)
+	_, err := Post(fmt.Sprintf("%s/volumes/%d/resize", *apiURLPtr, volumeID), ResizeVolumeRequest{Size: size}, nil)
+	return err
+}
+
+// growVolume resizes the volume to size GB, waits for the resize to finish
+// and, when the volume is attached to host, rescans the device and grows the
+// filesystem mounted on mount.  An empty mount only rescans
+func growVolume(vol *Volume, size int, host, mount string) error {
+	if err := resizeVolume(vol.ID, size); err != nil {
+		return err
+	}
+	if !*dryRunPtr {
+		if _, err := waitVolumeResized(vol, size); err != nil {
+			return err
+		}
+	}
+	if host == "" {
+		return nil // not attached, the filesystem grows when it is next mounted
+	}
+
+	m := mounterFor(host)
+	if err := m.Rescan(vol.FilesystemPath); err != nil {
+		return err
+	}
+	if mount == "" {
+		log.Warn("Volume %s has no known mount point on %s, the filesystem was not grown", vol.Label, host)
+		return nil
+	}
+	if mounted, err := m.IsMounted(mount); err != nil {
+		return err
+	} else if !mounted {
+		log.Warn("Volume %s is not mounted on %s:%s, the filesystem was not grown", vol.Label, host, mount)
+		return nil
+	}
+	return m.GrowFilesystem(vol.FilesystemPath, mount)
+}
+
+// CloneVolumeRequest linode volume clone request
+type CloneVolumeRequest struct {
+	Label string `json:"label"`
+}
+
+// cloneVolume clones the volume into a new volume with the given label
+func cloneVolume(volumeID int, label string) (*Volume, error) {
+	log.Info("Cloning volume %d to %s", volumeID, label)
+	it, err := Post(fmt.Sprintf("%s/volumes/%d/clone", *apiURLPtr, volumeID), CloneVolumeRequest{Label: label}, &Volume{})
+	if err != nil {
+		return nil, err
+	}
+	vol := it.(*Volume)
+	if *dryRunPtr {
+		vol.Label = label
+		dryRunVolumes[label] = vol
+	}
+	return vol, nil
+}
+
+// VolumeStatus status of a linode volume
+type VolumeStatus string
+
+// Volume statuses
+const (
+	VolumeCreating       VolumeStatus = "creating"
+	VolumeActive         VolumeStatus = "active"
+	VolumeResizing       VolumeStatus = "resizing"
+	VolumeContactSupport VolumeStatus = "contact_support"
+)
+
+// Transient whether the volume leaves the status by itself
+func (s VolumeStatus) Transient() bool {
+	return s == VolumeCreating || s == VolumeResizing
+}
+
+// VolumeStatusError a volume one-linode cannot act on because of its status
+type VolumeStatusError struct {
+	Label   string
+	Status  VolumeStatus
+	Timeout time.Duration // set when a transient status did not end in time
+}
+
+func (e *VolumeStatusError) Error() string {
+	switch {
+	case e.Timeout > 0:
+		return fmt.Sprintf("volume %s still %s after %s", e.Label, e.Status, e.Timeout)
+	case e.Status == VolumeContactSupport:
+		return fmt.Sprintf("volume %s is in status contact_support and needs a Linode support ticket", e.Label)
+	default:
+		return fmt.Sprintf("volume %s has unexpected status %q", e.Label, e.Status)
+	}
+}
+
+// volumePollInterval time between two reads of a volume waited for
+var volumePollInterval = 5 * time.Second
+
+// waitVolumeActive waits up to --volume-wait for a creating or resizing
+// volume to become active and returns it as last read.  Volumes without a
+// status count as active
+func waitVolumeActive(volume *Volume) (*Volume, error) {
+	timeout := time.Duration(*volumeWaitPtr) * time.Second
+	deadline := time.Now().Add(timeout)
+	for {
+		switch {
+		case volume.Status == VolumeActive || volume.Status == "":
+			return volume, nil
+		case !volume.Status.Transient():
+			return nil, &VolumeStatusError{Label: volume.Label, Status: volume.Status}
+		case time.Now().After(deadline):
+			return nil, &VolumeStatusError{Label: volume.Label, Status: volume.Status, Timeout: timeout}
+		}
+		log.Info("Volume %s is %s, waiting for it to become active", volume.Label, volume.Status)
+		time.Sleep(volumePollInterval)
+		current, err := getVolume(volume.ID)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get volume %s: %s", volume.Label, err)
+		}
+		volume = current
+	}
+}
+
+// waitVolumeResized waits up to --volume-wait for the volume to be active
+// with at least size GB.  A read right after the resize request can still
+// return the old size with the active status
+func waitVolumeResized(volume *Volume, size int) (*Volume, error) {
+	timeout := time.Duration(*volumeWaitPtr) * time.Second
+	deadline := time.Now().Add(timeout)
+	for {
+		current, err := getVolume(volume.ID)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get volume %s: %s", volume.Label, err)
+		}
+		active := current.Status == VolumeActive || current.Status == ""
+		switch {
+		case active && current.Size >= size:
+			return current, nil
+		case !active && !current.Status.Transient():
+			return nil, &VolumeStatusError{Label: volume.Label, Status: current.Status}
+		case time.Now().After(deadline):
+			return nil, fmt.Errorf("volume %s is %dGB and %s after %s, expected %dGB", volume.Label, current.Size, current.Status, timeout, size)
+		}
+		log.Info("Volume %s is %dGB and %s, waiting for it to grow to %dGB", volume.Label, current.Size, current.Status, size)
+		time.Sleep(volumePollInterval)
+	}
+}
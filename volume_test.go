@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGrowVolume(t *testing.T) {
+	api, m := setupTest(t)
+	id := api.addVolume("data", "us-east", 20, 1)
+	vol := api.volume(id)
+	if err := m.Mount(vol.FilesystemPath, "/mnt/data", ""); err != nil {
+		t.Fatal(err)
+	}
+	// the first reads after the resize still return the old size
+	api.resizing[id] = 3
+
+	if err := growVolume(vol, 40, "web1", "/mnt/data"); err != nil {
+		t.Fatalf("growVolume: %s", err)
+	}
+	if v := api.volume(id); v.Size != 40 || v.Status != VolumeActive {
+		t.Errorf("volume is %dGB and %s, want 40GB and active", v.Size, v.Status)
+	}
+	if n := api.called("GET /volumes/" + strconv.Itoa(id)); n < 4 {
+		t.Errorf("read %d times, want the resize waited for", n)
+	}
+	want := []string{
+		"mount " + vol.FilesystemPath + " /mnt/data ",
+		"rescan " + vol.FilesystemPath,
+		"grow " + vol.FilesystemPath + " /mnt/data",
+	}
+	if calls := m.called(); !reflect.DeepEqual(calls, want) {
+		t.Errorf("mounter calls = %q, want %q", calls, want)
+	}
+}
+
+func TestGrowVolumeNotMounted(t *testing.T) {
+	api, m := setupTest(t)
+	id := api.addVolume("data", "us-east", 20, 1)
+
+	if err := growVolume(api.volume(id), 30, "web1", "/mnt/data"); err != nil {
+		t.Fatalf("growVolume: %s", err)
+	}
+	if calls := m.called(); len(calls) != 1 || !strings.HasPrefix(calls[0], "rescan ") {
+		t.Errorf("mounter calls = %q, want only the rescan", calls)
+	}
+
+	// detached volumes grow when next mounted
+	other := api.addVolume("logs", "us-east", 20, 0)
+	if err := growVolume(api.volume(other), 30, "", ""); err != nil {
+		t.Fatalf("growVolume of a detached volume: %s", err)
+	}
+	if len(m.called()) != 1 {
+		t.Errorf("mounter calls = %q for a detached volume", m.called())
+	}
+}
+
+func TestGrowVolumeTimeout(t *testing.T) {
+	api, m := setupTest(t)
+	*volumeWaitPtr = 0
+	id := api.addVolume("data", "us-east", 20, 1)
+	api.resizing[id] = 1000
+
+	err := growVolume(api.volume(id), 40, "web1", "/mnt/data")
+	if err == nil || !strings.Contains(err.Error(), "expected 40GB") {
+		t.Fatalf("growVolume = %v, want the resize timeout", err)
+	}
+	if len(m.called()) != 0 {
+		t.Errorf("mounter called before the resize landed: %q", m.called())
+	}
+}
+
+func TestGrowVolumeShrink(t *testing.T) {
+	api, _ := setupTest(t)
+	id := api.addVolume("data", "us-east", 20, 0)
+	if err := growVolume(api.volume(id), 10, "", ""); err == nil {
+		t.Error("growVolume to a smaller size succeeded")
+	}
+}
+
+func TestRequestErrorsNameTheMethod(t *testing.T) {
+	api, _ := setupTest(t)
+	id := api.addVolume("data", "us-east", 20, 0)
+	path := "/volumes/" + strconv.Itoa(id)
+	api.failOn("GET "+path, http.StatusInternalServerError)
+	api.failOn("POST /volumes", http.StatusInternalServerError)
+	api.failOn("PUT "+path, http.StatusInternalServerError)
+	api.failOn("DELETE "+path, http.StatusInternalServerError)
+
+	_, getErr := getVolume(id)
+	_, postErr := createVolume(CreateVolumeRequest{Label: "new", Region: "us-east", Size: 20})
+	_, putErr := Put(*apiURLPtr+path, map[string]string{"label": "x"}, nil)
+	deleteErr := deleteVolume(id)
+	for method, err := range map[string]error{"GET": getErr, "POST": postErr, "PUT": putErr, "DELETE": deleteErr} {
+		if err == nil || !strings.HasPrefix(err.Error(), method+" Request returned error 500") {
+			t.Errorf("%s error = %v", method, err)
+		}
+	}
+}
+
+// setStatus sets the status of the volume in the fake API
+func setStatus(api *fakeAPI, id int, status VolumeStatus) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.volumes[id].Status = status
+}
+
+func TestAttachContactSupport(t *testing.T) {
+	api, _ := setupTest(t)
+	id := api.addVolume("data", "us-east", 20, 0)
+	setStatus(api, id, VolumeCreating)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		setStatus(api, id, VolumeContactSupport)
+	}()
+
+	start := time.Now()
+	_, err := attachLinode("web1", "data", false)
+	statusErr, ok := err.(*VolumeStatusError)
+	if !ok {
+		t.Fatalf("attachLinode = %v, want a VolumeStatusError", err)
+	}
+	if statusErr.Status != VolumeContactSupport || statusErr.Timeout != 0 || !strings.Contains(err.Error(), "support ticket") {
+		t.Errorf("error = %+v %q, want contact_support", statusErr, err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Duration(*volumeWaitPtr)*time.Second {
+		t.Errorf("attach waited %s, contact_support must end the wait", elapsed)
+	}
+	if n := api.called("POST /volumes/" + strconv.Itoa(id) + "/attach"); n != 0 {
+		t.Errorf("a contact_support volume was attached %d times", n)
+	}
+}
+
+func TestWaitVolumeActiveTimeout(t *testing.T) {
+	api, _ := setupTest(t)
+	*volumeWaitPtr = 1
+	volumePollInterval = 50 * time.Millisecond
+	id := api.addVolume("data", "us-east", 20, 0)
+	setStatus(api, id, VolumeCreating)
+
+	start := time.Now()
+	_, err := waitVolumeActive(api.volume(id))
+	statusErr, ok := err.(*VolumeStatusError)
+	if !ok || statusErr.Status != VolumeCreating || statusErr.Timeout != time.Second {
+		t.Fatalf("waitVolumeActive = %v, want a VolumeStatusError after 1s", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("waitVolumeActive waited %s past a 1s --volume-wait", elapsed)
+	}
+}
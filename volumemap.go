@@ -0,0 +1,419 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/libgolang/log"
+	"gopkg.in/yaml.v2"
+)
+
+// The volume map is a YAML file giving the volumes of containers whose name
+// is the key or matches the glob pattern in match:
+//
+//	containers:
+//	  web:
+//	    match: web-*
+//	    volumes:
+//	      - label: "{{.Name}}-data"
+//	        size: 20
+//	        filesystem: ext4
+//	        mount: /srv/web
+//	        options: noatime
+//	        owner: www-data:www-data
+//	        create: true
+//	        format: true
+//	        clone-before-attach: true
+//
+// Labels are templates like --volume-template.  Volumes are mounted only
+// when mount is set, format creates the filesystem when the volume has none
+const (
+	volumeMapPrefix = "containers."
+	// mapDeviceWait time to wait for the device of an attached volume before mounting it
+	mapDeviceWait = 2 * time.Minute
+)
+
+// volumeSpec a volume of the volume map
+type volumeSpec struct {
+	Label      string
+	Size       int // GB, for create
+	Filesystem string
+	Mount      string
+	Options    string
+	Owner      string // user[:group] of the mount point
+	Create     bool   // create the volume when it does not exist
+	Format     bool   // create the filesystem when the volume has none
+	Backup     bool   // clone-before-attach, back up the volume before attaching it
+}
+
+// containerSpec the volumes of the containers matching Match
+type containerSpec struct {
+	Key     string
+	Match   string
+	Volumes []*volumeSpec
+}
+
+// ConfigVolumeInfo a volume of the volume map as shown by config validate
+type ConfigVolumeInfo struct {
+	Container  string `json:"container"`
+	Match      string `json:"match"`
+	Volume     string `json:"volume"`
+	Size       int    `json:"size"`
+	Filesystem string `json:"filesystem"`
+	Mount      string `json:"mount"`
+	Owner      string `json:"owner"`
+	Create     bool   `json:"create"`
+	Format     bool   `json:"format"`
+	Backup     bool   `json:"clone_before_attach"`
+}
+
+// mappedVolumes the specs of the volumes commandVolumes took from the volume
+// map, by label
+var mappedVolumes = make(map[string]*volumeSpec)
+
+// volumeMapFile path of the volume map given with --volume-map
+func volumeMapFile() string {
+	return resolveConfigFile(*volumeMapPtr)
+}
+
+// loadVolumeMap reads the volume map file.  A missing file is an empty map.
+// Problems are returned one per entry
+func loadVolumeMap(file string) ([]*containerSpec, []string, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("Unable to read volume map %s: %s", file, err)
+	}
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, fmt.Errorf("invalid volume map %s: %s", file, err)
+	}
+	specs, problems := parseVolumeMap(doc)
+	return specs, problems, nil
+}
+
+// parseVolumeMap parses the containers section of the volume map
+func parseVolumeMap(doc map[string]interface{}) ([]*containerSpec, []string) {
+	var problems []string
+	problem := func(key, format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("%s: %s", key, fmt.Sprintf(format, args...)))
+	}
+
+	for _, key := range sortedKeys(doc) {
+		if key != "containers" {
+			problem(key, "unknown key")
+		}
+	}
+	containers, ok := yamlMap(doc["containers"])
+	if !ok {
+		problem("containers", "not a map of containers")
+	}
+
+	keys := sortedKeys(containers)
+	specs := make([]*containerSpec, 0, len(keys))
+	for _, k := range keys {
+		prefix := volumeMapPrefix + k
+		c := &containerSpec{Key: k, Match: k}
+		fields, ok := yamlMap(containers[k])
+		if !ok {
+			problem(prefix, "not a map")
+		}
+		for _, field := range sortedKeys(fields) {
+			value := fields[field]
+			switch field {
+			case "match":
+				match, ok := scalar(value)
+				if !ok {
+					problem(prefix+".match", "not a pattern")
+				}
+				c.Match = match
+			case "volumes":
+				list, ok := value.([]interface{})
+				if !ok && value != nil {
+					problem(prefix+".volumes", "not a list of volumes")
+				}
+				for i, item := range list {
+					v := &volumeSpec{Size: 20, Filesystem: "ext4", Format: true}
+					vfields, ok := yamlMap(item)
+					if !ok || item == nil {
+						problem(fmt.Sprintf("%s.volumes.%d", prefix, i), "not a map")
+					}
+					for _, name := range sortedKeys(vfields) {
+						key := fmt.Sprintf("%s.volumes.%d.%s", prefix, i, name)
+						value, ok := scalar(vfields[name])
+						if !ok {
+							problem(key, "not a value")
+						} else if err := v.set(name, value); err != nil {
+							problem(key, "%s", err)
+						}
+					}
+					c.Volumes = append(c.Volumes, v)
+				}
+			default:
+				problem(prefix+"."+field, "unknown key")
+			}
+		}
+		for _, msg := range c.validate() {
+			problem(prefix, "%s", msg)
+		}
+		specs = append(specs, c)
+	}
+	return specs, problems
+}
+
+// yamlMap returns the YAML map with its keys as strings.  ok is false when
+// value is neither a map nor empty
+func yamlMap(value interface{}) (map[string]interface{}, bool) {
+	m, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return nil, value == nil
+	}
+	out := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		out[fmt.Sprint(k)] = v
+	}
+	return out, true
+}
+
+// sortedKeys returns the keys of the map in order
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// scalar returns the text of a YAML value, ok is false for maps and lists
+func scalar(value interface{}) (string, bool) {
+	switch value.(type) {
+	case nil:
+		return "", true
+	case map[interface{}]interface{}, []interface{}:
+		return "", false
+	}
+	return fmt.Sprint(value), true
+}
+
+// set sets a field of the spec from its property
+func (v *volumeSpec) set(field, value string) error {
+	var err error
+	switch field {
+	case "label":
+		v.Label = value
+	case "size":
+		v.Size, err = strconv.Atoi(value)
+	case "filesystem":
+		v.Filesystem = value
+	case "mount":
+		v.Mount = value
+	case "options":
+		v.Options = value
+	case "owner":
+		v.Owner = value
+	case "create":
+		v.Create, err = strconv.ParseBool(value)
+	case "format":
+		v.Format, err = strconv.ParseBool(value)
+	case "clone-before-attach":
+		v.Backup, err = strconv.ParseBool(value)
+	default:
+		return fmt.Errorf("unknown volume field %s", field)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s %q", field, value)
+	}
+	return nil
+}
+
+// validate returns the problems of the container spec
+func (c *containerSpec) validate() []string {
+	var problems []string
+	if _, err := path.Match(c.Match, ""); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid match pattern %q", c.Match))
+	}
+	if len(c.Volumes) == 0 {
+		problems = append(problems, "no volumes")
+	}
+	labels := make(map[string]bool)
+	for i, v := range c.Volumes {
+		prefix := fmt.Sprintf("volume %d", i)
+		if v.Label == "" {
+			problems = append(problems, prefix+": label is required")
+		} else if _, err := template.New("label").Parse(v.Label); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: invalid label template: %s", prefix, err))
+		} else if labels[v.Label] {
+			problems = append(problems, fmt.Sprintf("%s: duplicate label %s", prefix, v.Label))
+		}
+		labels[v.Label] = true
+		if v.Size <= 0 {
+			problems = append(problems, fmt.Sprintf("%s: size must be positive", prefix))
+		}
+		if v.Mount == "" {
+			if v.Options != "" || v.Owner != "" {
+				problems = append(problems, prefix+": options and owner need mount")
+			}
+			continue
+		}
+		if !path.IsAbs(v.Mount) {
+			problems = append(problems, fmt.Sprintf("%s: mount %s is not an absolute path", prefix, v.Mount))
+		}
+		if v.Format && v.Filesystem == "" {
+			problems = append(problems, prefix+": format needs filesystem")
+		}
+		if strings.ContainsAny(v.Owner, " \t") || strings.Count(v.Owner, ":") > 1 {
+			problems = append(problems, fmt.Sprintf("%s: owner %q is not user[:group]", prefix, v.Owner))
+		}
+	}
+	return problems
+}
+
+// matchContainer returns the spec of the container, an exact match first,
+// then the first pattern matching in key order
+func matchContainer(specs []*containerSpec, name string) *containerSpec {
+	for _, c := range specs {
+		if c.Match == name {
+			return c
+		}
+	}
+	for _, c := range specs {
+		if ok, _ := path.Match(c.Match, name); ok {
+			return c
+		}
+	}
+	return nil
+}
+
+// mapVolumes returns the labels of the volumes the volume map gives the
+// container, remembering their specs in mappedVolumes
+func mapVolumes(name string) ([]string, error) {
+	if name == "" {
+		return nil, nil
+	}
+	file := volumeMapFile()
+	specs, problems, err := loadVolumeMap(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid volume map in %s: %s", file, strings.Join(problems, "; "))
+	}
+	c := matchContainer(specs, name)
+	if c == nil {
+		return nil, nil
+	}
+	log.Debug("Container %s matches %s of the volume map", name, c.Key)
+	var labels []string
+	for _, v := range c.Volumes {
+		label, err := renderVolumeTemplate("label of "+volumeMapPrefix+c.Key, v.Label)
+		if err != nil {
+			return nil, err
+		}
+		mappedVolumes[label] = v
+		labels = append(labels, label)
+	}
+	return labels, nil
+}
+
+// createMappedVolume creates the volume in the region of host when its spec
+// asks for it and it does not exist
+func createMappedVolume(label, host string) error {
+	v, ok := mappedVolumes[label]
+	if !ok || !v.Create {
+		return nil
+	}
+	if _, err := getVolumeByName(label); err != errVolumeNotFound {
+		return err
+	}
+	node, err := getLinodeByName(host)
+	if err != nil {
+		return fmt.Errorf("Unable to get Linode by name(%s): %s", host, err)
+	}
+	log.Info("Creating volume %s of %dGB in %s", label, v.Size, node.Region)
+	_, err = createVolume(CreateVolumeRequest{Label: label, Region: node.Region, Size: v.Size})
+	return err
+}
+
+// mountMappedVolume mounts the volume attached to host where its spec says
+func mountMappedVolume(att *AttachmentState, host string) error {
+	v, ok := mappedVolumes[att.Label]
+	if !ok || v.Mount == "" {
+		return nil
+	}
+	m := mounterFor(host)
+	if err := m.WaitForDevice(att.FilesystemPath, mapDeviceWait); err != nil {
+		return err
+	}
+	mounted, err := m.MountedFrom(att.FilesystemPath, v.Mount)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		log.Info("Volume %s is already mounted on %s", att.Label, v.Mount)
+	} else if v.Format {
+		err = m.FormatAndMount(att.FilesystemPath, v.Mount, v.Filesystem, v.Options)
+	} else {
+		err = m.Mount(att.FilesystemPath, v.Mount, v.Options)
+	}
+	if err != nil {
+		return err
+	}
+	att.MountPoint = v.Mount
+	if v.Owner != "" {
+		return m.Chown(v.Mount, v.Owner)
+	}
+	return nil
+}
+
+// runConfig config command
+func runConfig(c *command, args []string) (interface{}, error) {
+	fs := c.flagSet()
+	if err := c.parse(fs, args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() != 1 || fs.Arg(0) != "validate" {
+		return nil, usageError{"expected config validate"}
+	}
+	file := volumeMapFile()
+	if _, err := os.Stat(file); err != nil {
+		return nil, fmt.Errorf("Unable to read volume map %s: %s", file, err)
+	}
+	specs, problems, err := loadVolumeMap(file)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []ConfigVolumeInfo{}
+	for _, c := range specs {
+		for _, v := range c.Volumes {
+			results = append(results, ConfigVolumeInfo{
+				Container:  c.Key,
+				Match:      c.Match,
+				Volume:     v.Label,
+				Size:       v.Size,
+				Filesystem: v.Filesystem,
+				Mount:      v.Mount,
+				Owner:      v.Owner,
+				Create:     v.Create,
+				Format:     v.Format,
+				Backup:     v.Backup,
+			})
+		}
+	}
+	for _, p := range problems {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", file, p)
+	}
+	if len(problems) > 0 {
+		return results, fmt.Errorf("%d problems in the volume map %s", len(problems), file)
+	}
+	return results, nil
+}
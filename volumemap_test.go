@@ -0,0 +1,192 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+const testVolumeMap = `
+containers:
+  web:
+    match: web-*
+    volumes:
+      - label: "{{.Name}}-data"
+        size: 40
+        mount: /srv/web
+        options: noatime
+        owner: www-data:www-data
+        create: true
+        clone-before-attach: true
+      - label: "{{.Name}}-logs"
+  db:
+    volumes:
+      - label: db-data
+        mount: /var/lib/db
+        format: false
+`
+
+// mustParseVolumeMap parses the volume map in data
+func mustParseVolumeMap(t *testing.T, data string) ([]*containerSpec, []string) {
+	t.Helper()
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal([]byte(data), &doc); err != nil {
+		t.Fatal(err)
+	}
+	return parseVolumeMap(doc)
+}
+
+func TestParseVolumeMap(t *testing.T) {
+	specs, problems := mustParseVolumeMap(t, testVolumeMap)
+	if len(problems) != 0 {
+		t.Fatalf("problems = %v", problems)
+	}
+	if len(specs) != 2 || specs[0].Key != "db" || specs[1].Key != "web" {
+		t.Fatalf("specs = %+v, want db and web", specs)
+	}
+
+	db := specs[0]
+	if db.Match != "db" {
+		t.Errorf("db matches %q, want its key", db.Match)
+	}
+	want := &volumeSpec{Label: "db-data", Size: 20, Filesystem: "ext4", Mount: "/var/lib/db"}
+	if len(db.Volumes) != 1 || !reflect.DeepEqual(db.Volumes[0], want) {
+		t.Errorf("db volume = %+v, want %+v", db.Volumes[0], want)
+	}
+
+	web := specs[1]
+	if web.Match != "web-*" || len(web.Volumes) != 2 {
+		t.Fatalf("web = %+v", web)
+	}
+	// volumes are in the order of the list
+	want = &volumeSpec{Label: "{{.Name}}-data", Size: 40, Filesystem: "ext4", Mount: "/srv/web", Options: "noatime", Owner: "www-data:www-data", Create: true, Format: true, Backup: true}
+	if !reflect.DeepEqual(web.Volumes[0], want) {
+		t.Errorf("web volume 0 = %+v, want %+v", web.Volumes[0], want)
+	}
+	if web.Volumes[1].Label != "{{.Name}}-logs" {
+		t.Errorf("web volume 1 = %+v", web.Volumes[1])
+	}
+}
+
+func TestParseVolumeMapProblems(t *testing.T) {
+	data := `
+containers:
+  a:
+    volumes:
+      - label: a
+        size: big
+        colour: red
+        mount: [x]
+    other: x
+  b:
+    match: "["
+  c:
+    volumes:
+      - label: "{{.Name"
+  d:
+    volumes:
+      - label: d
+        options: ro
+      - label: d
+        size: 0
+  e:
+    volumes:
+      - label: e
+        mount: srv
+        owner: a:b:c
+        filesystem:
+  f: [x]
+other: x
+`
+	_, problems := mustParseVolumeMap(t, data)
+	all := strings.Join(problems, "\n")
+	for _, problem := range []string{
+		`containers.a.volumes.0.size: invalid size "big"`,
+		"containers.a.volumes.0.colour: unknown volume field colour",
+		"containers.a.other: unknown key",
+		"containers.a.volumes.0.mount: not a value",
+		"containers.f: not a map",
+		"other: unknown key",
+		`containers.b: invalid match pattern "["`,
+		"containers.b: no volumes",
+		"containers.c: volume 0: invalid label template",
+		"containers.d: volume 0: options and owner need mount",
+		"containers.d: volume 1: duplicate label d",
+		"containers.d: volume 1: size must be positive",
+		"containers.e: volume 0: mount srv is not an absolute path",
+		"containers.e: volume 0: format needs filesystem",
+		`containers.e: volume 0: owner "a:b:c" is not user[:group]`,
+	} {
+		if !strings.Contains(all, problem) {
+			t.Errorf("problems do not report %q:\n%s", problem, all)
+		}
+	}
+}
+
+func TestMatchContainer(t *testing.T) {
+	specs, _ := mustParseVolumeMap(t, testVolumeMap+"  web-admin:\n    volumes:\n      - label: admin\n")
+	tests := map[string]string{"db": "db", "web-1": "web", "web-admin": "web-admin", "dbx": ""}
+	for name, key := range tests {
+		got := ""
+		if c := matchContainer(specs, name); c != nil {
+			got = c.Key
+		}
+		if got != key {
+			t.Errorf("matchContainer(%s) = %q, want %q", name, got, key)
+		}
+	}
+}
+
+func TestMapVolumes(t *testing.T) {
+	setupTest(t)
+	if err := ioutil.WriteFile(*volumeMapPtr, []byte(testVolumeMap), 0644); err != nil {
+		t.Fatal(err)
+	}
+	name := *namePtr
+	defer func() { *namePtr = name }()
+	*namePtr = "web-1"
+	labels, err := mapVolumes("web-1")
+	if err != nil {
+		t.Fatalf("mapVolumes: %s", err)
+	}
+	if !reflect.DeepEqual(labels, []string{"web-1-data", "web-1-logs"}) {
+		t.Errorf("labels = %v", labels)
+	}
+	if v := mappedVolumes["web-1-data"]; v == nil || v.Mount != "/srv/web" {
+		t.Errorf("mapped spec = %+v", v)
+	}
+	if labels, err := mapVolumes("other"); err != nil || len(labels) != 0 {
+		t.Errorf("mapVolumes(other) = %v, %v, want nothing", labels, err)
+	}
+}
+
+func TestResolveConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Chdir(wd) }()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	binDir, _ := filepath.Abs(filepath.Dir(os.Args[0]))
+
+	if got := resolveConfigFile("volumes.yaml"); got != filepath.Join(binDir, "volumes.yaml") {
+		t.Errorf("missing from the working directory = %s, want next to the binary in %s", got, binDir)
+	}
+	if err := ioutil.WriteFile("volumes.yaml", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := resolveConfigFile("volumes.yaml"); got != "volumes.yaml" {
+		t.Errorf("in the working directory = %s", got)
+	}
+	if got := resolveConfigFile("/etc/one-linode/volumes.yaml"); got != "/etc/one-linode/volumes.yaml" {
+		t.Errorf("absolute = %s", got)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+)
+
+// volumeTemplateData values available to --volume-template
+type volumeTemplateData struct {
+	Name string // --name, or the name of the OpenNebula VM
+	Host string // --host
+	VM   *OneVM // the VM given with --template or --vm-id, nil otherwise
+}
+
+// Region region of the host linode.  A method so the API is only called by
+// templates using it
+func (d *volumeTemplateData) Region() (string, error) {
+	node, err := getLinodeByName(d.Host)
+	if err != nil {
+		return "", fmt.Errorf("Unable to get Linode by name(%s): %s", d.Host, err)
+	}
+	return node.Region, nil
+}
+
+// Attr returns the attribute of the OpenNebula VM, e.g: {{.Attr "ROLE"}}.
+// A missing attribute is an error rather than an empty part of the label
+func (d *volumeTemplateData) Attr(name string) (string, error) {
+	if d.VM == nil {
+		return "", fmt.Errorf("attribute %s needs --template or --vm-id", name)
+	}
+	v, ok := d.VM.Attributes[name]
+	if !ok {
+		return "", fmt.Errorf("VM %s has no attribute %s", d.VM.ID, name)
+	}
+	return v, nil
+}
+
+// renderVolumeTemplate renders a label template for the container --name
+func renderVolumeTemplate(name, text string) (string, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s: %s", name, err)
+	}
+	data := &volumeTemplateData{Name: *namePtr, Host: *hostPtr, VM: currentVM}
+	if data.Name == "" {
+		return "", usageError{name + " needs --name"}
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("unable to render %s: %s", name, err)
+	}
+	return buf.String(), nil
+}
+
+// templateVolumes renders --volume-template into a list of volume labels
+func templateVolumes() ([]string, error) {
+	if *volumeTemplatePtr == "" {
+		return nil, nil
+	}
+	labels, err := renderVolumeTemplate("--volume-template", *volumeTemplatePtr)
+	if err != nil {
+		return nil, err
+	}
+	return splitVolumes(labels), nil
+}
+
+// commandVolumes the volumes a command operates on: its arguments and
+// --volume, or the volume map entry of --name, or --volume-template when
+// none are given
+func commandVolumes(args []string) ([]string, error) {
+	vols := append(args, volumes...)
+	if len(vols) > 0 {
+		return vols, nil
+	}
+	if vols, err := mapVolumes(*namePtr); err != nil || len(vols) > 0 {
+		return vols, err
+	}
+	return templateVolumes()
+}
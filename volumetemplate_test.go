@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// setupTemplate runs as container name with --volume-template tmpl and the
+// OpenNebula VM vm
+func setupTemplate(t *testing.T, name, tmpl string, vm *OneVM) *fakeAPI {
+	t.Helper()
+	api, _ := setupTest(t)
+	oldName, oldTemplate, oldVolumes, oldVM := *namePtr, *volumeTemplatePtr, volumes, currentVM
+	t.Cleanup(func() {
+		*namePtr, *volumeTemplatePtr, volumes, currentVM = oldName, oldTemplate, oldVolumes, oldVM
+	})
+	*namePtr, *volumeTemplatePtr, volumes, currentVM = name, tmpl, nil, vm
+	return api
+}
+
+func TestTemplateVolumes(t *testing.T) {
+	vm := &OneVM{ID: "42", Attributes: map[string]string{"ROLE": "frontend"}}
+	tests := []struct {
+		tmpl string
+		vm   *OneVM
+		want []string
+		err  string
+	}{
+		{"", nil, nil, ""},
+		{"{{.Name}}-data, {{.Name}}-logs", nil, []string{"web-1-data", "web-1-logs"}, ""},
+		{"{{.Host}}-{{.Region}}", nil, []string{"web1-us-east"}, ""},
+		{`{{.Name}}-{{.Attr "ROLE"}}`, vm, []string{"web-1-frontend"}, ""},
+		{`{{.Name}}-{{.Attr "MISSING"}}`, vm, nil, "VM 42 has no attribute MISSING"},
+		{`{{.Name}}-{{.Attr "ROLE"}}`, nil, nil, "needs --template or --vm-id"},
+		{"{{.Name", nil, nil, "invalid --volume-template"},
+		{"{{.Nope}}", nil, nil, "unable to render --volume-template"},
+	}
+	for _, tt := range tests {
+		setupTemplate(t, "web-1", tt.tmpl, tt.vm)
+		got, err := templateVolumes()
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("templateVolumes(%q) = %v, %v, want error %q", tt.tmpl, got, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("templateVolumes(%q) = %v, %v, want %v", tt.tmpl, got, err, tt.want)
+		}
+	}
+}
+
+func TestTemplateVolumesNeedsName(t *testing.T) {
+	setupTemplate(t, "", "{{.Name}}-data", nil)
+	if _, err := templateVolumes(); err == nil {
+		t.Error("templateVolumes without --name succeeded")
+	} else if _, ok := err.(usageError); !ok {
+		t.Errorf("templateVolumes without --name = %v, want a usage error", err)
+	}
+}
+
+func TestCommandVolumesPriority(t *testing.T) {
+	setupTemplate(t, "web-1", "{{.Name}}-template", nil)
+	volumeMap := "containers:\n  web:\n    match: web-*\n    volumes:\n      - label: \"{{.Name}}-mapped\"\n"
+	if err := ioutil.WriteFile(*volumeMapPtr, []byte(volumeMap), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// arguments and --volume win over the volume map
+	volumes = volumesFlag{"flag-vol"}
+	if got, err := commandVolumes([]string{"arg-vol"}); err != nil || !reflect.DeepEqual(got, []string{"arg-vol", "flag-vol"}) {
+		t.Errorf("commandVolumes(args) = %v, %v", got, err)
+	}
+	volumes = nil
+
+	// the volume map wins over the template
+	if got, err := commandVolumes(nil); err != nil || !reflect.DeepEqual(got, []string{"web-1-mapped"}) {
+		t.Errorf("commandVolumes(mapped) = %v, %v, want web-1-mapped", got, err)
+	}
+
+	// the template is used when the volume map has no entry for the container
+	*namePtr = "db-1"
+	if got, err := commandVolumes(nil); err != nil || !reflect.DeepEqual(got, []string{"db-1-template"}) {
+		t.Errorf("commandVolumes(unmapped) = %v, %v, want db-1-template", got, err)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/libgolang/log"
+)
+
+// dockerEvent event of the Docker Engine /events stream
+type dockerEvent struct {
+	Type   string `json:"Type"`
+	Action string `json:"Action"`
+	Actor  struct {
+		ID         string            `json:"ID"`
+		Attributes map[string]string `json:"Attributes"` // includes the container labels
+	} `json:"Actor"`
+}
+
+// dockerContainer container of the Docker Engine /containers/json list
+type dockerContainer struct {
+	ID     string            `json:"Id"`
+	Names  []string          `json:"Names"` // with a leading slash
+	State  string            `json:"State"`
+	Labels map[string]string `json:"Labels"`
+}
+
+// dockerWatcher attaches the volumes labelled on containers when they start
+// and detaches them when they stop
+type dockerWatcher struct {
+	client *http.Client
+	label  string
+	retry  time.Duration
+}
+
+// newDockerClient http client talking to the docker daemon on a unix socket
+func newDockerClient(socket string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+}
+
+// runWatch watch command.  Follows the docker events until interrupted
+func runWatch(c *command, args []string) (interface{}, error) {
+	fs := c.flagSet()
+	socket := fs.String("docker-socket", "/var/run/docker.sock", "Docker Engine API socket")
+	label := fs.String("label", ociVolumesAnnotation, "Container label listing the volumes of the container")
+	if err := c.parse(fs, args); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	w := &dockerWatcher{client: newDockerClient(*socket), label: *label, retry: 5 * time.Second}
+	w.run(ctx)
+	return []*VolumeResult{}, nil
+}
+
+// run follows the event stream, reconnecting when it breaks, until ctx is done
+func (w *dockerWatcher) run(ctx context.Context) {
+	for {
+		err := w.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Warn("Docker event stream ended: %v. Reconnecting in %s", err, w.retry)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(w.retry):
+		}
+	}
+}
+
+// follow reads container events until the stream ends
+func (w *dockerWatcher) follow(ctx context.Context) error {
+	filters, _ := json.Marshal(map[string][]string{
+		"type":  {"container"},
+		"event": {"create", "start", "die", "destroy"},
+	})
+	u := "http://docker/events?filters=" + url.QueryEscape(string(filters))
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("GET /events returned %d", resp.StatusCode)
+	}
+	// subscribed first so the events of the containers changing while they
+	// are listed wait in the stream
+	if err := w.reconcile(ctx); err != nil {
+		return err
+	}
+
+	log.Info("Watching docker container events")
+	dec := json.NewDecoder(resp.Body)
+	for {
+		ev := &dockerEvent{}
+		if err := dec.Decode(ev); err != nil {
+			return err
+		}
+		w.handle(ev)
+	}
+}
+
+// reconcile catches up on the events missed before the stream was opened:
+// the volumes of the labelled containers running are attached and those of
+// the stopped ones detached
+func (w *dockerWatcher) reconcile(ctx context.Context) error {
+	filters, _ := json.Marshal(map[string][]string{"label": {w.label}})
+	u := "http://docker/containers/json?all=1&filters=" + url.QueryEscape(string(filters))
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("GET /containers/json returned %d", resp.StatusCode)
+	}
+	var containers []dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return fmt.Errorf("unable to decode container list: %s", err)
+	}
+
+	for _, c := range containers {
+		ev := &dockerEvent{Type: "container", Action: "die"}
+		if c.State == "running" {
+			ev.Action = "start"
+		}
+		ev.Actor.ID = c.ID
+		ev.Actor.Attributes = make(map[string]string, len(c.Labels)+1)
+		for k, v := range c.Labels {
+			ev.Actor.Attributes[k] = v
+		}
+		if len(c.Names) > 0 {
+			ev.Actor.Attributes["name"] = strings.TrimPrefix(c.Names[0], "/")
+		}
+		w.handle(ev)
+	}
+	return nil
+}
+
+// handle attaches on create/start and detaches on die/destroy
+func (w *dockerWatcher) handle(ev *dockerEvent) {
+	vols := splitVolumes(ev.Actor.Attributes[w.label])
+	if len(vols) == 0 {
+		return
+	}
+	name := ev.Actor.Attributes["name"]
+	if name == "" {
+		name = ev.Actor.ID
+	}
+
+	st, err := loadState(*statePtr)
+	if err != nil {
+		log.Error("Unable to read state file %s: %s", *statePtr, err)
+		return
+	}
+	// create and start, die and destroy come in pairs, only act on the first
+	var pending []string
+	for _, v := range vols {
+		recorded := st.attachment(name, v) != nil
+		switch ev.Action {
+		case "create", "start":
+			if !recorded {
+				pending = append(pending, v)
+			}
+		case "die", "destroy":
+			if recorded {
+				pending = append(pending, v)
+			}
+		}
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	log.Info("Container %s %s, volumes %v", name, ev.Action, pending)
+	switch ev.Action {
+	case "create", "start":
+		_, err = attachAll(name, pending)
+	case "die", "destroy":
+		_, err = detachAll(name, pending)
+	}
+	if err != nil {
+		log.Error("Container %s %s: %s", name, ev.Action, err)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testVolumesLabel = "one-linode.volumes"
+
+// dockerStub Docker Engine API serving /containers/json and an /events
+// stream fed from events
+type dockerStub struct {
+	mu         sync.Mutex
+	containers []dockerContainer
+	listQuery  []string // filters of the /containers/json requests
+	connects   int      // /events requests
+	events     chan *dockerEvent
+	// endStream when set, the /events stream of the current connection ends
+	endStream chan struct{}
+}
+
+// startDockerStub serves the stub on a unix socket and returns a watcher of it
+func startDockerStub(t *testing.T) (*dockerStub, *dockerWatcher) {
+	t.Helper()
+	d := &dockerStub{events: make(chan *dockerEvent, 10)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/containers/json", func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		d.listQuery = append(d.listQuery, r.URL.Query().Get("filters"))
+		containers := d.containers
+		d.mu.Unlock()
+		_ = json.NewEncoder(w).Encode(containers)
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		d.connects++
+		end := d.endStream
+		d.mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		enc := json.NewEncoder(w)
+		for {
+			select {
+			case ev := <-d.events:
+				_ = enc.Encode(ev)
+				w.(http.Flusher).Flush()
+			case <-end:
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: mux}
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(func() { _ = srv.Close() })
+	return d, &dockerWatcher{client: newDockerClient(socket), label: testVolumesLabel, retry: 10 * time.Millisecond}
+}
+
+// containerEvent returns an event of the container labelled with vols
+func containerEvent(action, name, vols string) *dockerEvent {
+	ev := &dockerEvent{Type: "container", Action: action}
+	ev.Actor.ID = "id-" + name
+	ev.Actor.Attributes = map[string]string{"name": name}
+	if vols != "" {
+		ev.Actor.Attributes[testVolumesLabel] = vols
+	}
+	return ev
+}
+
+// waitFor polls cond until it holds or fails the test after 5 seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWatchHandle(t *testing.T) {
+	api, _ := setupTest(t)
+	_, w := startDockerStub(t)
+	data := api.addVolume("web-data", "us-east", 20, 0)
+	logs := api.addVolume("web-logs", "us-east", 20, 2)
+
+	w.handle(containerEvent("create", "web", "web-data,web-logs"))
+	for _, id := range []int{data, logs} {
+		if v := api.volume(id); v.LinodeID != 1 {
+			t.Errorf("%s attached to %d, want web1", v.Label, v.LinodeID)
+		}
+	}
+	if st := readState(t); len(st.holders("web-data")) != 1 || st.attachment("web", "web-logs") == nil {
+		t.Errorf("state = %+v", st.Containers)
+	}
+
+	// start follows create, the volumes are already attached
+	w.handle(containerEvent("start", "web", "web-data,web-logs"))
+	if n := api.called("POST /volumes/" + strconv.Itoa(data) + "/attach"); n != 1 {
+		t.Errorf("attached %d times, want 1", n)
+	}
+
+	w.handle(containerEvent("die", "web", "web-data,web-logs"))
+	w.handle(containerEvent("destroy", "web", "web-data,web-logs"))
+	for _, id := range []int{data, logs} {
+		if v := api.volume(id); v.LinodeID != 0 {
+			t.Errorf("%s still attached to %d", v.Label, v.LinodeID)
+		}
+	}
+	if n := api.called("POST /volumes/" + strconv.Itoa(data) + "/detach"); n != 2 {
+		// one detach before the attach, one on die
+		t.Errorf("detached %d times, want 2", n)
+	}
+	if len(readState(t).Containers) != 0 {
+		t.Errorf("state = %+v, want empty", readState(t).Containers)
+	}
+}
+
+func TestWatchHandleIgnoresUnlabelled(t *testing.T) {
+	api, _ := setupTest(t)
+	_, w := startDockerStub(t)
+	w.handle(containerEvent("start", "web", ""))
+	if n := api.called("GET /volumes"); n != 0 {
+		t.Errorf("unlabelled container made %d API calls", n)
+	}
+}
+
+func TestWatchReconcilesOnConnect(t *testing.T) {
+	api, _ := setupTest(t)
+	d, w := startDockerStub(t)
+	running := api.addVolume("web-data", "us-east", 20, 0)
+	stopped := api.addVolume("db-data", "us-east", 20, 1)
+	if err := recordAttachment(*statePtr, "db", "web1", &AttachmentState{VolumeID: stopped, Label: "db-data", LinodeID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	// web started and db stopped while the watcher was down
+	d.containers = []dockerContainer{
+		{ID: "id-web", Names: []string{"/web"}, State: "running", Labels: map[string]string{testVolumesLabel: "web-data"}},
+		{ID: "id-db", Names: []string{"/db"}, State: "exited", Labels: map[string]string{testVolumesLabel: "db-data"}},
+	}
+	d.endStream = make(chan struct{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	waitFor(t, "the reconcile", func() bool {
+		st, err := loadState(*statePtr)
+		return err == nil && st.attachment("web", "web-data") != nil && st.attachment("db", "db-data") == nil
+	})
+	if api.volume(running).LinodeID != 1 || api.volume(stopped).LinodeID != 0 {
+		t.Errorf("web-data on %d, db-data on %d, want web1 and none", api.volume(running).LinodeID, api.volume(stopped).LinodeID)
+	}
+	d.mu.Lock()
+	query := d.listQuery[0]
+	d.mu.Unlock()
+	if query != `{"label":["`+testVolumesLabel+`"]}` {
+		t.Errorf("containers listed with filters %s", query)
+	}
+
+	// events are followed after the reconcile
+	d.events <- containerEvent("die", "web", "web-data")
+	waitFor(t, "the die event", func() bool {
+		st, err := loadState(*statePtr)
+		return err == nil && st.attachment("web", "web-data") == nil
+	})
+
+	// the stream breaks with web listed as running again, the reconnect catches up
+	close(d.endStream)
+	waitFor(t, "the reconnect", func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.connects >= 2 && len(d.listQuery) >= 2
+	})
+	waitFor(t, "the reconcile after the reconnect", func() bool { return api.volume(running).LinodeID == 1 })
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/libgolang/log"
+	"gopkg.in/resty.v1"
+)
+
+// xmlrpcCall performs an XML-RPC method call.  Params can be strings, ints
+// and bools.  The result is decoded into string, int, bool, float64,
+// []interface{} and map[string]interface{} values
+func xmlrpcCall(endpoint, method string, params ...interface{}) (interface{}, error) {
+	body, err := encodeXMLRPCCall(method, params)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug("XML-RPC %s %s", endpoint, method)
+
+	resp, err := resty.R().
+		SetHeader("Content-Type", "text/xml").
+		SetBody(body).
+		Post(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() != 200 {
+		return nil, fmt.Errorf("XML-RPC %s returned error %d", method, resp.StatusCode())
+	}
+	return decodeXMLRPCResponse(resp.Body())
+}
+
+// encodeXMLRPCCall encodes a methodCall document
+func encodeXMLRPCCall(method string, params []interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	buf.WriteString(`<?xml version="1.0"?><methodCall><methodName>`)
+	_ = xml.EscapeText(buf, []byte(method))
+	buf.WriteString(`</methodName><params>`)
+	for _, p := range params {
+		buf.WriteString(`<param><value>`)
+		switch v := p.(type) {
+		case string:
+			buf.WriteString(`<string>`)
+			_ = xml.EscapeText(buf, []byte(v))
+			buf.WriteString(`</string>`)
+		case int:
+			fmt.Fprintf(buf, `<int>%d</int>`, v)
+		case bool:
+			b := 0
+			if v {
+				b = 1
+			}
+			fmt.Fprintf(buf, `<boolean>%d</boolean>`, b)
+		default:
+			return nil, fmt.Errorf("unsupported XML-RPC param type %T", p)
+		}
+		buf.WriteString(`</value></param>`)
+	}
+	buf.WriteString(`</params></methodCall>`)
+	return buf.Bytes(), nil
+}
+
+// decodeXMLRPCResponse decodes a methodResponse document.  Faults are returned as errors
+func decodeXMLRPCResponse(data []byte) (interface{}, error) {
+	root := &xmlNode{}
+	if err := xml.Unmarshal(data, root); err != nil {
+		return nil, fmt.Errorf("invalid XML-RPC response: %s", err)
+	}
+	if fault := root.child("fault", "value"); fault != nil {
+		v, err := decodeXMLRPCValue(fault)
+		if err != nil {
+			return nil, err
+		}
+		if m, ok := v.(map[string]interface{}); ok {
+			return nil, fmt.Errorf("XML-RPC fault %v: %v", m["faultCode"], m["faultString"])
+		}
+		return nil, fmt.Errorf("XML-RPC fault: %v", v)
+	}
+	value := root.child("params", "param", "value")
+	if value == nil {
+		return nil, fmt.Errorf("invalid XML-RPC response: no value")
+	}
+	return decodeXMLRPCValue(value)
+}
+
+// decodeXMLRPCValue decodes a <value> element
+func decodeXMLRPCValue(n *xmlNode) (interface{}, error) {
+	if len(n.Nodes) == 0 {
+		return n.Content, nil // untyped values are strings
+	}
+	v := &n.Nodes[0]
+	text := strings.TrimSpace(v.Content)
+	switch v.XMLName.Local {
+	case "string", "dateTime.iso8601", "base64":
+		return v.Content, nil
+	case "int", "i4", "i8":
+		return strconv.Atoi(text)
+	case "boolean":
+		return text == "1", nil
+	case "double":
+		return strconv.ParseFloat(text, 64)
+	case "array":
+		var values []interface{}
+		if data := v.child("data"); data != nil {
+			for _, e := range data.children("value") {
+				ev, err := decodeXMLRPCValue(e)
+				if err != nil {
+					return nil, err
+				}
+				values = append(values, ev)
+			}
+		}
+		return values, nil
+	case "struct":
+		m := make(map[string]interface{})
+		for _, member := range v.children("member") {
+			mv := member.child("value")
+			if mv == nil {
+				continue
+			}
+			ev, err := decodeXMLRPCValue(mv)
+			if err != nil {
+				return nil, err
+			}
+			m[member.text("name")] = ev
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("unsupported XML-RPC value type %s", v.XMLName.Local)
+	}
+}